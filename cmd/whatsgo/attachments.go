@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// Attachment is a media file of a message stored on disk
+type Attachment struct {
+	ID       string `json:"id"`
+	Path     string `json:"path"`
+	MimeType string `json:"mime_type,omitempty"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256,omitempty"`
+	FileName string `json:"file_name,omitempty"`
+	Caption  string `json:"caption,omitempty"`
+	Width    uint32 `json:"width,omitempty"`
+	Height   uint32 `json:"height,omitempty"`
+	Duration uint32 `json:"duration,omitempty"` // seconds
+}
+
+// UnmarshalJSON also accepts a bare path, which is how files were queued before attachments had metadata
+func (a *Attachment) UnmarshalJSON(data []byte) error {
+	var path string
+	if err := json.Unmarshal(data, &path); err == nil {
+		*a = Attachment{Path: path}
+		return nil
+	}
+	type attachment Attachment
+	return json.Unmarshal(data, (*attachment)(a))
+}
+
+// mediaMessage is a downloadable WhatsApp message with a file
+type mediaMessage interface {
+	whatsmeow.DownloadableMessage
+	GetMimetype() string
+	GetFileLength() uint64
+}
+
+// saveAttachment downloads the media into the sub folder under the given file name.
+// If an identical file was already stored, it is reused instead of downloading it again.
+func saveAttachment(media mediaMessage, subFolder string, fileName string, dbTracker *DBTracker) (Attachment, error) {
+	attachment := Attachment{
+		MimeType: media.GetMimetype(),
+		Size:     int64(media.GetFileLength()),
+		SHA256:   hex.EncodeToString(media.GetFileSHA256()),
+	}
+
+	if dbTracker != nil && attachment.SHA256 != "" {
+		path, err := dbTracker.GetFilePathByHash(attachment.SHA256)
+		if err != nil {
+			log.Warnf("Failed to look up file by hash: %v", err)
+		} else if path != "" {
+			if _, err := os.Stat(path); err == nil {
+				log.Infof("Reusing identical file %s", path)
+				attachment.Path = path
+				return attachment, nil
+			}
+		}
+	}
+
+	data, err := cli.Download(media)
+	if err != nil {
+		return attachment, fmt.Errorf("failed to download: %v", err)
+	}
+	hash := sha256.Sum256(data)
+	attachment.SHA256 = hex.EncodeToString(hash[:])
+	attachment.Size = int64(len(data))
+
+	// Create sub folder if it doesn't exist
+	if _, err := os.Stat(subFolder); os.IsNotExist(err) {
+		err = os.MkdirAll(subFolder, 0700)
+		if err != nil {
+			return attachment, fmt.Errorf("failed to create subfolder: %v", err)
+		}
+	}
+
+	attachment.Path = fmt.Sprintf("%s/%s", subFolder, fileName)
+	err = encryptor.WriteFile(attachment.Path, data)
+	if err != nil {
+		return attachment, err
+	}
+	return attachment, nil
+}
+
+// attachmentID returns the ID of the next attachment of the message
+func attachmentID(messageID string, attachments []Attachment) string {
+	return fmt.Sprintf("%s-%d", messageID, len(attachments)+1)
+}
+
+// attachmentPaths returns paths of the attachments
+func attachmentPaths(attachments []Attachment) []string {
+	paths := make([]string, len(attachments))
+	for i, attachment := range attachments {
+		paths[i] = attachment.Path
+	}
+	return paths
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	"gopkg.in/yaml.v3"
+	"io"
 	"os"
+	"strconv"
+	"time"
 )
 
 type CSVConfig struct {
@@ -11,8 +16,9 @@ type CSVConfig struct {
 }
 
 type DBConfig struct {
-	ConnectionString string `yaml:"connection_string"`
-	Dialect          string `yaml:"dialect"`
+	ConnectionString     string `yaml:"connection_string"`
+	ConnectionStringFile string `yaml:"connection_string_file,omitempty"`
+	Dialect              string `yaml:"dialect"`
 }
 
 type GoogleCloudConfig struct {
@@ -23,12 +29,118 @@ type GoogleCloudConfig struct {
 }
 
 type OCRConfig struct {
-	Enabled bool `yaml:"enabled"`
+	Enabled   bool          `yaml:"enabled"`
+	Binary    string        `yaml:"binary,omitempty"`
+	Languages string        `yaml:"languages,omitempty"`
+	Timeout   time.Duration `yaml:"timeout,omitempty"`
 }
 
+// RetryConfig overrides the retry settings of the queue, zero values keep them
+type RetryConfig struct {
+	MaxAttempts int           `yaml:"max_attempts,omitempty"`
+	BaseDelay   time.Duration `yaml:"base_delay,omitempty"`
+	MaxDelay    time.Duration `yaml:"max_delay,omitempty"`
+}
+
+// WebhookTarget is a URL that events are posted to. Requests are signed with the secret if it's set,
+// any 2xx status is accepted unless accepted codes are listed. Payload is `envelope` by default
+// or `raw` for the internal message format that was sent before the envelope.
+// A template renders the envelope into a body of its own, sent with the content type.
+// If events are listed, other events aren't sent to the target.
+type WebhookTarget struct {
+	Name          string            `yaml:"name"`
+	URL           string            `yaml:"url"`
+	Secret        string            `yaml:"secret,omitempty"`
+	SecretFile    string            `yaml:"secret_file,omitempty"`
+	Headers       map[string]string `yaml:"headers,omitempty"`
+	Timeout       time.Duration     `yaml:"timeout,omitempty"`
+	AcceptedCodes []int             `yaml:"accepted_codes,omitempty"`
+	Retry         RetryConfig       `yaml:"retry,omitempty"`
+	Payload       string            `yaml:"payload,omitempty"`
+	Template      string            `yaml:"template,omitempty"`
+	TemplateFile  string            `yaml:"template_file,omitempty"`
+	ContentType   string            `yaml:"content_type,omitempty"`
+	Events        []string          `yaml:"events,omitempty"`
+}
+
+// WebhookConfig lists the webhook targets. Attachment URLs in payloads start with FilesBaseURL,
+// the public address of the HTTP server.
 type WebhookConfig struct {
-	Enabled bool     `yaml:"enabled"`
-	URLs    []string `yaml:"urls"`
+	Enabled      bool            `yaml:"enabled"`
+	URLs         []string        `yaml:"urls,omitempty"`
+	Targets      []WebhookTarget `yaml:"targets,omitempty"`
+	FilesBaseURL string          `yaml:"files_base_url,omitempty"`
+}
+
+// GetTargets returns the targets, URLs of the plain `urls` list are targets named by their position
+func (c WebhookConfig) GetTargets() []WebhookTarget {
+	targets := append([]WebhookTarget{}, c.Targets...)
+	for i, url := range c.URLs {
+		targets = append(targets, WebhookTarget{Name: strconv.Itoa(i + 1), URL: url})
+	}
+	return targets
+}
+
+type QueueConfig struct {
+	Workers      int           `yaml:"workers"`
+	MaxAttempts  int           `yaml:"max_attempts"`
+	BaseDelay    time.Duration `yaml:"base_delay"`
+	MaxDelay     time.Duration `yaml:"max_delay"`
+	PollInterval time.Duration `yaml:"poll_interval"`
+}
+
+type DirectoryConfig struct {
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+}
+
+// RetentionRule limits how long media and messages of chats are kept, zero days keep them forever.
+// A rule without chats applies to all chats.
+type RetentionRule struct {
+	Chats        []string `yaml:"chats,omitempty"`
+	MediaDays    int      `yaml:"media_days"`
+	MessagesDays int      `yaml:"messages_days"`
+}
+
+type RetentionConfig struct {
+	Enabled     bool            `yaml:"enabled"`
+	Interval    time.Duration   `yaml:"interval"`
+	ArchivePath string          `yaml:"archive_path,omitempty"`
+	Rules       []RetentionRule `yaml:"rules"`
+}
+
+type EncryptionConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	KeyFile string `yaml:"key_file,omitempty"`
+}
+
+// Route sends messages that match all of its conditions to the tracker, an empty condition matches every message.
+// Chats are IDs or aliases, senders are JIDs or phone numbers.
+type Route struct {
+	Tracker  string   `yaml:"tracker"`
+	Chats    []string `yaml:"chats,omitempty"`
+	Senders  []string `yaml:"senders,omitempty"`
+	Types    []string `yaml:"types,omitempty"`
+	Keywords []string `yaml:"keywords,omitempty"`
+}
+
+// ChatSelector selects chats by JID or glob like `*@g.us`, by server like `g.us`, `s.whatsapp.net` or `newsletter`
+// and by regular expressions on the name of the chat
+type ChatSelector struct {
+	Chats   []string `yaml:"chats,omitempty"`
+	Servers []string `yaml:"servers,omitempty"`
+	Names   []string `yaml:"names,omitempty"`
+}
+
+// SenderFilter lists JIDs, phone numbers or globs of senders whose messages are tracked or skipped
+type SenderFilter struct {
+	Allow []string `yaml:"allow,omitempty"`
+	Deny  []string `yaml:"deny,omitempty"`
+}
+
+type FilterConfig struct {
+	Include ChatSelector `yaml:"include"`
+	Exclude ChatSelector `yaml:"exclude"`
+	Senders SenderFilter `yaml:"senders"`
 }
 
 type Chat struct {
@@ -37,22 +149,40 @@ type Chat struct {
 }
 
 type Config struct {
-	Chats           []Chat            `yaml:"chats"`
-	FileStoragePath string            `yaml:"file_storage_path"`
-	Database        DBConfig          `yaml:"database"`
-	CSV             CSVConfig         `yaml:"csv"`
-	GoogleCloud     GoogleCloudConfig `yaml:"google_cloud"`
-	OCR             OCRConfig         `yaml:"ocr"`
-	Webhook         WebhookConfig     `yaml:"webhook"`
+	Chats           []Chat              `yaml:"chats"`
+	FileStoragePath string              `yaml:"file_storage_path"`
+	Database        DBConfig            `yaml:"database"`
+	CSV             CSVConfig           `yaml:"csv"`
+	GoogleCloud     GoogleCloudConfig   `yaml:"google_cloud"`
+	OCR             OCRConfig           `yaml:"ocr"`
+	Webhook         WebhookConfig       `yaml:"webhook"`
+	Queue           QueueConfig         `yaml:"queue"`
+	Directory       DirectoryConfig     `yaml:"directory"`
+	Retention       RetentionConfig     `yaml:"retention"`
+	Encryption      EncryptionConfig    `yaml:"encryption"`
+	Routes          []Route             `yaml:"routes"`
+	Filters         FilterConfig        `yaml:"filters"`
+	Processors      []string            `yaml:"processors"`
+	Keywords        map[string][]string `yaml:"keywords"`
+
+	filter *ChatFilter
 }
 
+// LoadConfig reads the config file, unknown keys are rejected.
+// Environment variables and secret files are applied before the config is validated.
 func LoadConfig(file string) (*Config, error) {
 	var config Config
 	configFile, err := os.ReadFile(file)
 	if err != nil {
 		return nil, err
 	}
-	err = yaml.Unmarshal(configFile, &config)
+	decoder := yaml.NewDecoder(bytes.NewReader(configFile))
+	decoder.KnownFields(true)
+	err = decoder.Decode(&config)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+	err = prepareConfig(&config)
 	if err != nil {
 		return nil, err
 	}
@@ -60,22 +190,93 @@ func LoadConfig(file string) (*Config, error) {
 	return &config, nil
 }
 
-func (c *Config) IsChatTrackable(chatID string) bool {
-	if c.Chats == nil {
-		return true
+// LoadDefaultConfig returns the default config with environment variables and secret files applied
+func LoadDefaultConfig() (*Config, error) {
+	config := GetDefaultConfig()
+	err := prepareConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func prepareConfig(config *Config) error {
+	err := applyEnvOverrides(config)
+	if err != nil {
+		return err
+	}
+	err = resolveSecretFiles(config)
+	if err != nil {
+		return err
 	}
+	err = config.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	config.filter, err = CompileChatFilter(config)
+	return err
+}
+
+// chatFilter returns the filter compiled when the config was loaded
+func (c *Config) chatFilter() *ChatFilter {
+	if c.filter == nil {
+		filter, err := CompileChatFilter(c)
+		if err != nil {
+			log.Errorf("Invalid chat filters: %v", err)
+			filter, _ = CompileChatFilter(&Config{Chats: c.Chats})
+		}
+		c.filter = filter
+	}
+	return c.filter
+}
+
+// UseChatNames sets how names of chats are looked up for `filters.include.names` and `filters.exclude.names`
+func (c *Config) UseChatNames(chatName func(string) string) {
+	c.chatFilter().chatName = chatName
+}
+
+func (c *Config) IsChatTrackable(chatID string) bool {
+	return c.chatFilter().MatchChat(chatID)
+}
 
-	log.Infof("Checking if chat '%s' is trackable", chatID)
+// IsSenderTrackable reports whether messages of the sender pass `filters.senders`
+func (c *Config) IsSenderTrackable(senderID string) bool {
+	return c.chatFilter().MatchSender(senderID)
+}
+
+// GetChatFolder returns the alias of the chat or its ID if the chat has no alias
+func (c *Config) GetChatFolder(chatID string) string {
 	for _, chat := range c.Chats {
-		if chat.ID == chatID {
-			return true
+		if chat.ID == chatID && chat.Alias != "" {
+			return chat.Alias
 		}
 	}
-	return false
+	return chatID
+}
+
+// GetRetentionRule returns the first rule that lists the chat by ID or alias,
+// else the first rule that applies to all chats, or nil
+func (c *Config) GetRetentionRule(chatID string) *RetentionRule {
+	folder := c.GetChatFolder(chatID)
+	var fallback *RetentionRule
+	for i, rule := range c.Retention.Rules {
+		if len(rule.Chats) == 0 {
+			if fallback == nil {
+				fallback = &c.Retention.Rules[i]
+			}
+			continue
+		}
+		for _, chat := range rule.Chats {
+			if chat == chatID || chat == folder {
+				return &c.Retention.Rules[i]
+			}
+		}
+	}
+	return fallback
 }
 
 func GetDefaultConfig() *Config {
-	return &Config{
+	config := &Config{
 		Chats:           nil,
 		FileStoragePath: "file-storage",
 		Database: DBConfig{
@@ -92,7 +293,26 @@ func GetDefaultConfig() *Config {
 			TokenFile:       "token.json",
 		},
 		OCR: OCRConfig{
-			Enabled: false,
+			Enabled:   false,
+			Binary:    defaultOCRBinary,
+			Languages: defaultOCRLanguages,
+			Timeout:   defaultOCRTimeout,
+		},
+		Queue: QueueConfig{
+			Workers:      defaultQueueWorkers,
+			MaxAttempts:  defaultQueueMaxAttempts,
+			BaseDelay:    defaultQueueBaseDelay,
+			MaxDelay:     defaultQueueMaxDelay,
+			PollInterval: defaultQueuePollInterval,
+		},
+		Directory: DirectoryConfig{
+			RefreshInterval: defaultDirectoryRefreshInterval,
+		},
+		Retention: RetentionConfig{
+			Enabled:  false,
+			Interval: defaultRetentionInterval,
 		},
 	}
+	config.filter, _ = CompileChatFilter(config)
+	return config
 }
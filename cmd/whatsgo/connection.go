@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// States of the connection to WhatsApp
+const (
+	ConnectionConnected         = "connected"
+	ConnectionDisconnected      = "disconnected"
+	ConnectionLoggedOut         = "logged_out"
+	ConnectionStreamReplaced    = "stream_replaced"
+	ConnectionKeepAliveTimeout  = "keepalive_timeout"
+	ConnectionKeepAliveRestored = "keepalive_restored"
+)
+
+// ConnectionState is a change of the connection to WhatsApp
+type ConnectionState struct {
+	State  string `json:"state"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// trackConnectionState passes a change of the connection to trackers and to clients of the events WebSocket.
+// Connection events don't belong to a chat, so chat filters don't apply to them.
+func trackConnectionState(state ConnectionState, queue *TrackerQueue, server *Server) {
+	timestamp := time.Now().Round(0)
+	message := TrackableMessage{
+		Event:      EventConnection,
+		MessageID:  fmt.Sprintf("connection-%d-%s", timestamp.UnixNano(), state.State),
+		Timestamp:  timestamp.String(),
+		Connection: &state,
+		Metadata: MessageMetadata{
+			Date:      timestamp.Format("02.01.2006"),
+			Timestamp: timestamp,
+		},
+	}
+
+	log.Infof("Tracking %s %s", message.Event, state.State)
+	err := queue.Enqueue(&message)
+	if err != nil {
+		log.Errorf("Failed to enqueue %s %s: %v", message.Event, message.MessageID, err)
+		return
+	}
+	if server != nil {
+		server.broadcastEvent(message.Event, message)
+	}
+}
@@ -5,11 +5,17 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"sync"
 )
 
 type CSVTracker struct {
 	config CSVConfig
 	chats  []Chat
+	mu     sync.Mutex
+}
+
+func (tracker *CSVTracker) Name() string {
+	return "csv"
 }
 
 func (tracker *CSVTracker) Init(config *Config) error {
@@ -18,20 +24,61 @@ func (tracker *CSVTracker) Init(config *Config) error {
 	return nil
 }
 
+// Rows start with id, sender, chat, content, parsed content and timestamp. Rows written before annotations
+// were added continue with file paths, newer rows with the layout marker, annotations, sender name, chat name
+// and then file paths, so the variable number of files stays at the end of both.
+const (
+	csvContentColumn = 3
+	csvLayoutColumn  = 6
+	csvLayoutV2      = "v2"
+)
+
+// csvLayout returns the positions of the annotations and the first file path of the row,
+// the annotations position is -1 for rows that have none
+func csvLayout(record []string) (annotations int, files int) {
+	if len(record) > csvLayoutColumn && record[csvLayoutColumn] == csvLayoutV2 {
+		return csvLayoutColumn + 1, csvLayoutColumn + 4
+	}
+	return -1, csvLayoutColumn
+}
+
+// upgradeCSVRecord converts a row to the current layout
+func upgradeCSVRecord(record []string) []string {
+	if annotations, _ := csvLayout(record); annotations >= 0 {
+		return record
+	}
+	upgraded := make([]string, 0, len(record)+4)
+	upgraded = append(upgraded, record[:csvLayoutColumn]...)
+	upgraded = append(upgraded, csvLayoutV2, "", "", "")
+	return append(upgraded, record[csvLayoutColumn:]...)
+}
+
 func (tracker *CSVTracker) TrackMessage(message *TrackableMessage) error {
+	if !message.IsMessageEvent() {
+		return nil
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	if message.Event == EventMessageEdited || message.Event == EventMessageRevoked {
+		return tracker.updateRecord(message)
+	}
+
 	// Create the directory path
-	dirPath := fmt.Sprintf("%s/%s/%s", tracker.config.Path, message.Metadata.Folder, message.Metadata.Date)
+	dirPath := tracker.dirPath(message)
 	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
 		os.MkdirAll(dirPath, 0755)
 	}
 
 	// Open the CSV file
 	fileName := fmt.Sprintf("%s/messages.csv", dirPath)
-	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0755)
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
 	if err != nil {
 		log.Errorf("Failed to open CSV file: %v", err)
 		return err
 	}
+	defer file.Close()
 
 	// Write the message to the CSV file
 	csvWriter := csv.NewWriter(file)
@@ -42,9 +89,13 @@ func (tracker *CSVTracker) TrackMessage(message *TrackableMessage) error {
 		strings.ReplaceAll(message.Content, "\n", " "),
 		strings.ReplaceAll(message.ParsedContent, "\n", " "),
 		message.Timestamp,
+		csvLayoutV2,
+		formatAnnotations(message.Annotations),
+		message.SenderName,
+		message.ChatName,
 	}
 	for _, file := range message.Files {
-		record = append(record, file)
+		record = append(record, file.Path)
 	}
 	if err := csvWriter.Write(record); err != nil {
 		log.Errorf("Failed to write record to CSV: %v", err)
@@ -53,3 +104,107 @@ func (tracker *CSVTracker) TrackMessage(message *TrackableMessage) error {
 	csvWriter.Flush()
 	return csvWriter.Error()
 }
+
+func (tracker *CSVTracker) dirPath(message *TrackableMessage) string {
+	return fmt.Sprintf("%s/%s/%s", tracker.config.Path, message.Metadata.Folder, message.Metadata.Date)
+}
+
+// updateRecord rewrites the row of an edited or revoked message in the CSV file of the original message
+func (tracker *CSVTracker) updateRecord(message *TrackableMessage) error {
+	fileName := fmt.Sprintf("%s/messages.csv", tracker.dirPath(message))
+	records, err := readCSV(fileName)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("changed message %s: %w", message.MessageID, errMessageNotStored)
+	}
+	if err != nil {
+		log.Errorf("Failed to read CSV file: %v", err)
+		return err
+	}
+
+	found := false
+	for i, record := range records {
+		if len(record) < csvLayoutColumn || record[0] != message.MessageID {
+			continue
+		}
+		record = upgradeCSVRecord(record)
+		annotations, _ := csvLayout(record)
+		if message.Event == EventMessageEdited {
+			record[csvContentColumn] = strings.ReplaceAll(message.Content, "\n", " ")
+		}
+		if record[annotations] != "" {
+			record[annotations] += "; "
+		}
+		record[annotations] += changeAnnotation(message)
+		records[i] = record
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("changed message %s in %s: %w", message.MessageID, fileName, errMessageNotStored)
+	}
+
+	return writeCSV(fileName, records)
+}
+
+// RemoveRecords deletes rows of the messages and file paths of the messages with expired media
+// from the CSV file of the chat folder and the date
+func (tracker *CSVTracker) RemoveRecords(folder string, date string, messages map[string]bool, media map[string]bool) error {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	fileName := fmt.Sprintf("%s/%s/%s/messages.csv", tracker.config.Path, folder, date)
+	records, err := readCSV(fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var kept [][]string
+	for _, record := range records {
+		if messages[record[0]] {
+			continue
+		}
+		if _, files := csvLayout(record); media[record[0]] && len(record) > files {
+			record = record[:files]
+		}
+		kept = append(kept, record)
+	}
+	if len(kept) == 0 {
+		return os.Remove(fileName)
+	}
+	return writeCSV(fileName, kept)
+}
+
+func readCSV(fileName string) ([][]string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	csvReader := csv.NewReader(file)
+	// Rows have a different number of columns because of files
+	csvReader.FieldsPerRecord = -1
+	return csvReader.ReadAll()
+}
+
+// writeCSV replaces the file with the records through a temporary file
+func writeCSV(fileName string, records [][]string) error {
+	tmpName := fileName + ".tmp"
+	file, err := os.OpenFile(tmpName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	csvWriter := csv.NewWriter(file)
+	err = csvWriter.WriteAll(records)
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(tmpName, fileName)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCSVLayout(t *testing.T) {
+	tests := []struct {
+		name        string
+		record      []string
+		annotations int
+		files       int
+	}{
+		{"old row without files", []string{"1", "s", "c", "hi", "", "1714546800"}, -1, 6},
+		{"old row with files", []string{"1", "s", "c", "hi", "", "1714546800", "files/a.jpg", "files/b.jpg"}, -1, 6},
+		{"row without files", []string{"1", "s", "c", "hi", "", "1714546800", "v2", "", "Ann", "Team"}, 7, 10},
+		{"row with files", []string{"1", "s", "c", "hi", "", "1714546800", "v2", "k=v", "Ann", "Team", "files/a.jpg"}, 7, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations, files := csvLayout(tt.record)
+			if annotations != tt.annotations || files != tt.files {
+				t.Errorf("csvLayout() = %d, %d, want %d, %d", annotations, files, tt.annotations, tt.files)
+			}
+		})
+	}
+}
+
+func TestCSVTracker(t *testing.T) {
+	tracker := &CSVTracker{config: CSVConfig{Enabled: true, Path: t.TempDir()}}
+	metadata := MessageMetadata{Folder: "team", Date: "2024-05-01"}
+	fileName := filepath.Join(tracker.config.Path, "team", "2024-05-01", "messages.csv")
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Rows written before annotations were added
+	old := [][]string{
+		{"OLD1", "s@s.whatsapp.net", "c@g.us", "photos", "", "1714546800", "files/a.jpg", "files/b.jpg"},
+		{"OLD2", "s@s.whatsapp.net", "c@g.us", "hello", "", "1714546801"},
+	}
+	if err := writeCSV(fileName, old); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := []*TrackableMessage{
+		{Event: EventMessageCreated, MessageID: "NEW", Sender: "s@s.whatsapp.net", SenderName: "Ann", Chat: "c@g.us",
+			ChatName: "Team", Content: "two\nlines", Timestamp: "1714546802", Metadata: metadata,
+			Files:       []Attachment{{Path: "files/c.jpg"}},
+			Annotations: []Annotation{{Processor: "language", Key: "language", Value: "en"}}},
+		{Event: EventMessageEdited, MessageID: "OLD1", Content: "edited", EventTimestamp: "1714546900", Metadata: metadata},
+		{Event: EventMessageRevoked, MessageID: "NEW", EventTimestamp: "1714546901", Metadata: metadata},
+	}
+	for _, message := range messages {
+		if err := tracker.TrackMessage(message); err != nil {
+			t.Fatalf("TrackMessage(%s %s) error = %v", message.Event, message.MessageID, err)
+		}
+	}
+	want := [][]string{
+		{"OLD1", "s@s.whatsapp.net", "c@g.us", "edited", "", "1714546800", "v2", "edited_at=1714546900", "", "",
+			"files/a.jpg", "files/b.jpg"},
+		{"OLD2", "s@s.whatsapp.net", "c@g.us", "hello", "", "1714546801"},
+		{"NEW", "s@s.whatsapp.net", "c@g.us", "two lines", "", "1714546802", "v2",
+			"language=en; revoked_at=1714546901", "Ann", "Team", "files/c.jpg"},
+	}
+	assertCSV(t, fileName, want)
+
+	// Clearing media keeps the columns before the file paths of either layout
+	old = [][]string{
+		{"OLD3", "s@s.whatsapp.net", "c@g.us", "photo", "", "1714546803", "files/d.jpg"},
+	}
+	records, err := readCSV(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeCSV(fileName, append(records, old...)); err != nil {
+		t.Fatal(err)
+	}
+	err = tracker.RemoveRecords("team", "2024-05-01", map[string]bool{"OLD2": true},
+		map[string]bool{"OLD1": true, "NEW": true, "OLD3": true})
+	if err != nil {
+		t.Fatalf("RemoveRecords() error = %v", err)
+	}
+	want = [][]string{
+		{"OLD1", "s@s.whatsapp.net", "c@g.us", "edited", "", "1714546800", "v2", "edited_at=1714546900", "", ""},
+		{"NEW", "s@s.whatsapp.net", "c@g.us", "two lines", "", "1714546802", "v2",
+			"language=en; revoked_at=1714546901", "Ann", "Team"},
+		{"OLD3", "s@s.whatsapp.net", "c@g.us", "photo", "", "1714546803"},
+	}
+	assertCSV(t, fileName, want)
+}
+
+func assertCSV(t *testing.T, fileName string, want [][]string) {
+	t.Helper()
+	records, err := readCSV(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("%s =\n%q\nwant\n%q", fileName, records, want)
+	}
+}
+
+func TestCSVTrackerChangesOfUnknownMessages(t *testing.T) {
+	tracker := &CSVTracker{config: CSVConfig{Enabled: true, Path: t.TempDir()}}
+	metadata := MessageMetadata{Folder: "team", Date: "2024-05-01"}
+	edit := &TrackableMessage{Event: EventMessageEdited, MessageID: "UNKNOWN", Content: "edited", Metadata: metadata}
+	// No file for the day
+	if err := tracker.TrackMessage(edit); !errors.Is(err, errMessageNotStored) {
+		t.Fatalf("TrackMessage() error = %v, want %v", err, errMessageNotStored)
+	}
+	// No row of the message
+	created := &TrackableMessage{Event: EventMessageCreated, MessageID: "KNOWN", Content: "hi", Metadata: metadata}
+	if err := tracker.TrackMessage(created); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.TrackMessage(edit); !errors.Is(err, errMessageNotStored) {
+		t.Fatalf("TrackMessage() error = %v, want %v", err, errMessageNotStored)
+	}
+	assertCSV(t, filepath.Join(tracker.config.Path, "team", "2024-05-01", "messages.csv"),
+		[][]string{{"KNOWN", "", "", "hi", "", "", "v2", "", "", ""}})
+}
@@ -2,54 +2,24 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
+	"strings"
 	"time"
 )
 
 // DBTracker is a struct for tracking messages in a database
 type DBTracker struct {
-	db     *sql.DB
+	db     *DB
 	config *Config
 }
 
+func (tracker *DBTracker) Name() string {
+	return "db"
+}
+
 func (tracker *DBTracker) Init(config *Config) error {
 	tracker.config = config
-	// Create table for messages
-	_, err := tracker.db.Exec(`
-		CREATE TABLE IF NOT EXISTS messages (
-			id TEXT PRIMARY KEY,
-			sender TEXT,
-			chat TEXT,
-			content TEXT,
-			parsed_content TEXT,
-			timestamp TEXT
-		)
-	`)
-	if err != nil {
-		return err
-	}
-
-	// Create table for files
-	_, err = tracker.db.Exec(`
-		CREATE TABLE IF NOT EXISTS files (
-			id TEXT PRIMARY KEY,
-			path TEXT,
-			message_id TEXT,
-			FOREIGN KEY(message_id) REFERENCES messages(id)
-		)
-	`)
-	if err != nil {
-		return err
-	}
-
-	// Check if parsedContent column exists and create it if not
-	_, err = tracker.db.Exec(`SELECT parsed_content FROM messages LIMIT 1`)
-	if err != nil {
-		_, err = tracker.db.Exec(`ALTER TABLE messages ADD COLUMN parsed_content TEXT DEFAULT ''`)
-		if err != nil {
-			return err
-		}
-	}
-
+	// The schema is created by migrations, see migrate.go
 	return nil
 }
 
@@ -76,108 +46,655 @@ func (tracker *DBTracker) GetChats() ([]string, error) {
 }
 
 func (tracker *DBTracker) GetMessagesByChat(chat string, date time.Time) ([]TrackableMessage, error) {
-	var rows *sql.Rows
-	var err error
-	query := `SELECT id, sender, chat, content, parsed_content, timestamp FROM messages WHERE chat = ? AND date(substr(timestamp,0,11)) = date(?)`
+	from := startOfDay(date)
+	query := `SELECT ` + messageColumns + ` FROM messages WHERE chat = ? AND ts >= ? AND ts < ? ORDER BY ts`
 	log.Infof("Query date: %s", date.Format("2006-01-02"))
-	rows, err = tracker.db.Query(query, chat, date.Format("2006-01-02"))
+	return tracker.queryMessages(query, chat, from.Unix(), from.AddDate(0, 0, 1).Unix())
+}
+
+// GetMessage returns the stored message or nil if there is no message with such ID
+func (tracker *DBTracker) GetMessage(messageID string) (*TrackableMessage, error) {
+	messages, err := tracker.queryMessages(`SELECT `+messageColumns+` FROM messages WHERE id = ?`, messageID)
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+	return &messages[0], nil
+}
 
+// HasMessage reports whether the message is stored in the database
+func (tracker *DBTracker) HasMessage(messageID string) (bool, error) {
+	var count int
+	err := tracker.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE id = ?`, messageID).Scan(&count)
+	return count > 0, err
+}
+
+// messageColumns are the columns of the messages table read by queryMessages
+const messageColumns = `id, sender, chat, content, parsed_content, timestamp, ` + locationColumns + `, ` + contextColumns
+
+func (tracker *DBTracker) queryMessages(query string, args ...interface{}) ([]TrackableMessage, error) {
+	rows, err := tracker.db.Query(query, args...)
 	if err != nil {
 		log.Errorf("Failed to query messages from database: %v", err)
 		return nil, err
 	}
 	defer rows.Close()
 
-	folder := chat
-	for _, c := range tracker.config.Chats {
-		if c.ID == chat && c.Alias != "" {
-			folder = c.Alias
-			break
-		}
-	}
-
 	var messages []TrackableMessage
+	var contexts []nullContext
 	for rows.Next() {
 		var message TrackableMessage
-		err := rows.Scan(&message.MessageID, &message.Sender, &message.Chat, &message.Content, &message.ParsedContent, &message.Timestamp)
+		var location nullLocation
+		var context nullContext
+		err := rows.Scan(&message.MessageID, &message.Sender, &message.Chat, &message.Content, &message.ParsedContent, &message.Timestamp,
+			&location.latitude, &location.longitude, &location.accuracy, &location.name, &location.address, &location.live,
+			&context.quotedMessageID, &context.quotedSender, &context.forwarded, &context.forwardingScore)
 		if err != nil {
 			log.Errorf("Failed to scan message from database: %v", err)
 			return nil, err
 		}
+		err = encryptor.decryptTexts(&message.Content, &message.ParsedContent)
+		if err != nil {
+			log.Errorf("Failed to decrypt message %s: %v", message.MessageID, err)
+			return nil, err
+		}
 		// parse timestamp
-		message.Metadata.Timestamp, err = time.Parse("2006-01-02 15:04:05 -0700 MST", message.Timestamp)
-		message.Metadata.Folder = folder
+		message.Metadata.Timestamp, err = parseMessageTimestamp(message.Timestamp)
+		message.Metadata.Folder = tracker.config.GetChatFolder(message.Chat)
 		message.Metadata.Date = message.Metadata.Timestamp.Format("02.01.2006")
+		message.Location = location.Location()
+		messages = append(messages, message)
+		contexts = append(contexts, context)
+	}
+	rows.Close()
 
-		files, err := tracker.GetFilesByMessage(message.MessageID)
+	// Files, annotations and mentions are queried after the rows are closed to not hold two connections at once
+	for i := range messages {
+		files, err := tracker.GetFilesByMessage(messages[i].MessageID)
 		if err != nil {
 			return nil, err
 		}
-		message.Files = files
+		messages[i].Files = files
 
-		messages = append(messages, message)
+		annotations, err := tracker.GetAnnotationsByMessage(messages[i].MessageID)
+		if err != nil {
+			return nil, err
+		}
+		messages[i].Annotations = annotations
+
+		contexts[i].mentions, err = tracker.GetMentionsByMessage(messages[i].MessageID)
+		if err != nil {
+			return nil, err
+		}
+		messages[i].Context = contexts[i].Context()
 	}
 
 	return messages, nil
 }
 
-func (tracker *DBTracker) GetFilesByMessage(messageID string) ([]string, error) {
-	rows, err := tracker.db.Query(`SELECT path FROM files WHERE message_id = ?`, messageID)
+func (tracker *DBTracker) GetFilesByMessage(messageID string) ([]Attachment, error) {
+	files, err := queryAttachments(tracker.db, messageID)
 	if err != nil {
 		log.Errorf("Failed to query files from database: %v", err)
+	}
+	return files, err
+}
+
+// queryAttachments returns the files of a message
+func queryAttachments(db *DB, messageID string) ([]Attachment, error) {
+	rows, err := db.Query(`
+		SELECT id, path, mime_type, size, sha256, file_name, caption, width, height, duration
+		FROM files WHERE message_id = ? ORDER BY id`, messageID)
+	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var files []string
+	var files []Attachment
 	for rows.Next() {
-		var file string
-		err := rows.Scan(&file)
+		var file Attachment
+		var mimeType, hash, fileName, caption sql.NullString
+		var size, width, height, duration sql.NullInt64
+		err := rows.Scan(&file.ID, &file.Path, &mimeType, &size, &hash, &fileName, &caption, &width, &height, &duration)
+		if err != nil {
+			return nil, err
+		}
+		file.MimeType, file.SHA256, file.FileName, file.Caption = mimeType.String, hash.String, fileName.String, caption.String
+		file.Size = size.Int64
+		file.Width, file.Height, file.Duration = uint32(width.Int64), uint32(height.Int64), uint32(duration.Int64)
+		err = encryptor.decryptTexts(&file.Caption)
 		if err != nil {
-			log.Errorf("Failed to scan file from database: %v", err)
 			return nil, err
 		}
 		files = append(files, file)
 	}
 
-	return files, nil
+	return files, rows.Err()
+}
+
+// GetFilePathByHash returns the path of a stored file with the SHA-256 hash or an empty string
+func (tracker *DBTracker) GetFilePathByHash(hash string) (string, error) {
+	var path string
+	err := tracker.db.QueryRow(`SELECT path FROM files WHERE sha256 = ? LIMIT 1`, hash).Scan(&path)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return path, err
+}
+
+func (tracker *DBTracker) GetMentionsByMessage(messageID string) ([]string, error) {
+	mentions, err := queryMentions(tracker.db, messageID)
+	if err != nil {
+		log.Errorf("Failed to query mentions from database: %v", err)
+	}
+	return mentions, err
+}
+
+// queryMentions returns the JIDs mentioned in a message
+func queryMentions(db *DB, messageID string) ([]string, error) {
+	rows, err := db.Query(`SELECT jid FROM mentions WHERE message_id = ?`, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mentions []string
+	for rows.Next() {
+		var jid string
+		err := rows.Scan(&jid)
+		if err != nil {
+			return nil, err
+		}
+		mentions = append(mentions, jid)
+	}
+	return mentions, rows.Err()
 }
 
-// StoreMessage stores a message in the database
-func (tracker *DBTracker) storeMessage(messageID string, sender string, chat string, content string, parsedContent string, timestamp string) error {
-	_, err := tracker.db.Exec(`INSERT INTO messages (id, sender, chat, content, parsed_content, timestamp) VALUES (?, ?, ?, ?, ?, ?)`,
-		messageID, sender, chat, content, parsedContent, timestamp)
+func (tracker *DBTracker) GetAnnotationsByMessage(messageID string) ([]Annotation, error) {
+	rows, err := tracker.db.Query(`SELECT processor, key, value FROM message_annotations WHERE message_id = ?`, messageID)
+	if err != nil {
+		log.Errorf("Failed to query annotations from database: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var annotations []Annotation
+	for rows.Next() {
+		var annotation Annotation
+		err := rows.Scan(&annotation.Processor, &annotation.Key, &annotation.Value)
+		if err != nil {
+			log.Errorf("Failed to scan annotation from database: %v", err)
+			return nil, err
+		}
+		annotations = append(annotations, annotation)
+	}
+
+	return annotations, nil
+}
+
+// StoreMessage stores a message in the database, it returns false if the message is already stored
+func (tracker *DBTracker) storeMessage(tx *Tx, message *TrackableMessage) (bool, error) {
+	var location nullLocation
+	if message.Location != nil {
+		location = newNullLocation(message.Location)
+	}
+	context := message.Context
+	if context == nil {
+		context = &MessageContext{}
+	}
+	var ts sql.NullInt64
+	if timestamp, err := messageTime(message); err == nil {
+		ts = sql.NullInt64{Int64: timestamp.Unix(), Valid: true}
+	} else {
+		log.Warnf("Failed to parse timestamp of message %s: %v", message.MessageID, err)
+	}
+	content, err := encryptor.EncryptText(message.Content)
+	if err != nil {
+		return false, err
+	}
+	parsedContent, err := encryptor.EncryptText(message.ParsedContent)
+	if err != nil {
+		return false, err
+	}
+	result, err := tx.Exec(`INSERT INTO messages (id, sender, chat, content, parsed_content, timestamp, ts, `+locationColumns+`, `+contextColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (id) DO NOTHING`,
+		message.MessageID, nonADJID(message.Sender), message.Chat, content, parsedContent, message.Timestamp, ts,
+		location.latitude, location.longitude, location.accuracy, location.name, location.address, location.live,
+		nullString(context.QuotedMessageID), nullString(context.QuotedSender), context.Forwarded, context.ForwardingScore)
 	if err != nil {
 		log.Errorf("Failed to insert message into database: %v", err)
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count > 0, err
+}
+
+func (tracker *DBTracker) TrackMessage(message *TrackableMessage) error {
+	switch message.Event {
+	case EventMessageEdited:
+		return tracker.editMessage(message)
+	case EventMessageRevoked:
+		return tracker.revokeMessage(message)
+	case EventReaction:
+		return tracker.storeReaction(message)
+	case EventPollVote:
+		return tracker.storePollVote(message)
+	case EventGroupChange:
+		return tracker.storeGroupChange(message)
+	case EventConnection:
+		// The connection state isn't stored
+		return nil
+	}
+
+	// Store the message with its files in one transaction, so a failed attempt can be retried
+	tx, err := tracker.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stored, err := tracker.storeMessage(tx, message)
+	if err != nil {
+		return err
+	}
+	// A replay of a job whose attempt was committed before the queue was updated, e.g. after a crash.
+	// The message was stored with its files and the rest in one transaction, so there is nothing left to do.
+	if !stored {
+		log.Infof("Message %s is already stored, skipping", message.MessageID)
+		return nil
+	}
+
+	if message.Context != nil {
+		for _, jid := range message.Context.Mentions {
+			err = tracker.storeMention(tx, message.MessageID, jid)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if message.Poll != nil {
+		err = tracker.storePoll(tx, message)
+		if err != nil {
+			return err
+		}
+	}
+
+	if message.Location != nil && message.Location.Live {
+		err = tracker.storeLocationTrack(tx, message)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, file := range message.Files {
+		// Files queued before attachments had IDs
+		if file.ID == "" {
+			file.ID = fmt.Sprintf("%s-%d", message.MessageID, i+1)
+		}
+		err = tracker.storeFile(tx, message.MessageID, file)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, annotation := range message.Annotations {
+		err = tracker.storeAnnotation(tx, message.MessageID, annotation)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// editMessage updates the content of the message and keeps all its versions in message_revisions
+func (tracker *DBTracker) editMessage(message *TrackableMessage) error {
+	content, err := encryptor.EncryptText(message.Content)
+	if err != nil {
+		return err
+	}
+
+	tx, err := tracker.db.Begin()
+	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
+
+	// The original version is added to the history on the first edit
+	_, err = tx.Exec(`
+		INSERT INTO message_revisions (message_id, content, timestamp)
+		SELECT id, content, timestamp FROM messages
+		WHERE id = ? AND NOT EXISTS (SELECT 1 FROM message_revisions WHERE message_id = ?)`,
+		message.MessageID, message.MessageID)
+	if err != nil {
+		log.Errorf("Failed to insert message revision into database: %v", err)
+		return err
+	}
+
+	result, err := tx.Exec(`UPDATE messages SET content = ?, edited_at = ? WHERE id = ?`, content, message.EventTimestamp, message.MessageID)
+	if err != nil {
+		log.Errorf("Failed to update message in database: %v", err)
+		return err
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		return fmt.Errorf("edited message %s: %w", message.MessageID, errMessageNotStored)
+	}
+
+	_, err = tx.Exec(`INSERT INTO message_revisions (message_id, content, timestamp) VALUES (?, ?, ?)`, message.MessageID, content, message.EventTimestamp)
+	if err != nil {
+		log.Errorf("Failed to insert message revision into database: %v", err)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// revokeMessage marks the message as deleted, its content is kept
+func (tracker *DBTracker) revokeMessage(message *TrackableMessage) error {
+	result, err := tracker.db.Exec(`UPDATE messages SET deleted_at = ? WHERE id = ?`, message.EventTimestamp, message.MessageID)
+	if err != nil {
+		log.Errorf("Failed to update message in database: %v", err)
+		return err
+	}
+	if count, _ := result.RowsAffected(); count == 0 {
+		return fmt.Errorf("revoked message %s: %w", message.MessageID, errMessageNotStored)
+	}
 	return nil
 }
 
-func (tracker *DBTracker) TrackMessage(message *TrackableMessage) error {
+// StoreMention stores a user mentioned in the message
+func (tracker *DBTracker) storeMention(tx *Tx, messageID string, jid string) error {
+	_, err := tx.Exec(`INSERT INTO mentions (message_id, jid) VALUES (?, ?) ON CONFLICT DO NOTHING`, messageID, jid)
+	if err != nil {
+		log.Errorf("Failed to insert mention into database: %v", err)
+		return err
+	}
+	return nil
+}
 
-	err := tracker.storeMessage(message.MessageID, message.Sender, message.Chat, message.Content, message.ParsedContent, message.Timestamp)
+// storeReaction replaces the reaction of the sender to the message, an empty emoji removes it
+func (tracker *DBTracker) storeReaction(message *TrackableMessage) error {
+	var err error
+	if message.Reaction.Emoji == "" {
+		_, err = tracker.db.Exec(`DELETE FROM reactions WHERE message_id = ? AND sender = ?`, message.Reaction.MessageID, message.Sender)
+	} else {
+		_, err = tracker.db.Exec(`
+			INSERT INTO reactions (message_id, sender, chat, emoji, timestamp) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(message_id, sender) DO UPDATE SET emoji = excluded.emoji, timestamp = excluded.timestamp`,
+			message.Reaction.MessageID, message.Sender, message.Chat, message.Reaction.Emoji, message.Timestamp)
+	}
 	if err != nil {
+		log.Errorf("Failed to store reaction in database: %v", err)
 		return err
 	}
+	return nil
+}
+
+// storeGroupChange adds the change of a group to the audit log, one row per participant
+func (tracker *DBTracker) storeGroupChange(message *TrackableMessage) error {
+	var ts sql.NullInt64
+	if timestamp, err := messageTime(message); err == nil {
+		ts = sql.NullInt64{Int64: timestamp.Unix(), Valid: true}
+	}
+	change := message.GroupChange
+	// Changes of the subject, the description and the picture have no participants
+	participants := []sql.NullString{{}}
+	if len(change.Participants) > 0 {
+		participants = nil
+		for _, participant := range change.Participants {
+			participants = append(participants, nullString(participant))
+		}
+	}
 
-	for _, file := range message.Files {
-		err = tracker.storeFile(message.MessageID, file)
+	tx, err := tracker.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// A replayed job finds the rows of its committed attempt
+	var stored int
+	err = tx.QueryRow(`SELECT count(*) FROM group_events WHERE event_id = ?`, message.MessageID).Scan(&stored)
+	if err != nil {
+		return err
+	}
+	if stored > 0 {
+		log.Infof("Group event %s is already stored, skipping", message.MessageID)
+		return nil
+	}
+
+	for _, participant := range participants {
+		_, err = tx.Exec(`INSERT INTO group_events (event_id, chat, type, actor, participant, value, reason, timestamp, ts) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			message.MessageID, message.Chat, change.Type, nullString(message.Sender), participant, nullString(change.Value),
+			nullString(change.Reason), message.Timestamp, ts)
 		if err != nil {
+			log.Errorf("Failed to insert group event into database: %v", err)
 			return err
 		}
 	}
+	return tx.Commit()
+}
 
+// storePoll stores the question and the options of a poll
+func (tracker *DBTracker) storePoll(tx *Tx, message *TrackableMessage) error {
+	_, err := tx.Exec(`INSERT INTO polls (message_id, question, selectable_count) VALUES (?, ?, ?)`,
+		message.MessageID, message.Poll.Question, message.Poll.SelectableCount)
+	if err != nil {
+		log.Errorf("Failed to insert poll into database: %v", err)
+		return err
+	}
+	for i, option := range message.Poll.Options {
+		_, err = tx.Exec(`INSERT INTO poll_options (poll_id, hash, name, position) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+			message.MessageID, option.Hash, option.Name, i)
+		if err != nil {
+			log.Errorf("Failed to insert poll option into database: %v", err)
+			return err
+		}
+	}
 	return nil
 }
 
+// storePollVote replaces previous votes of the sender in the poll
+func (tracker *DBTracker) storePollVote(message *TrackableMessage) error {
+	tx, err := tracker.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM poll_votes WHERE poll_id = ? AND voter = ?`, message.PollVote.PollID, message.Sender)
+	if err != nil {
+		log.Errorf("Failed to delete poll votes from database: %v", err)
+		return err
+	}
+	for _, option := range message.PollVote.Options {
+		_, err = tx.Exec(`INSERT INTO poll_votes (poll_id, voter, option_hash, timestamp) VALUES (?, ?, ?, ?)`,
+			message.PollVote.PollID, message.Sender, option.Hash, message.Timestamp)
+		if err != nil {
+			log.Errorf("Failed to insert poll vote into database: %v", err)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetPoll returns the poll of the message or nil if the message isn't a poll
+func (tracker *DBTracker) GetPoll(messageID string) (*Poll, error) {
+	var poll Poll
+	err := tracker.db.QueryRow(`SELECT question, selectable_count FROM polls WHERE message_id = ?`, messageID).
+		Scan(&poll.Question, &poll.SelectableCount)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	poll.Options, err = tracker.GetPollOptions(messageID)
+	if err != nil {
+		return nil, err
+	}
+	return &poll, nil
+}
+
+// GetPollOptions returns options of the poll in their original order
+func (tracker *DBTracker) GetPollOptions(pollID string) ([]PollOption, error) {
+	rows, err := tracker.db.Query(`SELECT hash, name FROM poll_options WHERE poll_id = ? ORDER BY position`, pollID)
+	if err != nil {
+		log.Errorf("Failed to query poll options from database: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var options []PollOption
+	for rows.Next() {
+		var option PollOption
+		err := rows.Scan(&option.Hash, &option.Name)
+		if err != nil {
+			log.Errorf("Failed to scan poll option from database: %v", err)
+			return nil, err
+		}
+		options = append(options, option)
+	}
+
+	return options, nil
+}
+
 // StoreFile stores a file in the database
-func (tracker *DBTracker) storeFile(messageID string, filePath string) error {
-	_, err := tracker.db.Exec(`INSERT INTO files (id, path, message_id) VALUES (?, ?, ?)`,
-		messageID, filePath, messageID)
+func (tracker *DBTracker) storeFile(tx *Tx, messageID string, file Attachment) error {
+	caption, err := encryptor.EncryptText(file.Caption)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO files (id, path, message_id, mime_type, size, sha256, file_name, caption, width, height, duration)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		file.ID, file.Path, messageID, nullString(file.MimeType), file.Size, nullString(file.SHA256),
+		nullString(file.FileName), nullString(caption), file.Width, file.Height, file.Duration)
 	if err != nil {
 		log.Errorf("Failed to insert file into database: %v", err)
 		return err
 	}
 	return nil
 }
+
+// StoreAnnotation stores an annotation of the message in the database
+func (tracker *DBTracker) storeAnnotation(tx *Tx, messageID string, annotation Annotation) error {
+	_, err := tx.Exec(`INSERT INTO message_annotations (message_id, processor, key, value) VALUES (?, ?, ?, ?)`,
+		messageID, annotation.Processor, annotation.Key, annotation.Value)
+	if err != nil {
+		log.Errorf("Failed to insert annotation into database: %v", err)
+		return err
+	}
+	return nil
+}
+
+// StoreLocationTrack stores a live location update of the sender in the database
+func (tracker *DBTracker) storeLocationTrack(tx *Tx, message *TrackableMessage) error {
+	location := message.Location
+	_, err := tx.Exec(`INSERT INTO location_tracks (message_id, sender, chat, latitude, longitude, accuracy, speed, heading, sequence, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		message.MessageID, message.Sender, message.Chat, location.Latitude, location.Longitude, location.Accuracy, location.Speed, location.Heading, location.Sequence, message.Timestamp)
+	if err != nil {
+		log.Errorf("Failed to insert location track into database: %v", err)
+		return err
+	}
+	return nil
+}
+
+// locationColumns are the location columns of the messages table in the order of nullLocation fields
+const locationColumns = `latitude, longitude, location_accuracy, location_name, location_address, live_location`
+
+// nullLocation holds location columns of a message that doesn't have to be a location
+type nullLocation struct {
+	latitude  sql.NullFloat64
+	longitude sql.NullFloat64
+	accuracy  sql.NullInt64
+	name      sql.NullString
+	address   sql.NullString
+	live      sql.NullBool
+}
+
+func newNullLocation(location *Location) nullLocation {
+	return nullLocation{
+		latitude:  sql.NullFloat64{Float64: location.Latitude, Valid: true},
+		longitude: sql.NullFloat64{Float64: location.Longitude, Valid: true},
+		accuracy:  sql.NullInt64{Int64: int64(location.Accuracy), Valid: true},
+		name:      sql.NullString{String: location.Name, Valid: true},
+		address:   sql.NullString{String: location.Address, Valid: true},
+		live:      sql.NullBool{Bool: location.Live, Valid: true},
+	}
+}
+
+func (l nullLocation) Location() *Location {
+	if !l.latitude.Valid || !l.longitude.Valid {
+		return nil
+	}
+	return &Location{
+		Latitude:  l.latitude.Float64,
+		Longitude: l.longitude.Float64,
+		Accuracy:  uint32(l.accuracy.Int64),
+		Name:      l.name.String,
+		Address:   l.address.String,
+		Live:      l.live.Bool,
+	}
+}
+
+// contextColumns are the reply and forwarding columns of the messages table in the order of nullContext fields
+const contextColumns = `quoted_message_id, quoted_sender, forwarded, forwarding_score`
+
+// nullContext holds reply and forwarding columns of a message and its mentions, which are queried separately
+type nullContext struct {
+	quotedMessageID sql.NullString
+	quotedSender    sql.NullString
+	forwarded       sql.NullBool
+	forwardingScore sql.NullInt64
+	mentions        []string
+}
+
+func (c nullContext) Context() *MessageContext {
+	if !c.quotedMessageID.Valid && !c.forwarded.Bool && len(c.mentions) == 0 {
+		return nil
+	}
+	return &MessageContext{
+		QuotedMessageID: c.quotedMessageID.String,
+		QuotedSender:    c.quotedSender.String,
+		Forwarded:       c.forwarded.Bool,
+		ForwardingScore: uint32(c.forwardingScore.Int64),
+		Mentions:        c.mentions,
+	}
+}
+
+// messageTimestampLayout is the format of time.Time.String() that is stored in the timestamp column
+const messageTimestampLayout = "2006-01-02 15:04:05 -0700 MST"
+
+// parseMessageTimestamp parses the text timestamp of a message
+func parseMessageTimestamp(value string) (time.Time, error) {
+	// Drop the monotonic clock reading that time.Time.String() may append
+	if i := strings.Index(value, " m="); i >= 0 {
+		value = value[:i]
+	}
+	timestamp, err := time.Parse(messageTimestampLayout, value)
+	if err != nil {
+		return time.Parse(time.RFC3339, value)
+	}
+	return timestamp, nil
+}
+
+// messageTime returns the time the message was sent
+func messageTime(message *TrackableMessage) (time.Time, error) {
+	if !message.Metadata.Timestamp.IsZero() {
+		return message.Metadata.Timestamp, nil
+	}
+	return parseMessageTimestamp(message.Timestamp)
+}
+
+// startOfDay returns the midnight of the date in the local time zone
+func startOfDay(date time.Time) time.Time {
+	return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.Local)
+}
+
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
+
+func nullInt(value int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(value), Valid: value != 0}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDBTrackerReplay(t *testing.T) {
+	db := newTestDB(t)
+	tracker := &DBTracker{db: db}
+	messages := []*TrackableMessage{
+		{Event: EventMessageCreated, MessageID: "M1", Sender: "1@s.whatsapp.net", Chat: "a@g.us", Content: "where?",
+			Timestamp: "1714546800", Context: &MessageContext{Mentions: []string{"2@s.whatsapp.net"}},
+			Location:    &Location{Latitude: 50.45, Longitude: 30.52, Live: true, Sequence: 1},
+			Files:       []Attachment{{ID: "M1", Path: "files/M1.jpg"}},
+			Annotations: []Annotation{{Processor: "language", Key: "language", Value: "en"}}},
+		{Event: EventMessageCreated, MessageID: "P1", Sender: "1@s.whatsapp.net", Chat: "a@g.us", Timestamp: "1714546801",
+			Poll: &Poll{Question: "Lunch?", Options: []PollOption{{Hash: "h1", Name: "yes"}, {Hash: "h2", Name: "no"}}}},
+		{Event: EventGroupChange, MessageID: "G1", Sender: "1@s.whatsapp.net", Chat: "a@g.us", Timestamp: "1714546802",
+			GroupChange: &GroupChange{Type: GroupChangeJoin, Participants: []string{"2@s.whatsapp.net", "3@s.whatsapp.net"}}},
+	}
+	counts := map[string]int{
+		`SELECT count(*) FROM messages`:            2,
+		`SELECT count(*) FROM mentions`:            1,
+		`SELECT count(*) FROM location_tracks`:     1,
+		`SELECT count(*) FROM files`:               1,
+		`SELECT count(*) FROM message_annotations`: 1,
+		`SELECT count(*) FROM poll_options`:        2,
+		`SELECT count(*) FROM group_events`:        2,
+	}
+
+	// The second attempt replays jobs that were committed before the queue was updated
+	for attempt := 1; attempt <= 2; attempt++ {
+		for _, message := range messages {
+			if err := tracker.TrackMessage(message); err != nil {
+				t.Fatalf("attempt %d: TrackMessage(%s) error = %v", attempt, message.MessageID, err)
+			}
+		}
+		for query, want := range counts {
+			if got := countRows(t, db, query); got != want {
+				t.Errorf("attempt %d: %s = %d, want %d", attempt, query, got, want)
+			}
+		}
+	}
+}
+
+func TestDBTrackerMessageChanges(t *testing.T) {
+	db := newTestDB(t)
+	tracker := &DBTracker{db: db}
+	created := &TrackableMessage{Event: EventMessageCreated, MessageID: "M1", Chat: "a@g.us", Content: "helo", Timestamp: "1714546800"}
+	changes := []*TrackableMessage{
+		created,
+		{Event: EventMessageEdited, MessageID: "M1", Content: "hello", EventTimestamp: "1714546810"},
+		{Event: EventMessageRevoked, MessageID: "M1", EventTimestamp: "1714546820"},
+	}
+	for _, message := range changes {
+		if err := tracker.TrackMessage(message); err != nil {
+			t.Fatalf("TrackMessage(%s %s) error = %v", message.Event, message.MessageID, err)
+		}
+	}
+	// Changes of messages that were never stored are left to the queue
+	unknown := []*TrackableMessage{
+		{Event: EventMessageEdited, MessageID: "UNKNOWN", Content: "edited", EventTimestamp: "1714546830"},
+		{Event: EventMessageRevoked, MessageID: "UNKNOWN", EventTimestamp: "1714546840"},
+	}
+	for _, message := range unknown {
+		if err := tracker.TrackMessage(message); !errors.Is(err, errMessageNotStored) {
+			t.Errorf("TrackMessage(%s %s) error = %v, want %v", message.Event, message.MessageID, err, errMessageNotStored)
+		}
+	}
+
+	var content, editedAt, deletedAt string
+	err := db.QueryRow(`SELECT content, edited_at, deleted_at FROM messages WHERE id = ?`, "M1").Scan(&content, &editedAt, &deletedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != "hello" || editedAt != "1714546810" || deletedAt != "1714546820" {
+		t.Errorf("message = %q edited at %s, deleted at %s", content, editedAt, deletedAt)
+	}
+	if got := countRows(t, db, `SELECT count(*) FROM message_revisions WHERE message_id = ?`, "M1"); got != 2 {
+		t.Errorf("revisions = %d, want the original and the edit", got)
+	}
+	if got := countRows(t, db, `SELECT count(*) FROM messages WHERE id = ?`, "UNKNOWN"); got != 0 {
+		t.Errorf("changes of an unknown message stored %d messages", got)
+	}
+}
+
+func TestMessagesReturnMentions(t *testing.T) {
+	db := newTestDB(t)
+	tracker := &DBTracker{db: db, config: &Config{}}
+	sent := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	messages := []*TrackableMessage{
+		{Event: EventMessageCreated, MessageID: "M1", Chat: "a@g.us", Sender: "1@s.whatsapp.net", Content: "@2 lunch?",
+			Timestamp: sent.String(), Context: &MessageContext{Mentions: []string{"2@s.whatsapp.net"}}},
+		{Event: EventMessageCreated, MessageID: "M2", Chat: "a@g.us", Sender: "2@s.whatsapp.net", Content: "sure",
+			Timestamp: sent.Add(time.Minute).String(), Context: &MessageContext{QuotedMessageID: "M1"}},
+	}
+	for _, message := range messages {
+		if err := tracker.TrackMessage(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mentions := func(message *WebMessage) []string {
+		if message.Context == nil {
+			return nil
+		}
+		return message.Context.Mentions
+	}
+
+	stored, err := tracker.GetMessage("M1")
+	if err != nil || stored == nil || stored.Context == nil || !sameStrings(stored.Context.Mentions, []string{"2@s.whatsapp.net"}) {
+		t.Errorf("GetMessage(M1) = %+v, %v, want the mention", stored, err)
+	}
+
+	server := &Server{DB: db}
+	for _, url := range []string{"/messages?from=01.05.2024&to=01.05.2024", "/thread?id=M1"} {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", url, nil)
+		if strings.HasPrefix(url, "/thread") {
+			server.getDBThreadHandler(recorder, request)
+		} else {
+			server.getDBMessagesHandler(recorder, request)
+		}
+		var results []WebMessage
+		if err := json.Unmarshal(recorder.Body.Bytes(), &results); err != nil {
+			t.Fatalf("%s: %v: %s", url, err, recorder.Body)
+		}
+		if len(results) != 2 {
+			t.Fatalf("%s = %+v, want M1 and M2", url, results)
+		}
+		for _, result := range results {
+			want := []string(nil)
+			if result.ID == "M1" {
+				want = []string{"2@s.whatsapp.net"}
+			}
+			if !sameStrings(mentions(&result), want) {
+				t.Errorf("%s: mentions of %s = %v, want %v", url, result.ID, mentions(&result), want)
+			}
+		}
+	}
+}
+
+func TestSendersMatchContacts(t *testing.T) {
+	db := newTestDB(t)
+	directory, err := CreateDirectory(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = directory.SaveContact(Contact{JID: "1@s.whatsapp.net", FullName: "Alice"}); err != nil {
+		t.Fatal(err)
+	}
+	tracker := &DBTracker{db: db, config: &Config{}}
+	sent := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	message := &TrackableMessage{Event: EventMessageCreated, MessageID: "M1", Chat: "a@g.us", Sender: "1:12@s.whatsapp.net",
+		Timestamp: sent.String()}
+	if err = tracker.TrackMessage(message); err != nil {
+		t.Fatal(err)
+	}
+	// Senders stored with the device before they were normalized
+	mustExec(t, db, `INSERT INTO messages (id, chat, sender, content, timestamp, ts) VALUES (?, ?, ?, '', ?, ?)`,
+		"M2", "a@g.us", "1.1:3@s.whatsapp.net", sent.Add(time.Minute).String(), sent.Add(time.Minute).Unix())
+	mustExec(t, db, `INSERT INTO messages (id, chat, sender, content, timestamp, ts) VALUES (?, ?, ?, '', ?, ?)`,
+		"M3", "a@g.us", "2@s.whatsapp.net", sent.Add(2*time.Minute).String(), sent.Add(2*time.Minute).Unix())
+	migrations, err := LoadMigrations(db.Dialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, migration := range migrations {
+		if migration.Name == "non_ad_senders" {
+			mustExec(t, db, migration.SQL)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	(&Server{DB: db}).getDBMessagesHandler(recorder, httptest.NewRequest("GET", "/messages?from=01.05.2024&to=01.05.2024", nil))
+	var results []WebMessage
+	if err := json.Unmarshal(recorder.Body.Bytes(), &results); err != nil {
+		t.Fatalf("%v: %s", err, recorder.Body)
+	}
+	want := map[string][2]string{
+		"M1": {"1@s.whatsapp.net", "Alice"},
+		"M2": {"1@s.whatsapp.net", "Alice"},
+		"M3": {"2@s.whatsapp.net", ""},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("/messages = %+v, want %d messages", results, len(want))
+	}
+	for _, result := range results {
+		if got := [2]string{result.Sender, result.SenderName}; got != want[result.ID] {
+			t.Errorf("sender of %s = %v, want %v", result.ID, got, want[result.ID])
+		}
+	}
+}
+
+func TestMessagesReturnReactionsAndPolls(t *testing.T) {
+	db := newTestDB(t)
+	tracker := &DBTracker{db: db, config: &Config{}}
+	sent := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	messages := []*TrackableMessage{
+		{Event: EventMessageCreated, MessageID: "M1", Chat: "a@g.us", Sender: "1@s.whatsapp.net", Content: "lunch", Timestamp: sent.String()},
+		{Event: EventMessageCreated, MessageID: "P1", Chat: "a@g.us", Sender: "1@s.whatsapp.net", Timestamp: sent.Add(time.Minute).String(),
+			Poll: &Poll{Question: "Where?", SelectableCount: 1, Options: []PollOption{{Hash: "h1", Name: "Cafe"}, {Hash: "h2", Name: "Park"}}}},
+		{Event: EventReaction, MessageID: "R1", Chat: "a@g.us", Sender: "2@s.whatsapp.net", Timestamp: sent.Add(2 * time.Minute).String(),
+			Reaction: &Reaction{MessageID: "M1", Emoji: "👍"}},
+		{Event: EventReaction, MessageID: "R2", Chat: "a@g.us", Sender: "3@s.whatsapp.net", Timestamp: sent.Add(3 * time.Minute).String(),
+			Reaction: &Reaction{MessageID: "M1", Emoji: "👍"}},
+		{Event: EventPollVote, MessageID: "V1", Chat: "a@g.us", Sender: "2@s.whatsapp.net", Timestamp: sent.Add(4 * time.Minute).String(),
+			PollVote: &PollVote{PollID: "P1", Options: []PollOption{{Hash: "h2", Name: "Park"}}}},
+	}
+	for _, message := range messages {
+		if err := tracker.TrackMessage(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	(&Server{DB: db}).getDBMessagesHandler(recorder, httptest.NewRequest("GET", "/messages?from=01.05.2024&to=01.05.2024", nil))
+	var results []WebMessage
+	if err := json.Unmarshal(recorder.Body.Bytes(), &results); err != nil {
+		t.Fatalf("%v: %s", err, recorder.Body)
+	}
+	byID := map[string]WebMessage{}
+	for _, result := range results {
+		byID[result.ID] = result
+	}
+	if reactions := byID["M1"].Reactions; reactions == nil || reactions.Counts["👍"] != 2 || len(reactions.Reactions) != 2 {
+		t.Errorf("reactions of M1 = %+v, want two 👍", reactions)
+	}
+	if byID["M1"].Poll != nil || byID["P1"].Reactions != nil {
+		t.Errorf("M1 has a poll or P1 has reactions: %+v, %+v", byID["M1"], byID["P1"])
+	}
+	poll := byID["P1"].Poll
+	if poll == nil || poll.Question != "Where?" || len(poll.Options) != 2 || poll.Options[0].Votes != 0 || poll.Options[1].Votes != 1 ||
+		!sameStrings(poll.Options[1].Voters, []string{"2@s.whatsapp.net"}) {
+		t.Errorf("poll of P1 = %+v, want one vote for Park", poll)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Dialect hides the SQL differences between supported databases
+type Dialect interface {
+	Name() string
+	// Rebind replaces `?` placeholders with the placeholders of the database
+	Rebind(query string) string
+	// AutoIncrementPrimaryKey is the column definition of an auto incremented integer primary key
+	AutoIncrementPrimaryKey() string
+	// FullTextSearch tells if the database has the full-text index used by SearchMessages and MatchContent
+	FullTextSearch() bool
+	// SearchMessages returns a query of `id, sender, chat, content, timestamp, rank, snippet, sender name, chat name`
+	// of messages matching the full-text filter, best matches first
+	SearchMessages(filter SearchFilter) (string, []interface{})
+	// MatchContent returns a condition on messages whose content matches all terms
+	MatchContent(terms []SearchTerm) (string, []interface{})
+	// AddColumnIfNotExists returns statements that add the column if the table doesn't have it yet
+	AddColumnIfNotExists(db execer, table string, column string, definition string) (string, error)
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func NewDialect(name string) (Dialect, error) {
+	switch name {
+	case "sqlite3":
+		return sqliteDialect{}, nil
+	case "postgres":
+		return postgresDialect{}, nil
+	}
+	return nil, fmt.Errorf("unsupported database dialect %q, supported dialects: sqlite3, postgres", name)
+}
+
+// sqliteDialect has the full-text index only if SQLite is built with FTS5
+type sqliteDialect struct {
+	fts5 bool
+}
+
+func (sqliteDialect) Name() string {
+	return "sqlite3"
+}
+
+func (sqliteDialect) Rebind(query string) string {
+	return query
+}
+
+func (sqliteDialect) AutoIncrementPrimaryKey() string {
+	return "INTEGER PRIMARY KEY AUTOINCREMENT"
+}
+
+func (d sqliteDialect) FullTextSearch() bool {
+	return d.fts5
+}
+
+func (sqliteDialect) SearchMessages(filter SearchFilter) (string, []interface{}) {
+	query := `
+		SELECT messages.id, messages.sender, messages.chat, messages.content, messages.timestamp,
+			-bm25(messages_fts, 10.0, 5.0, 2.0) AS rank,
+			snippet(messages_fts, -1, '<b>', '</b>', '…', 12) AS snippet, ` + directoryColumns + `
+		FROM messages_fts
+		JOIN messages ON messages.rowid = messages_fts.rowid
+		WHERE messages_fts MATCH ?`
+	args := []interface{}{fts5Query(filter.Terms)}
+	if filter.Chat != "" {
+		query += ` AND messages.chat = ?`
+		args = append(args, filter.Chat)
+	}
+	query += ` ORDER BY rank DESC LIMIT ? OFFSET ?`
+	return query, append(args, filter.Limit, filter.Offset)
+}
+
+func (sqliteDialect) MatchContent(terms []SearchTerm) (string, []interface{}) {
+	return `messages.rowid IN (SELECT rowid FROM messages_fts WHERE messages_fts MATCH ?)`,
+		[]interface{}{"{content} : (" + fts5Query(terms) + ")"}
+}
+
+func (sqliteDialect) AddColumnIfNotExists(db execer, table string, column string, definition string) (string, error) {
+	// SQLite has no IF NOT EXISTS for columns, so check if the column can be selected
+	_, err := db.Exec(fmt.Sprintf(`SELECT %s FROM %s LIMIT 1`, column, table))
+	if err == nil {
+		return "", nil
+	}
+	return fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition), nil
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string {
+	return "postgres"
+}
+
+func (postgresDialect) Rebind(query string) string {
+	var builder strings.Builder
+	n := 0
+	inString := false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			inString = !inString
+		case r == '?' && !inString:
+			n++
+			builder.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		builder.WriteRune(r)
+	}
+	return builder.String()
+}
+
+func (postgresDialect) AutoIncrementPrimaryKey() string {
+	return "BIGSERIAL PRIMARY KEY"
+}
+
+func (postgresDialect) FullTextSearch() bool {
+	return true
+}
+
+func (postgresDialect) SearchMessages(filter SearchFilter) (string, []interface{}) {
+	query := `
+		SELECT id, sender, chat, content, timestamp,
+			ts_rank(search, q) AS rank,
+			ts_headline('simple', coalesce(content, '') || ' ' || coalesce(parsed_content, ''), q,
+				'StartSel=<b>, StopSel=</b>, MaxWords=24, MinWords=8, MaxFragments=2') AS snippet, ` + directoryColumns + `
+		FROM messages, to_tsquery('simple', ?) q
+		WHERE search @@ q`
+	args := []interface{}{tsQuery(filter.Terms, "")}
+	if filter.Chat != "" {
+		query += ` AND chat = ?`
+		args = append(args, filter.Chat)
+	}
+	query += ` ORDER BY rank DESC LIMIT ? OFFSET ?`
+	return query, append(args, filter.Limit, filter.Offset)
+}
+
+// MatchContent matches the content by its weight in the search vector
+func (postgresDialect) MatchContent(terms []SearchTerm) (string, []interface{}) {
+	return `search @@ to_tsquery('simple', ?)`, []interface{}{tsQuery(terms, "A")}
+}
+
+func (postgresDialect) AddColumnIfNotExists(db execer, table string, column string, definition string) (string, error) {
+	return fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s`, table, column, definition), nil
+}
+
+// DB is a database connection that rewrites queries for its dialect
+type DB struct {
+	*sql.DB
+	Dialect Dialect
+}
+
+func NewDB(db *sql.DB, dialectName string) (*DB, error) {
+	dialect, err := NewDialect(dialectName)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := dialect.(sqliteDialect); ok {
+		dialect = sqliteDialect{fts5: hasFTS5(db)}
+	}
+	return &DB{DB: db, Dialect: dialect}, nil
+}
+
+func (db *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.Exec(db.Dialect.Rebind(query), args...)
+}
+
+func (db *DB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.Query(db.Dialect.Rebind(query), args...)
+}
+
+func (db *DB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRow(db.Dialect.Rebind(query), args...)
+}
+
+func (db *DB) Begin() (*Tx, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx, dialect: db.Dialect}, nil
+}
+
+// Tx is a transaction that rewrites queries for its dialect
+type Tx struct {
+	*sql.Tx
+	dialect Dialect
+}
+
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.Exec(tx.dialect.Rebind(query), args...)
+}
+
+func (tx *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.dialect.Rebind(query), args...)
+}
+
+func (tx *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRow(tx.dialect.Rebind(query), args...)
+}
+
+// EnsureColumn adds the column to the table if it doesn't exist yet
+func (tx *Tx) EnsureColumn(table string, column string, definition string) error {
+	query, err := tx.dialect.AddColumnIfNotExists(tx, table, column, definition)
+	if err != nil || query == "" {
+		return err
+	}
+	_, err = tx.Exec(query)
+	return err
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+const defaultDirectoryRefreshInterval = 6 * time.Hour
+
+// directoryColumns are the sender and chat names of a row of the messages table,
+// senders are stored without the device like contacts
+const directoryColumns = `(SELECT name FROM contacts WHERE contacts.jid = messages.sender), ` +
+	`coalesce((SELECT name FROM chats WHERE chats.jid = messages.chat), (SELECT name FROM contacts WHERE contacts.jid = messages.chat))`
+
+// Contact is a WhatsApp user with the names known for them
+type Contact struct {
+	JID          string
+	Name         string
+	PushName     string
+	FullName     string
+	FirstName    string
+	BusinessName string
+}
+
+// bestName prefers the name from the address book over the names users set themselves
+func (c Contact) bestName() string {
+	for _, name := range []string{c.FullName, c.BusinessName, c.PushName, c.FirstName} {
+		if name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// ChatInfo is a chat with its name, groups also have a topic and an owner
+type ChatInfo struct {
+	JID       string
+	Name      string
+	Topic     string
+	IsGroup   bool
+	Owner     string
+	CreatedAt string
+}
+
+// Directory keeps names of contacts and chats and participants of groups
+type Directory struct {
+	db       *DB
+	mu       sync.RWMutex
+	contacts map[string]Contact
+	chats    map[string]ChatInfo
+	quit     chan struct{}
+}
+
+func CreateDirectory(db *DB) (*Directory, error) {
+	directory := &Directory{
+		db:       db,
+		contacts: make(map[string]Contact),
+		chats:    make(map[string]ChatInfo),
+		quit:     make(chan struct{}),
+	}
+	err := directory.load()
+	if err != nil {
+		return nil, err
+	}
+	return directory, nil
+}
+
+func (d *Directory) load() error {
+	rows, err := d.db.Query(`SELECT jid, name, push_name, full_name, first_name, business_name FROM contacts`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var jid string
+		var name, pushName, fullName, firstName, businessName sql.NullString
+		err = rows.Scan(&jid, &name, &pushName, &fullName, &firstName, &businessName)
+		if err != nil {
+			return err
+		}
+		d.contacts[jid] = Contact{JID: jid, Name: name.String, PushName: pushName.String, FullName: fullName.String,
+			FirstName: firstName.String, BusinessName: businessName.String}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	rows, err = d.db.Query(`SELECT jid, name, topic, is_group, owner, created_at FROM chats`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var chat ChatInfo
+		var name, topic, owner, createdAt sql.NullString
+		var isGroup sql.NullBool
+		err = rows.Scan(&chat.JID, &name, &topic, &isGroup, &owner, &createdAt)
+		if err != nil {
+			return err
+		}
+		chat.Name, chat.Topic, chat.IsGroup, chat.Owner, chat.CreatedAt = name.String, topic.String, isGroup.Bool, owner.String, createdAt.String
+		d.chats[chat.JID] = chat
+	}
+	return rows.Err()
+}
+
+// ContactName returns the name of the user or an empty string if it's unknown
+func (d *Directory) ContactName(jid string) string {
+	jid = nonADJID(jid)
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.contacts[jid].Name
+}
+
+// nonADJID returns the JID without the device, as contacts are stored
+func nonADJID(jid string) string {
+	parsed, err := types.ParseJID(jid)
+	if err != nil {
+		return jid
+	}
+	return parsed.ToNonAD().String()
+}
+
+// ChatName returns the name of the group or of the user of a private chat
+func (d *Directory) ChatName(jid string) string {
+	d.mu.RLock()
+	chat, ok := d.chats[jid]
+	d.mu.RUnlock()
+	if ok && chat.Name != "" {
+		return chat.Name
+	}
+	return d.ContactName(jid)
+}
+
+// SaveContact stores the non-empty names of the contact
+func (d *Directory) SaveContact(contact Contact) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stored := d.contacts[contact.JID]
+	merged := stored
+	merged.JID = contact.JID
+	if contact.PushName != "" {
+		merged.PushName = contact.PushName
+	}
+	if contact.FullName != "" {
+		merged.FullName = contact.FullName
+	}
+	if contact.FirstName != "" {
+		merged.FirstName = contact.FirstName
+	}
+	if contact.BusinessName != "" {
+		merged.BusinessName = contact.BusinessName
+	}
+	merged.Name = merged.bestName()
+	if merged == stored {
+		return nil
+	}
+
+	_, err := d.db.Exec(`
+		INSERT INTO contacts (jid, name, push_name, full_name, first_name, business_name, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(jid) DO UPDATE SET name = excluded.name, push_name = excluded.push_name, full_name = excluded.full_name,
+			first_name = excluded.first_name, business_name = excluded.business_name, updated_at = excluded.updated_at`,
+		merged.JID, nullString(merged.Name), nullString(merged.PushName), nullString(merged.FullName),
+		nullString(merged.FirstName), nullString(merged.BusinessName), time.Now().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	d.contacts[merged.JID] = merged
+	return nil
+}
+
+// SavePushName stores the name the user set for themselves
+func (d *Directory) SavePushName(jid types.JID, pushName string) {
+	if pushName == "" || jid.IsEmpty() {
+		return
+	}
+	err := d.SaveContact(Contact{JID: jid.ToNonAD().String(), PushName: pushName})
+	if err != nil {
+		log.Errorf("Failed to save push name of %s: %v", jid, err)
+	}
+}
+
+// SaveChat stores the chat, empty fields keep their stored values
+func (d *Directory) SaveChat(chat ChatInfo) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stored, ok := d.chats[chat.JID]
+	merged := chat
+	if ok {
+		if merged.Name == "" {
+			merged.Name = stored.Name
+		}
+		if merged.Topic == "" {
+			merged.Topic = stored.Topic
+		}
+		if merged.Owner == "" {
+			merged.Owner = stored.Owner
+		}
+		if merged.CreatedAt == "" {
+			merged.CreatedAt = stored.CreatedAt
+		}
+		merged.IsGroup = merged.IsGroup || stored.IsGroup
+		if merged == stored {
+			return nil
+		}
+	}
+
+	_, err := d.db.Exec(`
+		INSERT INTO chats (jid, name, topic, is_group, owner, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(jid) DO UPDATE SET name = excluded.name, topic = excluded.topic, is_group = excluded.is_group,
+			owner = excluded.owner, created_at = excluded.created_at, updated_at = excluded.updated_at`,
+		merged.JID, nullString(merged.Name), nullString(merged.Topic), merged.IsGroup, nullString(merged.Owner),
+		nullString(merged.CreatedAt), time.Now().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	d.chats[merged.JID] = merged
+	return nil
+}
+
+// SaveGroup stores the group and replaces its participants
+func (d *Directory) SaveGroup(info *types.GroupInfo) error {
+	chat := ChatInfo{JID: info.JID.String(), Name: info.Name, Topic: info.Topic, IsGroup: true}
+	if !info.OwnerJID.IsEmpty() {
+		chat.Owner = info.OwnerJID.String()
+	}
+	if !info.GroupCreated.IsZero() {
+		chat.CreatedAt = info.GroupCreated.Format(time.RFC3339)
+	}
+	err := d.SaveChat(chat)
+	if err != nil {
+		return err
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`DELETE FROM group_participants WHERE group_jid = ?`, chat.JID)
+	if err != nil {
+		return err
+	}
+	for _, participant := range info.Participants {
+		_, err = tx.Exec(`INSERT INTO group_participants (group_jid, jid, is_admin, is_super_admin) VALUES (?, ?, ?, ?)`,
+			chat.JID, participant.JID.String(), participant.IsAdmin, participant.IsSuperAdmin)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ApplyGroupChange updates the stored group from a group info event
+func (d *Directory) ApplyGroupChange(evt *events.GroupInfo) error {
+	chat := ChatInfo{JID: evt.JID.String(), IsGroup: true}
+	if evt.Name != nil {
+		chat.Name = evt.Name.Name
+	}
+	if evt.Topic != nil {
+		chat.Topic = evt.Topic.Topic
+	}
+	err := d.SaveChat(chat)
+	if err != nil {
+		return err
+	}
+
+	for _, jid := range evt.Join {
+		_, err = d.db.Exec(`INSERT INTO group_participants (group_jid, jid) VALUES (?, ?) ON CONFLICT(group_jid, jid) DO NOTHING`,
+			chat.JID, jid.String())
+		if err != nil {
+			return err
+		}
+	}
+	for _, jid := range evt.Leave {
+		_, err = d.db.Exec(`DELETE FROM group_participants WHERE group_jid = ? AND jid = ?`, chat.JID, jid.String())
+		if err != nil {
+			return err
+		}
+	}
+	for _, jid := range evt.Promote {
+		_, err = d.db.Exec(`UPDATE group_participants SET is_admin = ? WHERE group_jid = ? AND jid = ?`, true, chat.JID, jid.String())
+		if err != nil {
+			return err
+		}
+	}
+	for _, jid := range evt.Demote {
+		_, err = d.db.Exec(`UPDATE group_participants SET is_admin = ?, is_super_admin = ? WHERE group_jid = ? AND jid = ?`,
+			false, false, chat.JID, jid.String())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Refresh stores contacts of the address book and all joined groups
+func (d *Directory) Refresh(client *whatsmeow.Client) error {
+	contacts, err := client.Store.Contacts.GetAllContacts()
+	if err != nil {
+		return err
+	}
+	for jid, info := range contacts {
+		err = d.SaveContact(Contact{JID: jid.ToNonAD().String(), PushName: info.PushName, FullName: info.FullName,
+			FirstName: info.FirstName, BusinessName: info.BusinessName})
+		if err != nil {
+			return err
+		}
+	}
+
+	groups, err := client.GetJoinedGroups()
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		err = d.SaveGroup(group)
+		if err != nil {
+			return err
+		}
+	}
+	log.Infof("Refreshed directory: %d contacts, %d groups", len(contacts), len(groups))
+	return nil
+}
+
+// Start refreshes the directory periodically while the client is connected
+func (d *Directory) Start(client *whatsmeow.Client, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultDirectoryRefreshInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.quit:
+				return
+			case <-ticker.C:
+				if !client.IsConnected() {
+					continue
+				}
+				err := d.Refresh(client)
+				if err != nil {
+					log.Errorf("Failed to refresh directory: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic refresh
+func (d *Directory) Stop() {
+	close(d.quit)
+}
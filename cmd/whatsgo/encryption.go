@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Encryption at rest is envelope encryption: content is encrypted with AES-256-GCM data keys,
+// which are stored in the encryption_keys table wrapped with the master key.
+// Rotating the master key only rewraps the data keys, stored content isn't touched.
+// Whether a value is encrypted isn't guessed from content: plain values that start like encrypted ones
+// are stored escaped, so a chat member can't send a text or a file that is taken for encrypted.
+const (
+	encryptionKeyEnv    = "WHATSGO_ENCRYPTION_KEY"
+	encryptedTextPrefix = "enc:v1:"
+	// plainTextPrefix escapes plain texts that start with reservedTextPrefix
+	plainTextPrefix    = "enc:plain:"
+	reservedTextPrefix = "enc:"
+)
+
+// encryptedFileMagic starts encrypted files, followed by the length of the key ID, the key ID, the nonce and the ciphertext
+var encryptedFileMagic = []byte("WGENC1")
+
+// plainFileMagic escapes plain files that start with encryptedFileMagic or plainFileMagic
+var plainFileMagic = []byte("WGPLN1")
+
+var errEncryptionDisabled = errors.New("content is encrypted, but encryption is not enabled")
+
+// encryptor encrypts stored content when encryption is enabled, it's nil otherwise
+var encryptor *Encryptor
+
+// Encryptor encrypts with the newest data key and decrypts with any of them.
+// A nil Encryptor keeps content as it is.
+type Encryptor struct {
+	keys     map[string]cipher.AEAD
+	activeID string
+}
+
+// LoadEncryptor unwraps the data keys with the master key, the first data key is created if there is none
+func LoadEncryptor(db *DB, config EncryptionConfig) (*Encryptor, error) {
+	masterKey, err := loadMasterKey(config)
+	if err != nil {
+		return nil, err
+	}
+	dataKeys, activeID, err := loadDataKeys(db, masterKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(dataKeys) == 0 {
+		tx, err := db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+		activeID, err = addDataKey(tx, masterKey)
+		if err != nil {
+			return nil, err
+		}
+		if err = tx.Commit(); err != nil {
+			return nil, err
+		}
+		log.Infof("Created data key %s", activeID)
+		return LoadEncryptor(db, config)
+	}
+
+	encryptor := &Encryptor{keys: make(map[string]cipher.AEAD), activeID: activeID}
+	for id, key := range dataKeys {
+		encryptor.keys[id], err = newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return encryptor, nil
+}
+
+// loadMasterKey reads the master key from the environment or from the key file
+func loadMasterKey(config EncryptionConfig) ([]byte, error) {
+	if value := os.Getenv(encryptionKeyEnv); value != "" {
+		return parseEncryptionKey(value)
+	}
+	if config.KeyFile == "" {
+		return nil, fmt.Errorf("encryption is enabled, but neither encryption.key_file nor %s is set", encryptionKeyEnv)
+	}
+	content, err := os.ReadFile(config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseEncryptionKey(string(content))
+}
+
+// parseEncryptionKey decodes a 256-bit key written in base64 or hex
+func parseEncryptionKey(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	if key, err := base64.StdEncoding.DecodeString(value); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := hex.DecodeString(value); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("encryption key must be 32 bytes in base64 or hex")
+}
+
+func generateEncryptionKey() ([]byte, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	return key, err
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the data with a random nonce that is prepended to the ciphertext
+func seal(aead cipher.AEAD, data []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+func unseal(aead cipher.AEAD, data []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("encrypted content is too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+}
+
+// wrapKey encrypts a data key with the master key
+func wrapKey(masterKey []byte, dataKey []byte) (string, error) {
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := seal(aead, dataKey)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(wrapped), nil
+}
+
+func unwrapKey(masterKey []byte, wrapped string) ([]byte, error) {
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return unseal(aead, data)
+}
+
+// loadDataKeys returns the unwrapped data keys by ID and the ID of the newest one
+func loadDataKeys(db *DB, masterKey []byte) (map[string][]byte, string, error) {
+	rows, err := db.Query(`SELECT id, wrapped_key FROM encryption_keys ORDER BY created_at, id`)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	keys := make(map[string][]byte)
+	var activeID string
+	for rows.Next() {
+		var id, wrapped string
+		err = rows.Scan(&id, &wrapped)
+		if err != nil {
+			return nil, "", err
+		}
+		keys[id], err = unwrapKey(masterKey, wrapped)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to unwrap data key %s, is it the right master key? %w", id, err)
+		}
+		activeID = id
+	}
+	return keys, activeID, rows.Err()
+}
+
+// addDataKey generates a data key, stores it wrapped with the master key and returns its ID
+func addDataKey(tx *Tx, masterKey []byte) (string, error) {
+	dataKey, err := generateEncryptionKey()
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := wrapKey(masterKey, dataKey)
+	if err != nil {
+		return "", err
+	}
+	id := make([]byte, 8)
+	if _, err = rand.Read(id); err != nil {
+		return "", err
+	}
+	keyID := hex.EncodeToString(id)
+	_, err = tx.Exec(`INSERT INTO encryption_keys (id, wrapped_key, created_at) VALUES (?, ?, ?)`,
+		keyID, wrapped, time.Now().UTC().Format(time.RFC3339Nano))
+	return keyID, err
+}
+
+// EncryptText returns the text encrypted as `enc:v1:<key id>:<base64>`, empty texts are kept empty.
+// Without encryption texts starting with `enc:` are escaped as `enc:plain:<text>`.
+func (e *Encryptor) EncryptText(text string) (string, error) {
+	if text == "" {
+		return text, nil
+	}
+	if e == nil {
+		if strings.HasPrefix(text, reservedTextPrefix) {
+			return plainTextPrefix + text, nil
+		}
+		return text, nil
+	}
+	sealed, err := seal(e.keys[e.activeID], []byte(text))
+	if err != nil {
+		return "", err
+	}
+	return encryptedTextPrefix + e.activeID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptText returns the text of an encrypted value, other values are returned as they are
+func (e *Encryptor) DecryptText(value string) (string, error) {
+	if strings.HasPrefix(value, plainTextPrefix) {
+		return strings.TrimPrefix(value, plainTextPrefix), nil
+	}
+	if !strings.HasPrefix(value, encryptedTextPrefix) {
+		return value, nil
+	}
+	if e == nil {
+		return "", errEncryptionDisabled
+	}
+	keyID, encoded, ok := strings.Cut(strings.TrimPrefix(value, encryptedTextPrefix), ":")
+	if !ok {
+		return "", errors.New("invalid encrypted value")
+	}
+	aead, ok := e.keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("unknown data key %s", keyID)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	text, err := unseal(aead, sealed)
+	return string(text), err
+}
+
+// decryptTexts decrypts the values in place
+func (e *Encryptor) decryptTexts(values ...*string) error {
+	for _, value := range values {
+		text, err := e.DecryptText(*value)
+		if err != nil {
+			return err
+		}
+		*value = text
+	}
+	return nil
+}
+
+func isEncryptedFile(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedFileMagic)
+}
+
+// hasFileMagic reports whether the content is encrypted or escaped, i.e. isn't stored as it is
+func hasFileMagic(data []byte) bool {
+	return isEncryptedFile(data) || bytes.HasPrefix(data, plainFileMagic)
+}
+
+// EncryptBytes returns the encrypted content of a file.
+// Without encryption content starting with a file magic is escaped with plainFileMagic.
+func (e *Encryptor) EncryptBytes(data []byte) ([]byte, error) {
+	if e == nil {
+		if hasFileMagic(data) {
+			return append(append([]byte{}, plainFileMagic...), data...), nil
+		}
+		return data, nil
+	}
+	sealed, err := seal(e.keys[e.activeID], data)
+	if err != nil {
+		return nil, err
+	}
+	encrypted := append([]byte{}, encryptedFileMagic...)
+	encrypted = append(encrypted, byte(len(e.activeID)))
+	encrypted = append(encrypted, e.activeID...)
+	return append(encrypted, sealed...), nil
+}
+
+// DecryptBytes returns the content of an encrypted file, other content is returned as it is
+func (e *Encryptor) DecryptBytes(data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, plainFileMagic) {
+		return data[len(plainFileMagic):], nil
+	}
+	if !isEncryptedFile(data) {
+		return data, nil
+	}
+	if e == nil {
+		return nil, errEncryptionDisabled
+	}
+	data = data[len(encryptedFileMagic):]
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return nil, errors.New("invalid encrypted file")
+	}
+	keyID := string(data[1 : 1+data[0]])
+	aead, ok := e.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown data key %s", keyID)
+	}
+	return unseal(aead, data[1+data[0]:])
+}
+
+// hasDataKey reports whether the encrypted file names one of the data keys
+func (e *Encryptor) hasDataKey(data []byte) bool {
+	data = data[len(encryptedFileMagic):]
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return false
+	}
+	_, ok := e.keys[string(data[1:1+data[0]])]
+	return ok
+}
+
+// ReadFile returns the decrypted content of the file
+func (e *Encryptor) ReadFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return e.DecryptBytes(data)
+}
+
+// WriteFile encrypts the data and replaces the file, which is readable only by the owner
+func (e *Encryptor) WriteFile(path string, data []byte) error {
+	encrypted, err := e.EncryptBytes(data)
+	if err != nil {
+		return err
+	}
+	tmpName := path + ".tmp"
+	err = os.WriteFile(tmpName, encrypted, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
+
+// RotateMasterKey rewraps all data keys with the new master key and adds a data key for new content
+func RotateMasterKey(db *DB, masterKey []byte, newMasterKey []byte) (int, error) {
+	dataKeys, _, err := loadDataKeys(db, masterKey)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for id, dataKey := range dataKeys {
+		wrapped, err := wrapKey(newMasterKey, dataKey)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(`UPDATE encryption_keys SET wrapped_key = ? WHERE id = ?`, wrapped, id)
+		if err != nil {
+			return 0, err
+		}
+	}
+	_, err = addDataKey(tx, newMasterKey)
+	if err != nil {
+		return 0, err
+	}
+	return len(dataKeys), tx.Commit()
+}
+
+// encryptedColumns are the text columns that are encrypted
+var encryptedColumns = []struct {
+	table  string
+	key    string
+	column string
+}{
+	{"messages", "id", "content"},
+	{"messages", "id", "parsed_content"},
+	{"message_revisions", "id", "content"},
+	{"files", "id", "caption"},
+	{"tracker_queue", "id", "payload"},
+}
+
+// EncryptExisting encrypts content that was stored before encryption was enabled
+func (e *Encryptor) EncryptExisting(db *DB) (int, int, error) {
+	values := 0
+	for _, column := range encryptedColumns {
+		rows, err := db.Query(`SELECT `+column.key+`, `+column.column+` FROM `+column.table+` WHERE `+column.column+` NOT LIKE ?`,
+			encryptedTextPrefix+"%")
+		if err != nil {
+			return values, 0, err
+		}
+		plain := make(map[string]string)
+		for rows.Next() {
+			var key string
+			var value *string
+			err = rows.Scan(&key, &value)
+			if err != nil {
+				rows.Close()
+				return values, 0, err
+			}
+			if value != nil && *value != "" {
+				plain[key] = strings.TrimPrefix(*value, plainTextPrefix)
+			}
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return values, 0, err
+		}
+
+		for key, value := range plain {
+			encrypted, err := e.EncryptText(value)
+			if err != nil {
+				return values, 0, err
+			}
+			_, err = db.Exec(`UPDATE `+column.table+` SET `+column.column+` = ? WHERE `+column.key+` = ?`, encrypted, key)
+			if err != nil {
+				return values, 0, err
+			}
+			values++
+		}
+	}
+
+	rows, err := db.Query(`SELECT DISTINCT path FROM files`)
+	if err != nil {
+		return values, 0, err
+	}
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err = rows.Scan(&path); err != nil {
+			rows.Close()
+			return values, 0, err
+		}
+		paths = append(paths, path)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return values, 0, err
+	}
+
+	files := 0
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return values, files, err
+		}
+		if isEncryptedFile(data) && e.hasDataKey(data) {
+			continue
+		}
+		// Plain files that start like encrypted ones are escaped or were stored before the escaping
+		err = e.WriteFile(path, bytes.TrimPrefix(data, plainFileMagic))
+		if err != nil {
+			return values, files, err
+		}
+		os.Chmod(filepath.Dir(path), 0700)
+		files++
+	}
+	return values, files, nil
+}
+
+// runEncryptionCommand handles `whatsgo encryption generate-key|rotate-key <new key file>|encrypt-existing`
+func runEncryptionCommand(db *DB, config *Config, args []string) error {
+	command := ""
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch command {
+	case "generate-key":
+		key, err := generateEncryptionKey()
+		if err != nil {
+			return err
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(key))
+		return nil
+	case "rotate-key":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: whatsgo encryption rotate-key <new key file>")
+		}
+		masterKey, err := loadMasterKey(config.Encryption)
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		newMasterKey, err := parseEncryptionKey(string(content))
+		if err != nil {
+			return err
+		}
+		count, err := RotateMasterKey(db, masterKey, newMasterKey)
+		if err != nil {
+			return err
+		}
+		log.Infof("Rewrapped %d data keys with the new master key, use %s as encryption.key_file or %s from now on",
+			count, args[1], encryptionKeyEnv)
+		return nil
+	case "encrypt-existing":
+		if !config.Encryption.Enabled {
+			return fmt.Errorf("encryption is not enabled")
+		}
+		encryptor, err := LoadEncryptor(db, config.Encryption)
+		if err != nil {
+			return err
+		}
+		values, files, err := encryptor.EncryptExisting(db)
+		log.Infof("Encrypted %d values and %d files", values, files)
+		return err
+	}
+	return fmt.Errorf("usage: whatsgo encryption generate-key|rotate-key <new key file>|encrypt-existing")
+}
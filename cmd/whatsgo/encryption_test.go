@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestMasterKey returns a base64 encoded master key
+func newTestMasterKey(t *testing.T) string {
+	key, err := generateEncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// useTestEncryptor enables encryption for the test
+func useTestEncryptor(t *testing.T, db *DB) *Encryptor {
+	t.Setenv(encryptionKeyEnv, newTestMasterKey(t))
+	e, err := LoadEncryptor(db, EncryptionConfig{Enabled: true})
+	if err != nil {
+		t.Fatalf("LoadEncryptor() error = %v", err)
+	}
+	encryptor = e
+	t.Cleanup(func() { encryptor = nil })
+	return e
+}
+
+func TestParseEncryptionKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	for _, value := range []string{base64.StdEncoding.EncodeToString(key), hex.EncodeToString(key) + "\n"} {
+		parsed, err := parseEncryptionKey(value)
+		if err != nil || !bytes.Equal(parsed, key) {
+			t.Errorf("parseEncryptionKey(%q) = %x, %v", value, parsed, err)
+		}
+	}
+	if _, err := parseEncryptionKey(base64.StdEncoding.EncodeToString(key[:16])); err == nil {
+		t.Error("parseEncryptionKey() accepted a 128-bit key")
+	}
+}
+
+func TestEncryptTextRoundTrip(t *testing.T) {
+	e := useTestEncryptor(t, newTestDB(t))
+	for _, text := range []string{"hello", "Привіт 👋", strings.Repeat("long ", 1000)} {
+		encrypted, err := e.EncryptText(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(encrypted, encryptedTextPrefix+e.activeID+":") || strings.Contains(encrypted, text) {
+			t.Errorf("EncryptText(%.10q) = %.40q", text, encrypted)
+		}
+		decrypted, err := e.DecryptText(encrypted)
+		if err != nil || decrypted != text {
+			t.Errorf("DecryptText() = %.10q, %v, want %.10q", decrypted, err, text)
+		}
+		// Without the key the value can't be read
+		if _, err := (*Encryptor)(nil).DecryptText(encrypted); !errors.Is(err, errEncryptionDisabled) {
+			t.Errorf("DecryptText() without encryption error = %v, want %v", err, errEncryptionDisabled)
+		}
+	}
+
+	if encrypted, _ := e.EncryptText(""); encrypted != "" {
+		t.Errorf("EncryptText(\"\") = %q, want it empty", encrypted)
+	}
+	if plain, err := e.DecryptText("stored before encryption"); err != nil || plain != "stored before encryption" {
+		t.Errorf("DecryptText() of a plain value = %q, %v", plain, err)
+	}
+	if _, err := e.DecryptText(encryptedTextPrefix + "unknown:AAAA"); err == nil {
+		t.Error("DecryptText() with an unknown data key succeeded")
+	}
+}
+
+func TestEncryptFileRoundTrip(t *testing.T) {
+	e := useTestEncryptor(t, newTestDB(t))
+	path := filepath.Join(t.TempDir(), "photo.jpg")
+	data := []byte("\xff\xd8\xff image data")
+	if err := e.WriteFile(path, data); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncryptedFile(stored) || bytes.Contains(stored, data) {
+		t.Errorf("stored file isn't encrypted: %q", stored)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("file mode = %v, want 0600", info.Mode().Perm())
+	}
+	read, err := e.ReadFile(path)
+	if err != nil || !bytes.Equal(read, data) {
+		t.Errorf("ReadFile() = %q, %v, want %q", read, err, data)
+	}
+	if plain, err := e.DecryptBytes(data); err != nil || !bytes.Equal(plain, data) {
+		t.Errorf("DecryptBytes() of a plain file = %q, %v", plain, err)
+	}
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	db := newTestDB(t)
+	oldKey, newKey := newTestMasterKey(t), newTestMasterKey(t)
+	t.Setenv(encryptionKeyEnv, oldKey)
+	before, err := LoadEncryptor(db, EncryptionConfig{Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := before.EncryptText("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldMaster, _ := parseEncryptionKey(oldKey)
+	newMaster, _ := parseEncryptionKey(newKey)
+	rewrapped, err := RotateMasterKey(db, oldMaster, newMaster)
+	if err != nil || rewrapped != 1 {
+		t.Fatalf("RotateMasterKey() = %d, %v, want 1 data key", rewrapped, err)
+	}
+
+	t.Setenv(encryptionKeyEnv, newKey)
+	after, err := LoadEncryptor(db, EncryptionConfig{Enabled: true})
+	if err != nil {
+		t.Fatalf("LoadEncryptor() with the new key error = %v", err)
+	}
+	if text, err := after.DecryptText(encrypted); err != nil || text != "secret" {
+		t.Errorf("DecryptText() after rotation = %q, %v", text, err)
+	}
+	if after.activeID == before.activeID {
+		t.Error("new content is encrypted with the data key from before the rotation")
+	}
+	t.Setenv(encryptionKeyEnv, oldKey)
+	if _, err := LoadEncryptor(db, EncryptionConfig{Enabled: true}); err == nil {
+		t.Error("LoadEncryptor() with the old key succeeded after rotation")
+	}
+}
+
+func TestEncryptExisting(t *testing.T) {
+	db := newTestDB(t)
+	storeSearchMessages(t, db)
+	e := useTestEncryptor(t, db)
+	values, _, err := e.EncryptExisting(db)
+	if err != nil {
+		t.Fatalf("EncryptExisting() error = %v", err)
+	}
+	// Content of four messages, one OCR text and one caption
+	if values != 6 {
+		t.Errorf("EncryptExisting() encrypted %d values, want 6", values)
+	}
+	if got := countRows(t, db, `SELECT count(*) FROM messages WHERE content NOT LIKE 'enc:v1:%' AND content != ''`); got != 0 {
+		t.Errorf("%d messages are left in plain form", got)
+	}
+	if again, _, _ := e.EncryptExisting(db); again != 0 {
+		t.Errorf("EncryptExisting() encrypted %d values again", again)
+	}
+}
+
+func TestEncryptedSearch(t *testing.T) {
+	db := newTestDB(t)
+	useTestEncryptor(t, db)
+	storeSearchMessages(t, db)
+	server := &Server{DB: db}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"q=bus", []string{"M3", "M1"}},
+		{"q=bus*", []string{"M5", "M3", "M1"}},
+		{"q=timetable", []string{"M4"}},
+		{"q=кава+cafe", []string{"M2"}},
+		// Pages are filled with matching messages only
+		{"q=bus*&limit=2", []string{"M5", "M3"}},
+		{"q=bus*&limit=2&offset=2", []string{"M1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			server.getDBSearchHandler(recorder, httptest.NewRequest("GET", "/search?"+tt.query, nil))
+			if recorder.Code != 200 {
+				t.Fatalf("status = %d, body %s", recorder.Code, recorder.Body)
+			}
+			var results []WebSearchResult
+			if err := json.Unmarshal(recorder.Body.Bytes(), &results); err != nil {
+				t.Fatal(err)
+			}
+			ids := []string{}
+			for _, result := range results {
+				ids = append(ids, result.ID)
+				if strings.HasPrefix(result.Content, encryptedTextPrefix) || strings.Contains(result.Snippet, encryptedTextPrefix) {
+					t.Errorf("result %s isn't decrypted: %+v", result.ID, result)
+				}
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("ids = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+
+	recorder := httptest.NewRecorder()
+	server.getDBMessagesHandler(recorder, httptest.NewRequest("GET", "/messages?from=01.05.2024&to=01.05.2024&content=BUS*", nil))
+	var messages []WebMessage
+	if err := json.Unmarshal(recorder.Body.Bytes(), &messages); err != nil {
+		t.Fatalf("%v: %s", err, recorder.Body)
+	}
+	if len(messages) != 2 || messages[0].ID != "M5" || messages[0].Content != "the business plan" || messages[1].ID != "M1" {
+		t.Errorf("/messages with the content filter = %+v, want M5 and M1 decrypted", messages)
+	}
+}
+
+func TestPlainValuesLookingEncrypted(t *testing.T) {
+	db := newTestDB(t)
+	tracker := &DBTracker{db: db, config: &Config{}}
+	sent := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	texts := []string{"enc:v1:x", "enc:plain:y", "enc:other"}
+	for i, text := range texts {
+		message := &TrackableMessage{Event: EventMessageCreated, MessageID: fmt.Sprintf("M%d", i), Chat: "a@g.us", Content: text,
+			ParsedContent: text, Timestamp: sent.Add(time.Duration(i) * time.Minute).String()}
+		if err := tracker.TrackMessage(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recorder := httptest.NewRecorder()
+	(&Server{DB: db}).getDBMessagesHandler(recorder, httptest.NewRequest("GET", "/messages?from=01.05.2024&to=01.05.2024", nil))
+	if recorder.Code != 200 {
+		t.Fatalf("/messages status = %d, body %s", recorder.Code, recorder.Body)
+	}
+	var messages []WebMessage
+	if err := json.Unmarshal(recorder.Body.Bytes(), &messages); err != nil {
+		t.Fatal(err)
+	}
+	contents := []string{}
+	for _, message := range messages {
+		contents = append(contents, message.Content)
+	}
+	if !sameStrings(contents, texts) {
+		t.Errorf("contents = %q, want %q", contents, texts)
+	}
+
+	// A file that starts like an encrypted one
+	root := t.TempDir()
+	path := filepath.Join(root, "doc.pdf")
+	data := append([]byte{}, encryptedFileMagic...)
+	data = append(data, "\x04fake"...)
+	if err := encryptor.WriteFile(path, data); err != nil {
+		t.Fatal(err)
+	}
+	if read, err := encryptor.ReadFile(path); err != nil || !bytes.Equal(read, data) {
+		t.Errorf("ReadFile() = %q, %v, want %q", read, err, data)
+	}
+	recorder = httptest.NewRecorder()
+	(&Server{fileStoragePath: root}).fileHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/doc.pdf", nil))
+	if recorder.Code != 200 || !bytes.Equal(recorder.Body.Bytes(), data) {
+		t.Errorf("/files = %d %q, want %q", recorder.Code, recorder.Body, data)
+	}
+
+	mustExec(t, db, `INSERT INTO files (id, path, message_id) VALUES ('F1', ?, 'M0')`, path)
+	e := useTestEncryptor(t, db)
+	values, files, err := e.EncryptExisting(db)
+	if err != nil || values != 6 || files != 1 {
+		t.Fatalf("EncryptExisting() = %d, %d, %v, want 6 values and 1 file", values, files, err)
+	}
+	stored, err := tracker.GetMessagesByChat("a@g.us", sent)
+	if err != nil || len(stored) != 3 || stored[1].Content != "enc:plain:y" || stored[1].ParsedContent != "enc:plain:y" {
+		t.Errorf("GetMessagesByChat() after encryption = %+v, %v", stored, err)
+	}
+	if read, err := e.ReadFile(path); err != nil || !bytes.Equal(read, data) {
+		t.Errorf("ReadFile() after encryption = %q, %v, want %q", read, err, data)
+	}
+}
+
+func TestMigrationEscapesPlainTexts(t *testing.T) {
+	db := newTestDB(t)
+	e := useTestEncryptor(t, db)
+	encrypted, err := e.EncryptText("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Texts stored before plain texts were escaped
+	for id, content := range map[string]string{"M1": "enc:v1:x", "M2": "enc:plain:y", "M3": encrypted, "M4": "hello"} {
+		mustExec(t, db, `INSERT INTO messages (id, content) VALUES (?, ?)`, id, content)
+	}
+	migrations, err := LoadMigrations(db.Dialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, migration := range migrations {
+		if migration.Name == "escape_plain_text" {
+			mustExec(t, db, migration.SQL)
+		}
+	}
+	for id, want := range map[string]string{"M1": "enc:v1:x", "M2": "enc:plain:y", "M3": "secret", "M4": "hello"} {
+		var content string
+		if err := db.QueryRow(`SELECT content FROM messages WHERE id = ?`, id).Scan(&content); err != nil {
+			t.Fatal(err)
+		}
+		if text, err := e.DecryptText(content); err != nil || text != want {
+			t.Errorf("message %s = %q, %v, want %q", id, text, err, want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix starts environment variables that override fields of the config
+const envPrefix = "WHATSGO_"
+
+// applyEnvOverrides sets fields of the config from environment variables named after their YAML path,
+// e.g. WHATSGO_DATABASE_CONNECTION_STRING for `database.connection_string`.
+// Text fields take the value as it is, other fields are parsed as YAML, e.g. WHATSGO_CHATS='[{id: 123@g.us}]'.
+func applyEnvOverrides(config *Config) error {
+	return applyEnvOverridesTo(reflect.ValueOf(config).Elem(), envPrefix)
+}
+
+func applyEnvOverridesTo(value reflect.Value, prefix string) error {
+	for i := 0; i < value.NumField(); i++ {
+		name := yamlFieldName(value.Type().Field(i))
+		if name == "" {
+			continue
+		}
+		field := value.Field(i)
+		env := prefix + strings.ToUpper(name)
+		if override, ok := os.LookupEnv(env); ok {
+			err := setFieldFromText(field, override)
+			if err != nil {
+				return fmt.Errorf("invalid value of %s: %w", env, err)
+			}
+			continue
+		}
+		if field.Kind() == reflect.Struct {
+			err := applyEnvOverridesTo(field, env+"_")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func setFieldFromText(field reflect.Value, text string) error {
+	if field.Kind() == reflect.String {
+		field.SetString(text)
+		return nil
+	}
+	return yaml.Unmarshal([]byte(text), field.Addr().Interface())
+}
+
+// yamlFieldName returns the YAML key of an exported field or an empty string
+func yamlFieldName(field reflect.StructField) string {
+	if !field.IsExported() {
+		return ""
+	}
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+	return name
+}
+
+// resolveSecretFiles reads fields that have a `<name>_file` sibling set from that file, so secrets
+// can be mounted as files instead of being written into the config. A text field takes the whole file
+// without surrounding whitespace, a list takes its non-empty lines.
+// WHATSGO_<FIELD>_FILE does the same for any text or list field.
+func resolveSecretFiles(config *Config) error {
+	return resolveSecretFilesIn(reflect.ValueOf(config).Elem(), "", envPrefix)
+}
+
+func resolveSecretFilesIn(value reflect.Value, path string, prefix string) error {
+	switch value.Kind() {
+	case reflect.Slice:
+		// Elements of lists only take files from their `<name>_file` fields
+		for i := 0; i < value.Len(); i++ {
+			err := resolveSecretFilesIn(value.Index(i), fmt.Sprintf("%s[%d]", path, i), "")
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Struct:
+	default:
+		return nil
+	}
+
+	fields := make(map[string]reflect.Value)
+	for i := 0; i < value.NumField(); i++ {
+		if name := yamlFieldName(value.Type().Field(i)); name != "" {
+			fields[name] = value.Field(i)
+		}
+	}
+	for name, field := range fields {
+		fieldPath := strings.TrimPrefix(path+"."+name, ".")
+		env := prefix + strings.ToUpper(name)
+		if field.Kind() == reflect.Struct || (field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct) {
+			childPrefix := ""
+			if prefix != "" {
+				childPrefix = env + "_"
+			}
+			err := resolveSecretFilesIn(field, fieldPath, childPrefix)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if field.Kind() != reflect.String && !(field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String) {
+			continue
+		}
+
+		var file string
+		if prefix != "" {
+			if _, ok := os.LookupEnv(env); ok {
+				// The value set by the environment takes precedence
+				continue
+			}
+			file = os.Getenv(env + "_FILE")
+		}
+		if sibling, ok := fields[name+"_file"]; ok && sibling.Kind() == reflect.String && sibling.String() != "" {
+			file = sibling.String()
+		}
+		if file == "" {
+			continue
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s from file: %w", fieldPath, err)
+		}
+		if field.Kind() == reflect.String {
+			field.SetString(strings.TrimSpace(string(content)))
+			continue
+		}
+		var lines []string
+		for _, line := range strings.Split(string(content), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				lines = append(lines, line)
+			}
+		}
+		field.Set(reflect.ValueOf(lines))
+	}
+	return nil
+}
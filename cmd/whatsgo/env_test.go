@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeTestFile writes the content to a file in a temporary directory and returns its path
+func writeTestFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	t.Setenv("WHATSGO_DATABASE_CONNECTION_STRING", "postgres://db/whatsgo")
+	t.Setenv("WHATSGO_CSV_ENABLED", "true")
+	t.Setenv("WHATSGO_QUEUE_BASE_DELAY", "30s")
+	t.Setenv("WHATSGO_CHATS", "[{id: 1@g.us, alias: team}]")
+	t.Setenv("WHATSGO_WEBHOOK_URLS", "[https://example.com/hook]")
+
+	config := GetDefaultConfig()
+	if err := applyEnvOverrides(config); err != nil {
+		t.Fatalf("applyEnvOverrides() error = %v", err)
+	}
+	if config.Database.ConnectionString != "postgres://db/whatsgo" || config.Database.Dialect != "sqlite3" {
+		t.Errorf("database = %+v", config.Database)
+	}
+	if !config.CSV.Enabled || config.CSV.Path != "csv" {
+		t.Errorf("csv = %+v", config.CSV)
+	}
+	if config.Queue.BaseDelay != 30*time.Second || config.Queue.Workers != defaultQueueWorkers {
+		t.Errorf("queue = %+v", config.Queue)
+	}
+	if !reflect.DeepEqual(config.Chats, []Chat{{ID: "1@g.us", Alias: "team"}}) {
+		t.Errorf("chats = %+v", config.Chats)
+	}
+	if !reflect.DeepEqual(config.Webhook.URLs, []string{"https://example.com/hook"}) {
+		t.Errorf("webhook.urls = %q", config.Webhook.URLs)
+	}
+
+	t.Setenv("WHATSGO_QUEUE_WORKERS", "many")
+	if err := applyEnvOverrides(GetDefaultConfig()); err == nil {
+		t.Error("applyEnvOverrides() accepted an invalid number")
+	}
+}
+
+func TestResolveSecretFiles(t *testing.T) {
+	config := GetDefaultConfig()
+	config.Database.ConnectionStringFile = writeTestFile(t, "dsn", "postgres://db/whatsgo\n")
+	config.Webhook.Targets = []WebhookTarget{
+		{Name: "a", URL: "https://example.com/a", Secret: "inline", SecretFile: writeTestFile(t, "secret", " from file \n")},
+		{Name: "b", URL: "https://example.com/b", Secret: "inline"},
+	}
+	t.Setenv("WHATSGO_WEBHOOK_URLS_FILE", writeTestFile(t, "urls", "https://example.com/1\n\n  https://example.com/2\n"))
+	if err := resolveSecretFiles(config); err != nil {
+		t.Fatalf("resolveSecretFiles() error = %v", err)
+	}
+	if config.Database.ConnectionString != "postgres://db/whatsgo" {
+		t.Errorf("database.connection_string = %q", config.Database.ConnectionString)
+	}
+	if config.Webhook.Targets[0].Secret != "from file" || config.Webhook.Targets[1].Secret != "inline" {
+		t.Errorf("secrets = %q, %q", config.Webhook.Targets[0].Secret, config.Webhook.Targets[1].Secret)
+	}
+	if !reflect.DeepEqual(config.Webhook.URLs, []string{"https://example.com/1", "https://example.com/2"}) {
+		t.Errorf("webhook.urls = %q", config.Webhook.URLs)
+	}
+
+	// The value set by the environment takes precedence over the file
+	t.Setenv("WHATSGO_WEBHOOK_URLS", "[https://example.com/env]")
+	config = GetDefaultConfig()
+	if err := applyEnvOverrides(config); err != nil {
+		t.Fatal(err)
+	}
+	if err := resolveSecretFiles(config); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.Webhook.URLs, []string{"https://example.com/env"}) {
+		t.Errorf("webhook.urls = %q, want the environment value", config.Webhook.URLs)
+	}
+
+	config = GetDefaultConfig()
+	config.Database.ConnectionStringFile = filepath.Join(t.TempDir(), "missing")
+	if err := resolveSecretFiles(config); err == nil {
+		t.Error("resolveSecretFiles() succeeded with a missing file")
+	}
+}
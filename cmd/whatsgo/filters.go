@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// jidMatcher matches JIDs by exact value, glob, server and name of the chat
+type jidMatcher struct {
+	exact   map[string]bool
+	globs   []string
+	servers map[string]bool
+	names   []*regexp.Regexp
+}
+
+func compileJIDMatcher(patterns []string, servers []string, names []string) (*jidMatcher, error) {
+	matcher := &jidMatcher{exact: make(map[string]bool), servers: make(map[string]bool)}
+	for _, pattern := range patterns {
+		pattern = strings.TrimPrefix(pattern, "+")
+		if !strings.ContainsAny(pattern, `*?[\`) {
+			matcher.exact[pattern] = true
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		matcher.globs = append(matcher.globs, pattern)
+	}
+	for _, server := range servers {
+		matcher.servers[strings.TrimPrefix(server, "@")] = true
+	}
+	for _, name := range names {
+		re, err := regexp.Compile(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid name pattern %q: %w", name, err)
+		}
+		matcher.names = append(matcher.names, re)
+	}
+	return matcher, nil
+}
+
+func (m *jidMatcher) empty() bool {
+	return len(m.exact) == 0 && len(m.globs) == 0 && len(m.servers) == 0 && len(m.names) == 0
+}
+
+// match reports whether the JID, its user part or the name matches.
+// The name is only looked up when there are name patterns.
+func (m *jidMatcher) match(jid string, name func(string) string) bool {
+	user, server := jid, ""
+	if parsed, err := types.ParseJID(jid); err == nil {
+		jid, user, server = parsed.ToNonAD().String(), parsed.User, parsed.Server
+	}
+	if m.exact[jid] || m.exact[user] || m.servers[server] {
+		return true
+	}
+	for _, glob := range m.globs {
+		if ok, _ := path.Match(glob, jid); ok {
+			return true
+		}
+		if ok, _ := path.Match(glob, user); ok {
+			return true
+		}
+	}
+	if len(m.names) > 0 && name != nil {
+		chatName := name(jid)
+		for _, re := range m.names {
+			if chatName != "" && re.MatchString(chatName) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ChatFilter decides which chats and senders are tracked. A chat is tracked if it's listed in `chats`
+// or matches `filters.include`, or if both are unset, and it doesn't match `filters.exclude`.
+// An empty `chats: []` without include filters tracks no chats.
+type ChatFilter struct {
+	none         bool
+	include      *jidMatcher
+	exclude      *jidMatcher
+	allowSenders *jidMatcher
+	denySenders  *jidMatcher
+	chatName     func(string) string
+}
+
+func CompileChatFilter(config *Config) (*ChatFilter, error) {
+	// Copied, so appending doesn't change filters.include.chats of the config
+	chats := append([]string(nil), config.Filters.Include.Chats...)
+	for _, chat := range config.Chats {
+		chats = append(chats, chat.ID)
+	}
+
+	var filter ChatFilter
+	var err error
+	filter.include, err = compileJIDMatcher(chats, config.Filters.Include.Servers, config.Filters.Include.Names)
+	if err != nil {
+		return nil, fmt.Errorf("filters.include: %w", err)
+	}
+	filter.none = config.Chats != nil && filter.include.empty()
+	filter.exclude, err = compileJIDMatcher(config.Filters.Exclude.Chats, config.Filters.Exclude.Servers, config.Filters.Exclude.Names)
+	if err != nil {
+		return nil, fmt.Errorf("filters.exclude: %w", err)
+	}
+	filter.allowSenders, err = compileJIDMatcher(config.Filters.Senders.Allow, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("filters.senders.allow: %w", err)
+	}
+	filter.denySenders, err = compileJIDMatcher(config.Filters.Senders.Deny, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("filters.senders.deny: %w", err)
+	}
+	return &filter, nil
+}
+
+// MatchChat reports whether the chat is tracked
+func (f *ChatFilter) MatchChat(chatID string) bool {
+	if f.none {
+		return false
+	}
+	if !f.include.empty() && !f.include.match(chatID, f.chatName) {
+		return false
+	}
+	return !f.exclude.match(chatID, f.chatName)
+}
+
+// MatchSender reports whether messages of the sender are tracked
+func (f *ChatFilter) MatchSender(senderID string) bool {
+	if !f.allowSenders.empty() && !f.allowSenders.match(senderID, nil) {
+		return false
+	}
+	return !f.denySenders.match(senderID, nil)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChatFilter(t *testing.T) {
+	names := map[string]string{"1@g.us": "Team news", "2@g.us": "Spam offers"}
+	chatName := func(jid string) string { return names[jid] }
+
+	tests := []struct {
+		name   string
+		config Config
+		want   map[string]bool
+	}{
+		{"no chats", Config{},
+			map[string]bool{"1@g.us": true, "380501234567@s.whatsapp.net": true}},
+		{"empty chats", Config{Chats: []Chat{}},
+			map[string]bool{"1@g.us": false, "380501234567@s.whatsapp.net": false}},
+		{"listed chats", Config{Chats: []Chat{{ID: "1@g.us"}}},
+			map[string]bool{"1@g.us": true, "2@g.us": false}},
+		{"empty chats with include", Config{Chats: []Chat{}, Filters: FilterConfig{Include: ChatSelector{Servers: []string{"g.us"}}}},
+			map[string]bool{"2@g.us": true, "380501234567@s.whatsapp.net": false}},
+		{"globs", Config{Filters: FilterConfig{Include: ChatSelector{Chats: []string{"+380*"}}}},
+			map[string]bool{"380501234567@s.whatsapp.net": true, "380501234567:12@s.whatsapp.net": true, "1@g.us": false}},
+		{"names and exclude", Config{Filters: FilterConfig{
+			Include: ChatSelector{Names: []string{"(?i)^team "}},
+			Exclude: ChatSelector{Chats: []string{"3@g.us"}, Names: []string{"(?i)spam"}}}},
+			map[string]bool{"1@g.us": true, "2@g.us": false, "3@g.us": false}},
+		{"exclude only", Config{Filters: FilterConfig{Exclude: ChatSelector{Servers: []string{"@newsletter"}}}},
+			map[string]bool{"1@g.us": true, "1@newsletter": false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := CompileChatFilter(&tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			filter.chatName = chatName
+			for chatID, want := range tt.want {
+				if got := filter.MatchChat(chatID); got != want {
+					t.Errorf("MatchChat(%s) = %v, want %v", chatID, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestChatFilterSenders(t *testing.T) {
+	filter, err := CompileChatFilter(&Config{Filters: FilterConfig{Senders: SenderFilter{
+		Allow: []string{"380*"},
+		Deny:  []string{"+380501234567"},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for senderID, want := range map[string]bool{
+		"380507654321@s.whatsapp.net":   true,
+		"380501234567@s.whatsapp.net":   false,
+		"380501234567:3@s.whatsapp.net": false,
+		"14155550100@s.whatsapp.net":    false,
+	} {
+		if got := filter.MatchSender(senderID); got != want {
+			t.Errorf("MatchSender(%s) = %v, want %v", senderID, got, want)
+		}
+	}
+}
+
+func TestCompileChatFilterKeepsConfig(t *testing.T) {
+	include := make([]string, 1, 4)
+	include[0] = "1@g.us"
+	config := &Config{Chats: []Chat{{ID: "2@g.us"}}, Filters: FilterConfig{Include: ChatSelector{Chats: include}}}
+	if _, err := CompileChatFilter(config); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.Filters.Include.Chats, []string{"1@g.us"}) || include[:2][1] != "" {
+		t.Errorf("filters.include.chats = %q, backing array %q, want them unchanged", config.Filters.Include.Chats, include[:2])
+	}
+}
+
+func TestCompileChatFilterErrors(t *testing.T) {
+	configs := []Config{
+		{Filters: FilterConfig{Include: ChatSelector{Chats: []string{"[380"}}}},
+		{Filters: FilterConfig{Exclude: ChatSelector{Names: []string{"(spam"}}}},
+		{Filters: FilterConfig{Senders: SenderFilter{Deny: []string{"[1"}}}},
+	}
+	for _, config := range configs {
+		if _, err := CompileChatFilter(&config); err == nil {
+			t.Errorf("CompileChatFilter(%+v) succeeded", config.Filters)
+		}
+	}
+}
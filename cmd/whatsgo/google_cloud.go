@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -227,6 +228,10 @@ type CloudTracker struct {
 	folderID      string
 }
 
+func (tracker *CloudTracker) Name() string {
+	return "google_cloud"
+}
+
 func (tracker *CloudTracker) Init(config *Config) error {
 	ctx := context.Background()
 
@@ -335,6 +340,10 @@ func (tracker *CloudTracker) getOrCreateFolder(parentFolderId string, path strin
 }
 
 func (tracker *CloudTracker) TrackMessage(message *TrackableMessage) error {
+	if !message.IsMessageEvent() {
+		return nil
+	}
+
 	path := fmt.Sprintf("%s/%s", message.Metadata.Folder, message.Metadata.Date)
 	folderId, err := tracker.getOrCreateFolder(tracker.folderID, path)
 	if err != nil {
@@ -347,10 +356,18 @@ func (tracker *CloudTracker) TrackMessage(message *TrackableMessage) error {
 		return err
 	}
 
+	if message.Event == EventMessageEdited || message.Event == EventMessageRevoked {
+		spreadsheet, err := tracker.getOrCreateSpreadsheet(message.Chat, folderId)
+		if err != nil {
+			return err
+		}
+		return tracker.updateRow(spreadsheet, message)
+	}
+
 	// Store all files into a Google Drive folder
 	fileLinks := make([]string, len(message.Files))
-	for i, filePath := range message.Files {
-		link, err := tracker.storeFile(filePath, folderId)
+	for i, file := range message.Files {
+		link, err := tracker.storeFile(file.Path, folderId)
 		if err != nil {
 			return err
 		}
@@ -364,49 +381,36 @@ func (tracker *CloudTracker) TrackMessage(message *TrackableMessage) error {
 	}
 
 	// Insert the data about the message
-	fileLinksInterface := make([]interface{}, len(fileLinks)*2)
-	for i, v := range fileLinks {
-		fileLinksInterface[i] = fmt.Sprintf("=IMAGE(\"%s\")", v)
-		fileLinksInterface[i+1] = v
+	fileLinksInterface := make([]interface{}, 0, len(fileLinks)*2)
+	for _, v := range fileLinks {
+		fileLinksInterface = append(fileLinksInterface, fmt.Sprintf("=IMAGE(\"%s\")", v), v)
+	}
+	sender := message.Sender
+	if message.SenderName != "" {
+		sender = fmt.Sprintf("%s (%s)", message.SenderName, message.Sender)
 	}
 	values := append([]interface{}{
 		message.MessageID,
 		message.Metadata.Timestamp.Format("15:04:05"),
-		message.Sender,
+		sender,
 		message.Content,
 		message.ParsedContent,
+		formatAnnotations(message.Annotations),
 	}, fileLinksInterface...)
 
-	retryAttempts := 5
-	delay := time.Second * 10
-
-	for attempt := 1; attempt <= retryAttempts; attempt++ {
-		err = tracker.insertRow(spreadsheet, values)
-		if err == nil {
-			break
-		}
-		if attempt < retryAttempts {
-			log.Warnf("Attempt %d failed: %v. Retrying after %s...", attempt, err, delay)
-			time.Sleep(delay)
-		} else {
-			log.Errorf("All %d attempts failed: %v", retryAttempts, err)
-			return err
-		}
-	}
-
-	return nil
+	// Failed rows are retried by the tracker queue
+	return tracker.insertRow(spreadsheet, values)
 }
 
 // StoreFile stores a file in Google Cloud
 
 func (tracker *CloudTracker) storeFile(filePath string, folderId string) (string, error) {
-	// Open the file
-	f, err := os.Open(filePath)
+	// Read the file, encrypted files are uploaded decrypted
+	data, err := encryptor.ReadFile(filePath)
 	if err != nil {
 		log.Errorf("Unable to open file: %v", err)
 		return "", err
 	}
-	defer f.Close()
 
 	// Check if the file already exists in the folder
 	searchResult, err := tracker.driveService.Files.List().Q(fmt.Sprintf("name='%s' and '%s' in parents", filepath.Base(filePath), folderId)).Do()
@@ -424,7 +428,7 @@ func (tracker *CloudTracker) storeFile(filePath string, folderId string) (string
 		Name:     filepath.Base(filePath),
 		MimeType: "application/octet-stream",
 		Parents:  []string{folderId},
-	}).Media(f).Do()
+	}).Media(bytes.NewReader(data)).Do()
 	if err != nil {
 		log.Errorf("Unable to create file on Drive: %v", err)
 		return "", err
@@ -568,3 +572,152 @@ func (tracker *CloudTracker) insertRow(spreadsheet *sheets.Spreadsheet, values [
 
 	return nil
 }
+
+// updateRow changes the content of an edited message and annotates an edited or revoked message
+func (tracker *CloudTracker) updateRow(spreadsheet *sheets.Spreadsheet, message *TrackableMessage) error {
+	rowsResponse, err := tracker.sheetsService.Spreadsheets.Values.Get(spreadsheet.SpreadsheetId, "A:F").Do()
+	if err != nil {
+		log.Errorf("Unable to get values from spreadsheet: %v", err)
+		return err
+	}
+
+	for i, row := range rowsResponse.Values {
+		if len(row) == 0 || row[0] != message.MessageID {
+			continue
+		}
+		annotations := changeAnnotation(message)
+		if len(row) > 5 && row[5] != "" {
+			annotations = fmt.Sprintf("%v; %s", row[5], annotations)
+		}
+
+		data := []*sheets.ValueRange{
+			{Range: fmt.Sprintf("F%d", i+1), Values: [][]interface{}{{annotations}}},
+		}
+		if message.Event == EventMessageEdited {
+			data = append(data, &sheets.ValueRange{Range: fmt.Sprintf("D%d", i+1), Values: [][]interface{}{{message.Content}}})
+		}
+		_, err = tracker.sheetsService.Spreadsheets.Values.BatchUpdate(spreadsheet.SpreadsheetId, &sheets.BatchUpdateValuesRequest{
+			ValueInputOption: "RAW",
+			Data:             data,
+		}).Do()
+		if err != nil {
+			log.Errorf("Unable to update row: %v", err)
+			return err
+		}
+		log.Infof("Updated row %d of spreadsheet %s", i+1, spreadsheet.SpreadsheetId)
+		return nil
+	}
+
+	return fmt.Errorf("changed message %s in spreadsheet %s: %w", message.MessageID, spreadsheet.SpreadsheetId, errMessageNotStored)
+}
+
+// findFolder returns the ID of the folder at the path below the folder of the tracker, or "" if it doesn't exist
+func (tracker *CloudTracker) findFolder(path string) (string, error) {
+	folderId := tracker.folderID
+	if folderId == "" {
+		rootFolder, err := tracker.driveService.Files.Get("root").Do()
+		if err != nil {
+			return "", err
+		}
+		folderId = rootFolder.Id
+	}
+	for _, folder := range strings.Split(path, "/") {
+		searchResult, err := tracker.driveService.Files.List().Q(fmt.Sprintf("name='%s' and '%s' in parents", folder, folderId)).Do()
+		if err != nil {
+			return "", err
+		}
+		if len(searchResult.Files) == 0 {
+			return "", nil
+		}
+		folderId = searchResult.Files[0].Id
+	}
+	return folderId, nil
+}
+
+// RemoveRecords deletes rows of the messages and file links of the messages with expired media from the spreadsheet
+// of the chat in the folder of the chat and the date, and deletes the uploaded files with the names from that folder
+func (tracker *CloudTracker) RemoveRecords(folder string, date string, chat string, messages map[string]bool, media map[string]bool,
+	fileNames []string) error {
+	folderId, err := tracker.findFolder(folder + "/" + date)
+	if err != nil || folderId == "" {
+		return err
+	}
+
+	for _, name := range fileNames {
+		searchResult, err := tracker.driveService.Files.List().Q(fmt.Sprintf("name='%s' and '%s' in parents", name, folderId)).Do()
+		if err != nil {
+			return err
+		}
+		for _, file := range searchResult.Files {
+			err = tracker.driveService.Files.Delete(file.Id).Do()
+			if err != nil {
+				return err
+			}
+			log.Infof("Deleted expired file %s from Drive", name)
+		}
+	}
+
+	searchResult, err := tracker.driveService.Files.List().Q(fmt.Sprintf("name='%s' and '%s' in parents", chat, folderId)).Do()
+	if err != nil {
+		return err
+	}
+	if len(searchResult.Files) == 0 {
+		return nil
+	}
+	spreadsheetId := searchResult.Files[0].Id
+	defer messageIdsCache.Remove(spreadsheetId)
+
+	spreadsheet, err := tracker.sheetsService.Spreadsheets.Get(spreadsheetId).Do()
+	if err != nil {
+		return err
+	}
+	if len(spreadsheet.Sheets) == 0 {
+		return nil
+	}
+	sheet := spreadsheet.Sheets[0].Properties
+	rowsResponse, err := tracker.sheetsService.Spreadsheets.Values.Get(spreadsheetId, fmt.Sprintf("'%s'", sheet.Title)).Do()
+	if err != nil {
+		return err
+	}
+
+	// File links start in column G, rows are deleted from the bottom so indexes of rows above stay valid
+	var cleared []string
+	var deleted []*sheets.Request
+	kept := 0
+	for i, row := range rowsResponse.Values {
+		id := ""
+		if len(row) > 0 {
+			id = fmt.Sprint(row[0])
+		}
+		if messages[id] {
+			deleted = append([]*sheets.Request{{DeleteDimension: &sheets.DeleteDimensionRequest{Range: &sheets.DimensionRange{
+				SheetId: sheet.SheetId, Dimension: "ROWS", StartIndex: int64(i), EndIndex: int64(i + 1),
+			}}}}, deleted...)
+			continue
+		}
+		kept++
+		if media[id] && len(row) > 6 {
+			cleared = append(cleared, fmt.Sprintf("'%s'!G%d:%d", sheet.Title, i+1, i+1))
+		}
+	}
+
+	// A sheet can't lose all its rows, the spreadsheet is deleted instead
+	if kept == 0 {
+		spreadSheetsCache.Remove(fmt.Sprintf("%s-%s", chat, folderId))
+		return tracker.driveService.Files.Delete(spreadsheetId).Do()
+	}
+	if len(cleared) > 0 {
+		_, err = tracker.sheetsService.Spreadsheets.Values.BatchClear(spreadsheetId, &sheets.BatchClearValuesRequest{Ranges: cleared}).Do()
+		if err != nil {
+			return err
+		}
+	}
+	if len(deleted) > 0 {
+		_, err = tracker.sheetsService.Spreadsheets.BatchUpdate(spreadsheetId, &sheets.BatchUpdateSpreadsheetRequest{Requests: deleted}).Do()
+		if err != nil {
+			return err
+		}
+	}
+	log.Infof("Removed %d expired rows and the files of %d rows from spreadsheet %s", len(deleted), len(cleared), spreadsheetId)
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Kinds of group changes
+const (
+	GroupChangeJoin        = "join"
+	GroupChangeLeave       = "leave"
+	GroupChangePromote     = "promote"
+	GroupChangeDemote      = "demote"
+	GroupChangeSubject     = "subject"
+	GroupChangeDescription = "description"
+	GroupChangePicture     = "picture"
+)
+
+// GroupChange is a change of the members or the metadata of a group.
+// Value is the new subject, description or picture ID, it's empty when the picture was removed.
+type GroupChange struct {
+	Type         string   `json:"type"`
+	Participants []string `json:"participants,omitempty"`
+	Value        string   `json:"value,omitempty"`
+	Reason       string   `json:"reason,omitempty"`
+}
+
+// groupChanges lists the changes of a group info event that are kept in the audit log
+func groupChanges(evt *events.GroupInfo) []GroupChange {
+	var changes []GroupChange
+	if len(evt.Join) > 0 {
+		changes = append(changes, GroupChange{Type: GroupChangeJoin, Participants: jidStrings(evt.Join), Reason: evt.JoinReason})
+	}
+	if len(evt.Leave) > 0 {
+		changes = append(changes, GroupChange{Type: GroupChangeLeave, Participants: jidStrings(evt.Leave)})
+	}
+	if len(evt.Promote) > 0 {
+		changes = append(changes, GroupChange{Type: GroupChangePromote, Participants: jidStrings(evt.Promote)})
+	}
+	if len(evt.Demote) > 0 {
+		changes = append(changes, GroupChange{Type: GroupChangeDemote, Participants: jidStrings(evt.Demote)})
+	}
+	if evt.Name != nil {
+		changes = append(changes, GroupChange{Type: GroupChangeSubject, Value: evt.Name.Name})
+	}
+	if evt.Topic != nil {
+		change := GroupChange{Type: GroupChangeDescription, Value: evt.Topic.Topic}
+		if evt.Topic.TopicDeleted {
+			change.Value = ""
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+func jidStrings(jids []types.JID) []string {
+	result := make([]string, len(jids))
+	for i, jid := range jids {
+		result[i] = jid.ToNonAD().String()
+	}
+	return result
+}
+
+// groupChangeID identifies a change by the group, its time, kind and content, so a notification that is
+// delivered again, e.g. after a reconnect, gets the same ID. The participant list version of the notification
+// keeps apart the same participant added, removed and added again within a second.
+func groupChangeID(chat types.JID, actor types.JID, timestamp time.Time, version string, change GroupChange) string {
+	var unix int64
+	if !timestamp.IsZero() {
+		unix = timestamp.Unix()
+	}
+	content := strings.Join(append([]string{actor.String(), version, change.Value, change.Reason}, change.Participants...), "\n")
+	hash := sha256.Sum256([]byte(content))
+	return fmt.Sprintf("%s-%d-%s-%s", chat.User, unix, change.Type, hex.EncodeToString(hash[:8]))
+}
+
+// trackGroupChange passes a change of a group to trackers and to clients of the events WebSocket.
+// Changes without a timestamp are recorded at the current time.
+func trackGroupChange(chat types.JID, actor types.JID, timestamp time.Time, version string, change GroupChange, queue *TrackerQueue, directory *Directory, server *Server) {
+	id := groupChangeID(chat, actor, timestamp, version, change)
+	if timestamp.IsZero() {
+		timestamp = time.Now().Round(0)
+	}
+	message := TrackableMessage{
+		Event:       EventGroupChange,
+		MessageID:   id,
+		Chat:        chat.String(),
+		ChatName:    directory.ChatName(chat.String()),
+		Timestamp:   timestamp.String(),
+		GroupChange: &change,
+		Metadata: MessageMetadata{
+			Date:      timestamp.Format("02.01.2006"),
+			Timestamp: timestamp,
+		},
+	}
+	if !actor.IsEmpty() {
+		message.Sender = actor.ToNonAD().String()
+		message.SenderName = directory.ContactName(message.Sender)
+	}
+
+	log.Infof("Tracking %s %s in group %s", message.Event, change.Type, message.Chat)
+	err := queue.Enqueue(&message)
+	if err != nil {
+		log.Errorf("Failed to enqueue %s %s: %v", message.Event, message.MessageID, err)
+		return
+	}
+	if server != nil {
+		server.broadcastEvent(message.Event, message)
+	}
+}
+
+// trackGroupInfo passes changes of a group info event to trackers
+func trackGroupInfo(evt *events.GroupInfo, queue *TrackerQueue, directory *Directory, server *Server) {
+	var actor types.JID
+	if evt.Sender != nil {
+		actor = *evt.Sender
+	}
+	for _, change := range groupChanges(evt) {
+		trackGroupChange(evt.JID, actor, evt.Timestamp, evt.ParticipantVersionID, change, queue, directory, server)
+	}
+}
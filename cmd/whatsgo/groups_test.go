@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestGroupChangeID(t *testing.T) {
+	chat := types.NewJID("120363000000000000", types.GroupServer)
+	admin := types.NewJID("380501234567", types.DefaultUserServer)
+	second := time.Unix(1714546800, 0)
+	changes := []struct {
+		actor   types.JID
+		version string
+		change  GroupChange
+	}{
+		{admin, "v1", GroupChange{Type: GroupChangeJoin, Participants: []string{"1@s.whatsapp.net"}}},
+		{admin, "v2", GroupChange{Type: GroupChangeJoin, Participants: []string{"2@s.whatsapp.net"}}},
+		{admin, "v3", GroupChange{Type: GroupChangeLeave, Participants: []string{"1@s.whatsapp.net"}}},
+		// The same participant added again within the second
+		{admin, "v4", GroupChange{Type: GroupChangeJoin, Participants: []string{"1@s.whatsapp.net"}}},
+		{types.EmptyJID, "", GroupChange{Type: GroupChangeSubject, Value: "Team"}},
+		{types.EmptyJID, "", GroupChange{Type: GroupChangeSubject, Value: "Team A"}},
+	}
+	ids := make(map[string]bool)
+	for _, c := range changes {
+		id := groupChangeID(chat, c.actor, second, c.version, c.change)
+		if ids[id] {
+			t.Errorf("groupChangeID() = %s, returned for an earlier change as well", id)
+		}
+		ids[id] = true
+		// A notification delivered again gets the same ID
+		if again := groupChangeID(chat, c.actor, second, c.version, c.change); again != id {
+			t.Errorf("groupChangeID() = %s, then %s for the same change", id, again)
+		}
+	}
+}
+
+func TestGroupChangeStoredOnce(t *testing.T) {
+	db := newTestDB(t)
+	tracker := &DBTracker{db: db}
+	chat := types.NewJID("120363000000000000", types.GroupServer)
+	admin := types.NewJID("380501234567", types.DefaultUserServer)
+	change := GroupChange{Type: GroupChangeJoin, Participants: []string{"1@s.whatsapp.net", "2@s.whatsapp.net"}}
+	// The notification is delivered again after a reconnect
+	for i := 0; i < 2; i++ {
+		message := &TrackableMessage{Event: EventGroupChange, MessageID: groupChangeID(chat, admin, time.Unix(1714546800, 0), "v1", change),
+			Chat: chat.String(), Sender: admin.String(), Timestamp: "1714546800", GroupChange: &change}
+		if err := tracker.TrackMessage(message); err != nil {
+			t.Fatalf("TrackMessage() error = %v", err)
+		}
+	}
+	if got := countRows(t, db, `SELECT count(*) FROM group_events`); got != 2 {
+		t.Errorf("group events = %d, want one per participant", got)
+	}
+	if _, err := db.Exec(`INSERT INTO group_events (event_id, participant) SELECT event_id, participant FROM group_events`); err == nil {
+		t.Error("a duplicate group event was stored")
+	}
+}
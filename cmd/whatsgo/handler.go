@@ -1,238 +1,292 @@
 package main
 
 import (
-	//"encoding/json"
+	"context"
 	"fmt"
 	"go.mau.fi/whatsmeow/appstate"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
 	"go.mau.fi/whatsmeow/types"
 	"go.mau.fi/whatsmeow/types/events"
 	"mime"
 	"os"
+	"path/filepath"
 	"strings"
-	//"sync/atomic"
-	//"time"
+	"time"
 )
 
-func CreateHandler(fileFolder string, trackers []Tracker, config *Config, server *Server) func(interface{}) {
+func CreateHandler(fileFolder string, db *DB, queue *TrackerQueue, processors *ProcessorSet, directory *Directory, configs *ConfigHolder, server *Server) (func(interface{}), *HistoryImporter) {
 
-	//var historySyncID int32
-	//var startupTime = time.Now().Unix()
-
-	handler := func(rawEvt interface{}) {
-		switch evt := rawEvt.(type) {
-		case *events.AppStateSyncComplete:
-			if len(cli.Store.PushName) > 0 && evt.Name == appstate.WAPatchCriticalBlock {
-				err := cli.SendPresence(types.PresenceAvailable)
-				if err != nil {
-					log.Warnf("Failed to send available presence: %v", err)
-				} else {
-					log.Infof("Marked self as available")
-				}
-			}
-		case *events.Connected, *events.PushNameSetting:
-			if len(cli.Store.PushName) == 0 {
-				return
-			}
-			// Send presence available when connecting and when the pushname is changed.
-			// This makes sure that outgoing messages always have the right pushname.
-			err := cli.SendPresence(types.PresenceAvailable)
-			if err != nil {
-				log.Warnf("Failed to send available presence: %v", err)
-			} else {
-				log.Infof("Marked self as available")
-			}
-		case *events.StreamReplaced:
-			os.Exit(0)
-		case *events.Message:
-			timestamp := evt.Info.Timestamp
-			metaParts := []string{fmt.Sprintf("pushname: %s", evt.Info.PushName), fmt.Sprintf("timestamp: %s", timestamp)}
-			if evt.Info.Type != "" {
-				metaParts = append(metaParts, fmt.Sprintf("type: %s", evt.Info.Type))
-			}
-			if evt.Info.Category != "" {
-				metaParts = append(metaParts, fmt.Sprintf("category: %s", evt.Info.Category))
-			}
-			if evt.IsViewOnce {
-				metaParts = append(metaParts, "view once")
-			}
-			if evt.IsViewOnce {
-				metaParts = append(metaParts, "ephemeral")
-			}
-			if evt.IsViewOnceV2 {
-				metaParts = append(metaParts, "ephemeral (v2)")
-			}
-			if evt.IsDocumentWithCaption {
-				metaParts = append(metaParts, "document with caption")
-			}
-			if evt.IsEdit {
-				metaParts = append(metaParts, "edit")
-			}
+	handleMessage := func(evt *events.Message, live bool) {
+		config := configs.Get()
+		// The trackers are replaced when the config is reloaded
+		dbTracker := findDBTracker(queue.Router().Trackers())
+		timestamp := evt.Info.Timestamp
+		metaParts := []string{fmt.Sprintf("pushname: %s", evt.Info.PushName), fmt.Sprintf("timestamp: %s", timestamp)}
+		if evt.Info.Type != "" {
+			metaParts = append(metaParts, fmt.Sprintf("type: %s", evt.Info.Type))
+		}
+		if evt.Info.Category != "" {
+			metaParts = append(metaParts, fmt.Sprintf("category: %s", evt.Info.Category))
+		}
+		if evt.IsViewOnce {
+			metaParts = append(metaParts, "view once")
+		}
+		if evt.IsViewOnce {
+			metaParts = append(metaParts, "ephemeral")
+		}
+		if evt.IsViewOnceV2 {
+			metaParts = append(metaParts, "ephemeral (v2)")
+		}
+		if evt.IsDocumentWithCaption {
+			metaParts = append(metaParts, "document with caption")
+		}
+		if evt.IsEdit {
+			metaParts = append(metaParts, "edit")
+		}
 
-			log.Infof("Received message %s from %s (%s)", evt.Info.ID, evt.Info.SourceString(), strings.Join(metaParts, ", "))
+		log.Infof("Received message %s from %s (%s)", evt.Info.ID, evt.Info.SourceString(), strings.Join(metaParts, ", "))
 
-			log.Infof(evt.Info.MessageSource.Chat.String())
-			log.Infof(evt.Info.MessageSource.Sender.String())
-			var sender = evt.Info.MessageSource.Sender.String()
-			var chat = evt.Info.MessageSource.Chat.String()
+		log.Infof(evt.Info.MessageSource.Chat.String())
+		log.Infof(evt.Info.MessageSource.Sender.String())
+		var sender = evt.Info.MessageSource.Sender.String()
+		var chat = evt.Info.MessageSource.Chat.String()
 
-			var trackable = config.IsChatTrackable(chat)
+		var trackable = config.IsChatTrackable(chat) && config.IsSenderTrackable(sender)
 
-			var text string
-			if trackable && evt.Info.Type == "text" {
-				text = evt.Message.GetConversation()
-				if text == "" && evt.Message.ExtendedTextMessage != nil {
-					text = *evt.Message.ExtendedTextMessage.Text
-				}
-			}
+		if live {
+			directory.SavePushName(evt.Info.Sender, evt.Info.PushName)
+		}
 
-			if evt.Message.GetPollUpdateMessage() != nil {
-				decrypted, err := cli.DecryptPollVote(evt)
-				if err != nil {
-					log.Errorf("Failed to decrypt vote: %v", err)
-				} else {
-					log.Infof("Selected options in decrypted vote:")
-					for _, option := range decrypted.SelectedOptions {
-						log.Infof("- %X", option)
-					}
-				}
-			} else if evt.Message.GetEncReactionMessage() != nil {
-				decrypted, err := cli.DecryptReaction(evt)
-				if err != nil {
-					log.Errorf("Failed to decrypt encrypted reaction: %v", err)
-				} else {
-					log.Infof("Decrypted reaction: %+v", decrypted)
-				}
-			}
+		// Messages from history sync are not shown to web clients as new ones
+		webServer := server
+		if !live {
+			webServer = nil
+		}
 
-			date := timestamp.Format("02.01.2006")
+		if protocol := evt.Message.GetProtocolMessage(); trackable && protocol != nil {
+			trackMessageChange(evt, protocol, queue, dbTracker, config)
+			return
+		}
 
-			// Get the chat alias or ID
-			folder := chat
-			for _, c := range config.Chats {
-				if c.ID == chat && c.Alias != "" {
-					folder = c.Alias
-					break
-				}
+		// Messages from history sync have no type, so the text is taken from any message
+		var text string
+		if trackable {
+			text = evt.Message.GetConversation()
+			if text == "" && evt.Message.ExtendedTextMessage != nil {
+				text = evt.Message.ExtendedTextMessage.GetText()
 			}
+		}
 
-			metadata := MessageMetadata{
-				Date:      date,
-				Folder:    folder,
-				Timestamp: timestamp,
-			}
+		if trackable && trackReactionOrVote(evt, queue, dbTracker, webServer) {
+			return
+		}
 
-			var files []string
-			img := evt.Message.GetImageMessage()
-			if trackable && img != nil {
-				data, err := cli.Download(img)
-				if err != nil {
-					log.Errorf("Failed to download image: %v", err)
-					return
-				}
-				exts, _ := mime.ExtensionsByType(img.GetMimetype())
-				ext := exts[0]
-				if ext == ".jpe" {
-					ext = ".jpg"
-				}
+		poll := getPoll(evt.Message)
+		if trackable && poll != nil {
+			text = poll.Question
+			log.Infof("Received poll with %d options in message", len(poll.Options))
+		}
 
-				subFolder := fmt.Sprintf("%s/%s/%s", fileFolder, folder, date)
-				path := fmt.Sprintf("%s/%s%s", subFolder, evt.Info.ID, ext)
+		date := timestamp.Format("02.01.2006")
 
-				// Create sub folder if it doesn't exist
-				if _, err := os.Stat(subFolder); os.IsNotExist(err) {
-					err = os.MkdirAll(subFolder, 0755)
-					if err != nil {
-						log.Errorf("Failed to create subfolder: %v", err)
-						return
-					}
-				}
+		// Get the chat alias or ID
+		folder := config.GetChatFolder(chat)
 
-				err = os.WriteFile(path, data, 0755)
-				if err != nil {
-					log.Errorf("Failed to save image: %v", err)
-					return
-				}
-				text = img.GetCaption()
-				files = append(files, path)
+		metadata := MessageMetadata{
+			Date:      date,
+			Folder:    folder,
+			Timestamp: timestamp,
+		}
 
-				if err != nil {
-					log.Errorf("Failed to store file: %v", err)
-				}
+		var files []Attachment
+		subFolder := fmt.Sprintf("%s/%s/%s", fileFolder, folder, date)
 
-				log.Infof("Saved image in message to %s", path)
+		img := evt.Message.GetImageMessage()
+		if trackable && img != nil {
+			file, err := saveAttachment(img, subFolder, evt.Info.ID+mediaExtension(img.GetMimetype(), ".jpg"), dbTracker)
+			if err != nil {
+				log.Errorf("Failed to save image: %v", err)
+				return
 			}
+			text = img.GetCaption()
+			file.ID = attachmentID(evt.Info.ID, files)
+			file.Caption = text
+			file.Width, file.Height = img.GetWidth(), img.GetHeight()
+			files = append(files, file)
 
-			voice := evt.Message.GetAudioMessage()
+			log.Infof("Saved image in message to %s", file.Path)
+		}
 
-			if trackable && voice != nil {
-				data, err := cli.Download(voice)
-				if err != nil {
-					log.Errorf("Failed to download voice message: %v", err)
-					return
-				}
+		voice := evt.Message.GetAudioMessage()
+		if trackable && voice != nil {
+			file, err := saveAttachment(voice, subFolder, evt.Info.ID+".ogg", dbTracker)
+			if err != nil {
+				log.Errorf("Failed to save voice message: %v", err)
+				return
+			}
+			file.ID = attachmentID(evt.Info.ID, files)
+			file.Duration = voice.GetSeconds()
+			files = append(files, file)
 
-				subFolder := fmt.Sprintf("%s/%s/%s", fileFolder, folder, date)
-				path := fmt.Sprintf("%s/%s.ogg", subFolder, evt.Info.ID)
+			log.Infof("Saved voice message in message to %s", file.Path)
+		}
 
-				// Create sub folder if it doesn't exist
-				if _, err := os.Stat(subFolder); os.IsNotExist(err) {
-					err = os.MkdirAll(subFolder, 0755)
-					if err != nil {
-						log.Errorf("Failed to create subfolder: %v", err)
-						return
-					}
-				}
+		document := evt.Message.GetDocumentMessage()
+		if trackable && document != nil {
+			ext := filepath.Ext(document.GetFileName())
+			if ext == "" {
+				ext = mediaExtension(document.GetMimetype(), ".bin")
+			}
+			file, err := saveAttachment(document, subFolder, evt.Info.ID+ext, dbTracker)
+			if err != nil {
+				log.Errorf("Failed to save document: %v", err)
+				return
+			}
+			text = document.GetCaption()
+			file.ID = attachmentID(evt.Info.ID, files)
+			file.FileName = document.GetFileName()
+			file.Caption = text
+			files = append(files, file)
 
-				err = os.WriteFile(path, data, 0755)
-				if err != nil {
-					log.Errorf("Failed to save voice message: %v", err)
-					return
-				}
-				files = append(files, path)
+			log.Infof("Saved document in message to %s", file.Path)
+		}
+
+		// GIFs are sent as videos with the gif playback flag
+		video := evt.Message.GetVideoMessage()
+		if trackable && video != nil {
+			file, err := saveAttachment(video, subFolder, evt.Info.ID+mediaExtension(video.GetMimetype(), ".mp4"), dbTracker)
+			if err != nil {
+				log.Errorf("Failed to save video: %v", err)
+				return
+			}
+			text = video.GetCaption()
+			file.ID = attachmentID(evt.Info.ID, files)
+			file.Caption = text
+			file.Width, file.Height = video.GetWidth(), video.GetHeight()
+			file.Duration = video.GetSeconds()
+			files = append(files, file)
+
+			if video.GetGifPlayback() {
+				log.Infof("Saved GIF in message to %s", file.Path)
+			} else {
+				log.Infof("Saved video in message to %s", file.Path)
+			}
+		}
 
-				log.Infof("Saved voice message in message to %s", path)
+		sticker := evt.Message.GetStickerMessage()
+		if trackable && sticker != nil {
+			file, err := saveAttachment(sticker, subFolder, evt.Info.ID+mediaExtension(sticker.GetMimetype(), ".webp"), dbTracker)
+			if err != nil {
+				log.Errorf("Failed to save sticker: %v", err)
+				return
 			}
+			file.ID = attachmentID(evt.Info.ID, files)
+			file.Width, file.Height = sticker.GetWidth(), sticker.GetHeight()
+			files = append(files, file)
 
-			document := evt.Message.GetDocumentMessage()
-			if trackable && document != nil {
-				data, err := cli.Download(document)
-				if err != nil {
-					log.Errorf("Failed to download document: %v", err)
-					return
-				}
+			log.Infof("Saved sticker in message to %s", file.Path)
+		}
 
-				exts, _ := mime.ExtensionsByType(document.GetMimetype())
+		var location *Location
+		if loc := evt.Message.GetLocationMessage(); trackable && loc != nil {
+			location = &Location{
+				Latitude:  loc.GetDegreesLatitude(),
+				Longitude: loc.GetDegreesLongitude(),
+				Accuracy:  loc.GetAccuracyInMeters(),
+				Name:      loc.GetName(),
+				Address:   loc.GetAddress(),
+			}
+			text = loc.GetComment()
+			log.Infof("Received location %f,%f in message", location.Latitude, location.Longitude)
+		}
+		if loc := evt.Message.GetLiveLocationMessage(); trackable && loc != nil {
+			location = &Location{
+				Latitude:  loc.GetDegreesLatitude(),
+				Longitude: loc.GetDegreesLongitude(),
+				Accuracy:  loc.GetAccuracyInMeters(),
+				Live:      true,
+				Speed:     loc.GetSpeedInMps(),
+				Heading:   loc.GetDegreesClockwiseFromMagneticNorth(),
+				Sequence:  loc.GetSequenceNumber(),
+			}
+			text = loc.GetCaption()
+			log.Infof("Received live location %f,%f (sequence %d) in message", location.Latitude, location.Longitude, location.Sequence)
+		}
 
-				subFolder := fmt.Sprintf("%s/%s/%s", fileFolder, folder, date)
-				path := fmt.Sprintf("%s/%s%s", subFolder, evt.Info.ID, exts[0])
+		if trackable && (text != "" || len(files) > 0 || location != nil || poll != nil) {
+			log.Infof("Tracking message from %s in chat %s", sender, chat)
+			ProcessMessage(queue, processors.Get(), TrackableMessage{
+				Event:      EventMessageCreated,
+				MessageID:  evt.Info.ID,
+				Sender:     sender,
+				SenderName: directory.ContactName(sender),
+				Chat:       chat,
+				ChatName:   directory.ChatName(chat),
+				Content:    text,
+				Timestamp:  timestamp.String(),
+				Files:      files,
+				Location:   location,
+				Context:    getMessageContext(evt.Message),
+				Poll:       poll,
+				Metadata:   metadata,
+			}, webServer)
+			log.Infof("WebMessage text: %s", text)
+		} else {
+			log.Infof("Ignoring message from %s in chat %s", sender, chat)
+		}
 
-				// Create sub folder if it doesn't exist
-				if _, err := os.Stat(subFolder); os.IsNotExist(err) {
-					err = os.MkdirAll(subFolder, 0755)
-					if err != nil {
-						log.Errorf("Failed to create subfolder: %v", err)
-						return
-					}
-				}
+	}
+
+	history := CreateHistoryImporter(db, func(ctx context.Context, evt *events.HistorySync) {
+		importHistorySync(ctx, evt, handleMessage, queue, findDBTracker(queue.Router().Trackers()), configs.Get())
+	})
 
-				err = os.WriteFile(path, data, 0755)
+	handler := func(rawEvt interface{}) {
+		config := configs.Get()
+		switch evt := rawEvt.(type) {
+		case *events.AppStateSyncComplete:
+			if len(cli.Store.PushName) > 0 && evt.Name == appstate.WAPatchCriticalBlock {
+				err := cli.SendPresence(types.PresenceAvailable)
 				if err != nil {
-					log.Errorf("Failed to save document: %v", err)
-					return
+					log.Warnf("Failed to send available presence: %v", err)
+				} else {
+					log.Infof("Marked self as available")
 				}
-				files = append(files, path)
-
-				log.Infof("Saved document in message to %s", path)
 			}
-
-			if trackable && (text != "" || len(files) > 0) {
-				log.Infof("Tracking message from %s in chat %s", sender, chat)
-				ProcessMessage(trackers, evt.Info.ID, sender, chat, text, timestamp.String(), files, metadata, server)
-				log.Infof("WebMessage text: %s", text)
+		case *events.Connected, *events.PushNameSetting:
+			if _, ok := evt.(*events.Connected); ok {
+				trackConnectionState(ConnectionState{State: ConnectionConnected}, queue, server)
+				go func() {
+					err := directory.Refresh(cli)
+					if err != nil {
+						log.Errorf("Failed to refresh directory: %v", err)
+					}
+				}()
+			}
+			if len(cli.Store.PushName) == 0 {
+				return
+			}
+			// Send presence available when connecting and when the pushname is changed.
+			// This makes sure that outgoing messages always have the right pushname.
+			err := cli.SendPresence(types.PresenceAvailable)
+			if err != nil {
+				log.Warnf("Failed to send available presence: %v", err)
 			} else {
-				log.Infof("Ignoring message from %s in chat %s", sender, chat)
+				log.Infof("Marked self as available")
 			}
-
+		case *events.Disconnected:
+			trackConnectionState(ConnectionState{State: ConnectionDisconnected}, queue, server)
+		case *events.LoggedOut:
+			state := ConnectionState{State: ConnectionLoggedOut}
+			if evt.OnConnect {
+				state.Reason = evt.Reason.String()
+			}
+			trackConnectionState(state, queue, server)
+		case *events.StreamReplaced:
+			trackConnectionState(ConnectionState{State: ConnectionStreamReplaced}, queue, server)
+			os.Exit(0)
+		case *events.Message:
+			handleMessage(evt, true)
 		case *events.Receipt:
 			if evt.Type == types.ReceiptTypeRead || evt.Type == types.ReceiptTypeReadSelf {
 				log.Infof("%v was read by %s at %s", evt.MessageIDs, evt.SourceString(), evt.Timestamp)
@@ -249,34 +303,179 @@ func CreateHandler(fileFolder string, trackers []Tracker, config *Config, server
 			} else {
 				log.Infof("%s is now online", evt.From)
 			}
+		case *events.PushName:
+			directory.SavePushName(evt.JID, evt.NewPushName)
+		case *events.Contact:
+			info, err := cli.Store.Contacts.GetContact(evt.JID)
+			if err != nil {
+				log.Errorf("Failed to get contact %s: %v", evt.JID, err)
+				return
+			}
+			err = directory.SaveContact(Contact{JID: evt.JID.ToNonAD().String(), PushName: info.PushName, FullName: info.FullName,
+				FirstName: info.FirstName, BusinessName: info.BusinessName})
+			if err != nil {
+				log.Errorf("Failed to save contact %s: %v", evt.JID, err)
+			}
+		case *events.GroupInfo:
+			err := directory.ApplyGroupChange(evt)
+			if err != nil {
+				log.Errorf("Failed to save changes of group %s: %v", evt.JID, err)
+			}
+			if config.IsChatTrackable(evt.JID.String()) {
+				trackGroupInfo(evt, queue, directory, server)
+			}
+		case *events.JoinedGroup:
+			err := directory.SaveGroup(&evt.GroupInfo)
+			if err != nil {
+				log.Errorf("Failed to save group %s: %v", evt.JID, err)
+			}
+			if config.IsChatTrackable(evt.JID.String()) && cli.Store.ID != nil {
+				reason := evt.Reason
+				if reason == "" {
+					reason = evt.Type
+				}
+				change := GroupChange{Type: GroupChangeJoin, Participants: []string{cli.Store.ID.ToNonAD().String()}, Reason: reason}
+				trackGroupChange(evt.JID, types.EmptyJID, time.Time{}, evt.ParticipantVersionID, change, queue, directory, server)
+			}
+		case *events.Picture:
+			if evt.JID.Server == types.GroupServer && config.IsChatTrackable(evt.JID.String()) {
+				trackGroupChange(evt.JID, evt.Author, evt.Timestamp, "", GroupChange{Type: GroupChangePicture, Value: evt.PictureID},
+					queue, directory, server)
+			}
 		case *events.HistorySync:
-			log.Infof("Skip history sync event: %+v", evt)
-			//id := atomic.AddInt32(&historySyncID, 1)
-			//fileName := fmt.Sprintf("history-%d-%d.json", startupTime, id)
-			//file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE, 0600)
-			//if err != nil {
-			//	log.Errorf("Failed to open file to write history sync: %v", err)
-			//	return
-			//}
-			//enc := json.NewEncoder(file)
-			//enc.SetIndent("", "  ")
-			//err = enc.Encode(evt.Data)
-			//if err != nil {
-			//	log.Errorf("Failed to write history sync: %v", err)
-			//	return
-			//}
-			//log.Infof("Wrote history sync to %s", fileName)
-			//_ = file.Close()
+			saveHistorySyncNames(evt, directory)
+			if !*importHistory {
+				log.Infof("Skip history sync event: %s", evt.Data.GetSyncType())
+				return
+			}
+			history.Add(evt)
 		case *events.AppState:
 			log.Debugf("App state event: %+v / %+v", evt.Index, evt.SyncActionValue)
 		case *events.KeepAliveTimeout:
 			log.Debugf("Keepalive timeout event: %+v", evt)
+			// Timeouts repeat until the connection is restored, only the first one is tracked
+			if evt.ErrorCount == 1 {
+				trackConnectionState(ConnectionState{State: ConnectionKeepAliveTimeout}, queue, server)
+			}
 		case *events.KeepAliveRestored:
 			log.Debugf("Keepalive restored")
+			trackConnectionState(ConnectionState{State: ConnectionKeepAliveRestored}, queue, server)
 		case *events.Blocklist:
 			log.Infof("Blocklist event: %+v", evt)
 		}
 	}
 
-	return handler
+	return handler, history
+}
+
+// saveHistorySyncNames stores push names and conversation names from the history sync
+func saveHistorySyncNames(evt *events.HistorySync, directory *Directory) {
+	for _, pushname := range evt.Data.GetPushnames() {
+		jid, err := types.ParseJID(pushname.GetID())
+		if err != nil {
+			continue
+		}
+		directory.SavePushName(jid, pushname.GetPushname())
+	}
+	for _, conv := range evt.Data.GetConversations() {
+		jid, err := types.ParseJID(conv.GetID())
+		if err != nil || conv.GetName() == "" {
+			continue
+		}
+		err = directory.SaveChat(ChatInfo{JID: jid.String(), Name: conv.GetName(), IsGroup: jid.Server == types.GroupServer})
+		if err != nil {
+			log.Errorf("Failed to save chat %s: %v", jid, err)
+		}
+	}
+}
+
+// trackMessageChange passes edits and revocations of earlier messages to trackers
+func trackMessageChange(evt *events.Message, protocol *waProto.ProtocolMessage, queue *TrackerQueue, dbTracker *DBTracker, config *Config) {
+	var event string
+	switch protocol.GetType() {
+	case waProto.ProtocolMessage_MESSAGE_EDIT:
+		event = EventMessageEdited
+	case waProto.ProtocolMessage_REVOKE:
+		event = EventMessageRevoked
+	default:
+		log.Debugf("Ignoring protocol message %s of type %s", evt.Info.ID, protocol.GetType())
+		return
+	}
+	messageID := protocol.GetKey().GetID()
+
+	// Trackers need the original message to find where it was stored
+	original, err := dbTracker.GetMessage(messageID)
+	if err != nil {
+		log.Errorf("Failed to get message %s: %v", messageID, err)
+		return
+	}
+	var message TrackableMessage
+	if original != nil {
+		original.Poll, err = dbTracker.GetPoll(messageID)
+		if err != nil {
+			log.Errorf("Failed to get poll %s: %v", messageID, err)
+			return
+		}
+		message = *original
+		message.Original = original
+	} else {
+		log.Warnf("Message %s is not stored yet, using the time of the change", messageID)
+		chat := evt.Info.Chat.String()
+		message = TrackableMessage{
+			MessageID: messageID,
+			Sender:    evt.Info.Sender.String(),
+			Chat:      chat,
+			Timestamp: evt.Info.Timestamp.String(),
+			Metadata: MessageMetadata{
+				Date:      evt.Info.Timestamp.Format("02.01.2006"),
+				Folder:    config.GetChatFolder(chat),
+				Timestamp: evt.Info.Timestamp,
+			},
+		}
+	}
+	message.Event = event
+	message.EventTimestamp = evt.Info.Timestamp.String()
+	if event == EventMessageEdited {
+		message.Content = messageText(protocol.GetEditedMessage())
+	}
+
+	log.Infof("Tracking %s of message %s in chat %s", event, messageID, message.Chat)
+	err = queue.Enqueue(&message)
+	if err != nil {
+		log.Errorf("Failed to enqueue %s of message %s: %v", event, messageID, err)
+	}
+}
+
+// messageText returns the text or the caption of the message
+func messageText(msg *waProto.Message) string {
+	switch {
+	case msg.GetConversation() != "":
+		return msg.GetConversation()
+	case msg.GetExtendedTextMessage() != nil:
+		return msg.GetExtendedTextMessage().GetText()
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage().GetCaption()
+	case msg.GetVideoMessage() != nil:
+		return msg.GetVideoMessage().GetCaption()
+	case msg.GetDocumentMessage() != nil:
+		return msg.GetDocumentMessage().GetCaption()
+	}
+	return ""
+}
+
+// mediaExtension returns the file extension for the mimetype, preferring the fallback if it matches
+func mediaExtension(mimetype string, fallback string) string {
+	exts, _ := mime.ExtensionsByType(mimetype)
+	if len(exts) == 0 {
+		return fallback
+	}
+	for _, ext := range exts {
+		if ext == fallback {
+			return ext
+		}
+	}
+	if exts[0] == ".jpe" {
+		return ".jpg"
+	}
+	return exts[0]
 }
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// historyProgressInterval is how often the progress of a history sync import is logged
+const historyProgressInterval = 10 * time.Second
+
+// HistoryImporter imports history syncs one by one in the background, so the event handler
+// keeps handling live events while a large history is downloaded and tracked.
+// History syncs are stored in history_syncs until they are imported, WhatsApp doesn't send them again.
+type HistoryImporter struct {
+	db         *DB
+	importSync func(ctx context.Context, evt *events.HistorySync)
+	mu         sync.Mutex
+	pending    []historyJob
+	started    bool
+	notify     chan struct{}
+	ctx        context.Context
+	cancel     context.CancelFunc
+	done       chan struct{}
+}
+
+// historyJob is a history sync waiting for the import. id is zero if it couldn't be stored,
+// evt is nil until a history sync stored by an earlier run is loaded.
+type historyJob struct {
+	id  int64
+	evt *events.HistorySync
+}
+
+// CreateHistoryImporter returns the importer that passes queued history syncs to importSync once it's started
+func CreateHistoryImporter(db *DB, importSync func(ctx context.Context, evt *events.HistorySync)) *HistoryImporter {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &HistoryImporter{
+		db:         db,
+		importSync: importSync,
+		notify:     make(chan struct{}, 1),
+		ctx:        ctx,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+}
+
+// Start runs the worker, history syncs left by the previous run are imported first
+func (h *HistoryImporter) Start() error {
+	rows, err := h.db.Query(`SELECT id FROM history_syncs ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// Syncs added before the start are stored as well
+	added := make(map[int64]*events.HistorySync)
+	var unstored []historyJob
+	for _, job := range h.pending {
+		if job.id == 0 {
+			unstored = append(unstored, job)
+		} else {
+			added[job.id] = job.evt
+		}
+	}
+	h.pending = nil
+	left := 0
+	for _, id := range ids {
+		if _, ok := added[id]; !ok {
+			left++
+		}
+		h.pending = append(h.pending, historyJob{id: id, evt: added[id]})
+	}
+	h.pending = append(h.pending, unstored...)
+	if left > 0 {
+		log.Infof("Resuming import of %d history syncs left by the previous run", left)
+	}
+	h.started = true
+	go h.work()
+	return nil
+}
+
+// Add stores the history sync for the import and returns without waiting for it
+func (h *HistoryImporter) Add(evt *events.HistorySync) {
+	id, err := h.store(evt)
+	if err != nil {
+		log.Errorf("Failed to store history sync %s, it's lost if whatsgo stops before it's imported: %v", evt.Data.GetSyncType(), err)
+	}
+	h.mu.Lock()
+	h.pending = append(h.pending, historyJob{id: id, evt: evt})
+	pending := len(h.pending)
+	h.mu.Unlock()
+	log.Infof("Queued history sync %s for import, %d waiting", evt.Data.GetSyncType(), pending)
+	select {
+	case h.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (h *HistoryImporter) store(evt *events.HistorySync) (int64, error) {
+	data, err := proto.Marshal(evt.Data)
+	if err != nil {
+		return 0, err
+	}
+	data, err = encryptor.EncryptBytes(data)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	err = h.db.QueryRow(`INSERT INTO history_syncs (sync_type, data, created_at) VALUES (?, ?, ?) RETURNING id`,
+		evt.Data.GetSyncType().String(), data, time.Now().Unix()).Scan(&id)
+	return id, err
+}
+
+func (h *HistoryImporter) load(id int64) (*events.HistorySync, error) {
+	var data []byte
+	err := h.db.QueryRow(`SELECT data FROM history_syncs WHERE id = ?`, id).Scan(&data)
+	if err != nil {
+		return nil, err
+	}
+	data, err = encryptor.DecryptBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	var historySync waProto.HistorySync
+	err = proto.Unmarshal(data, &historySync)
+	if err != nil {
+		return nil, err
+	}
+	return &events.HistorySync{Data: &historySync}, nil
+}
+
+func (h *HistoryImporter) work() {
+	defer close(h.done)
+	for {
+		h.mu.Lock()
+		var job historyJob
+		found := len(h.pending) > 0
+		if found {
+			job = h.pending[0]
+			h.pending = h.pending[1:]
+		}
+		h.mu.Unlock()
+
+		if !found {
+			select {
+			case <-h.ctx.Done():
+				return
+			case <-h.notify:
+			}
+			continue
+		}
+
+		evt := job.evt
+		if evt == nil {
+			var err error
+			evt, err = h.load(job.id)
+			if err != nil {
+				// The stored sync is kept, e.g. for a restart with the encryption key
+				log.Errorf("Failed to load stored history sync %d: %v", job.id, err)
+				continue
+			}
+		}
+		h.importSync(h.ctx, evt)
+		if h.ctx.Err() != nil {
+			return
+		}
+		if job.id != 0 {
+			if _, err := h.db.Exec(`DELETE FROM history_syncs WHERE id = ?`, job.id); err != nil {
+				log.Errorf("Failed to delete imported history sync %d: %v", job.id, err)
+			}
+		}
+	}
+}
+
+// Stop interrupts the running import. Stored history syncs that aren't imported completely, including
+// the interrupted one, are imported on the next start, where the messages handled by now are skipped.
+func (h *HistoryImporter) Stop() {
+	h.cancel()
+	h.mu.Lock()
+	started := h.started
+	h.mu.Unlock()
+	if started {
+		<-h.done
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	unstored := 0
+	for _, job := range h.pending {
+		if job.id == 0 {
+			unstored++
+		}
+	}
+	if unstored > 0 {
+		log.Warnf("Dropped %d history syncs that couldn't be stored and weren't imported", unstored)
+	}
+	h.pending = nil
+}
+
+// importHistorySync passes messages of tracked chats from the history sync to the message handler
+func importHistorySync(ctx context.Context, evt *events.HistorySync, handleMessage func(*events.Message, bool), queue *TrackerQueue, dbTracker *DBTracker, config *Config) {
+	syncType := evt.Data.GetSyncType()
+	conversations := evt.Data.GetConversations()
+	log.Infof("Importing history sync %s with %d conversations", syncType, len(conversations))
+	imported, skipped := 0, 0
+	lastProgress := time.Now()
+	for i, conv := range conversations {
+		chatJID, err := types.ParseJID(conv.GetID())
+		if err != nil {
+			log.Errorf("Failed to parse chat JID %s of history sync: %v", conv.GetID(), err)
+			continue
+		}
+		if !config.IsChatTrackable(chatJID.String()) {
+			continue
+		}
+
+		for _, historyMsg := range conv.GetMessages() {
+			if ctx.Err() != nil {
+				log.Warnf("History sync %s interrupted after %d of %d conversations: %d messages handled, %d already stored",
+					syncType, i, len(conversations), imported, skipped)
+				return
+			}
+			if time.Since(lastProgress) >= historyProgressInterval {
+				log.Infof("History sync %s: %d of %d conversations, %d messages handled, %d already stored",
+					syncType, i, len(conversations), imported, skipped)
+				lastProgress = time.Now()
+			}
+
+			msgEvt, err := cli.ParseWebMessage(chatJID, historyMsg.GetMessage())
+			if err != nil {
+				log.Errorf("Failed to parse message of history sync: %v", err)
+				continue
+			}
+
+			// Messages may be already stored or queued by a previous sync or as live messages
+			stored, err := dbTracker.HasMessage(msgEvt.Info.ID)
+			if err == nil && !stored {
+				stored, err = queue.HasMessage(msgEvt.Info.ID)
+			}
+			if err != nil {
+				log.Errorf("Failed to check if message %s is stored: %v", msgEvt.Info.ID, err)
+				continue
+			}
+			if stored {
+				skipped++
+				continue
+			}
+
+			handleMessage(msgEvt, false)
+			imported++
+		}
+	}
+	log.Infof("History sync %s imported: %d messages handled, %d already stored", syncType, imported, skipped)
+}
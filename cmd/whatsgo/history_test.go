@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+func TestHistoryImporter(t *testing.T) {
+	db := newTestDB(t)
+	started := make(chan waProto.HistorySync_HistorySyncType)
+	release := make(chan struct{})
+	interrupted := make(chan struct{})
+	history := CreateHistoryImporter(db, func(ctx context.Context, evt *events.HistorySync) {
+		started <- evt.Data.GetSyncType()
+		select {
+		case <-release:
+		case <-ctx.Done():
+			close(interrupted)
+		}
+	})
+	if err := history.Start(); err != nil {
+		t.Fatal(err)
+	}
+	syncTypes := []waProto.HistorySync_HistorySyncType{
+		waProto.HistorySync_INITIAL_BOOTSTRAP,
+		waProto.HistorySync_RECENT,
+		waProto.HistorySync_PUSH_NAME,
+	}
+
+	// Add doesn't wait for the running import
+	added := make(chan struct{})
+	go func() {
+		for _, syncType := range syncTypes {
+			history.Add(&events.HistorySync{Data: &waProto.HistorySync{SyncType: syncType.Enum()}})
+		}
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("Add() blocked while a history sync is imported")
+	}
+
+	for i, want := range syncTypes[:2] {
+		if got := <-started; got != want {
+			t.Errorf("import %d got %s, want %s", i, got, want)
+		}
+		if i == 0 {
+			release <- struct{}{}
+		}
+	}
+
+	// Stop interrupts the running import and keeps it and the queued one for the next start
+	history.Stop()
+	select {
+	case <-interrupted:
+	default:
+		t.Error("Stop() returned before the running import was interrupted")
+	}
+	select {
+	case got := <-started:
+		t.Errorf("history sync %s imported after Stop()", got)
+	default:
+	}
+	if got := countRows(t, db, `SELECT count(*) FROM history_syncs`); got != 2 {
+		t.Errorf("stored history syncs = %d, want the interrupted and the queued one", got)
+	}
+
+	imported := make(chan waProto.HistorySync_HistorySyncType, len(syncTypes))
+	history = CreateHistoryImporter(db, func(ctx context.Context, evt *events.HistorySync) {
+		imported <- evt.Data.GetSyncType()
+	})
+	if err := history.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range syncTypes[1:] {
+		select {
+		case got := <-imported:
+			if got != want {
+				t.Errorf("resumed import %d got %s, want %s", i, got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("history sync %s isn't imported after the restart", want)
+		}
+	}
+	history.Stop()
+	if got := countRows(t, db, `SELECT count(*) FROM history_syncs`); got != 0 {
+		t.Errorf("%d history syncs are left after the import", got)
+	}
+}
+
+func TestHistoryImporterStopBeforeStart(t *testing.T) {
+	db := newTestDB(t)
+	history := CreateHistoryImporter(db, func(ctx context.Context, evt *events.HistorySync) {
+		t.Error("history sync imported without Start()")
+	})
+	history.Add(&events.HistorySync{Data: &waProto.HistorySync{SyncType: waProto.HistorySync_RECENT.Enum()}})
+	history.Stop()
+	if got := countRows(t, db, `SELECT count(*) FROM history_syncs`); got != 1 {
+		t.Errorf("stored history syncs = %d, want 1", got)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/mdp/qrterminal/v3"
 	"go.mau.fi/whatsmeow"
@@ -42,6 +43,8 @@ var serverless = flag.Bool("serverless", false, "Skip server initialization")
 var configPath = flag.String("config", "config.yaml", "Path to config file")
 var detached = flag.Bool("detached", false, "Run in detached mode?")
 var requestFullSync = flag.Bool("request-full-sync", false, "Request full (1 year) history sync when logging in?")
+var importHistory = flag.Bool("import-history", false, "Import messages of tracked chats from history sync?")
+var watchConfig = flag.Duration("watch-config", 5*time.Second, "How often to check the config file for changes, 0 disables it")
 var pairRejectChan = make(chan bool, 1)
 
 func main() {
@@ -52,10 +55,29 @@ func main() {
 	log = waLog.Stdout("Main", logLevel, true)
 
 	config, err := LoadConfig(*configPath)
+	if flag.Arg(0) == "config" {
+		err = runConfigCommand(config, err, flag.Arg(1))
+		if err != nil {
+			log.Errorf("%v", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if errors.Is(err, os.ErrNotExist) && !isFlagSet("config") {
+		log.Warnf("Configuration file %s not found, using default configuration", *configPath)
+		config, err = LoadDefaultConfig()
+	}
 	if err != nil {
-		log.Infof("Failed to load configuration: %v", err)
-		log.Infof("Using default configuration")
-		config = GetDefaultConfig()
+		log.Errorf("Failed to load configuration: %v", err)
+		os.Exit(1)
+	}
+	if flag.Arg(0) == "webhook" {
+		err = runWebhookCommand(config, flag.Args()[1:])
+		if err != nil {
+			log.Errorf("Failed to run webhook command: %v", err)
+			os.Exit(1)
+		}
+		return
 	}
 
 	var fileFolder = &config.FileStoragePath
@@ -75,13 +97,69 @@ func main() {
 	dbLog := waLog.Stdout("Database", logLevel, true)
 	storeContainer, err := sqlstore.New(*dbDialect, *dbAddress, dbLog)
 
-	var db *sql.DB
-	db, err = sql.Open(*dbDialect, *dbAddress)
+	sqlDB, err := sql.Open(*dbDialect, *dbAddress)
+	if err != nil {
+		log.Errorf("Failed to open database: %v", err)
+		return
+	}
+	db, err := NewDB(sqlDB, *dbDialect)
 	if err != nil {
 		log.Errorf("Failed to open database: %v", err)
 		return
 	}
 
+	if flag.Arg(0) == "migrate" {
+		err = runMigrateCommand(db, flag.Arg(1))
+		if err != nil {
+			log.Errorf("Failed to migrate database: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+	_, err = Migrate(db)
+	if err != nil {
+		log.Errorf("Failed to migrate database: %v", err)
+		return
+	}
+
+	if flag.Arg(0) == "encryption" {
+		err = runEncryptionCommand(db, config, flag.Args()[1:])
+		if err != nil {
+			log.Errorf("Failed to run encryption command: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if config.Encryption.Enabled {
+		encryptor, err = LoadEncryptor(db, config.Encryption)
+		if err != nil {
+			log.Errorf("Failed to load encryption keys: %v", err)
+			return
+		}
+	}
+
+	if flag.Arg(0) == "retention" {
+		var csvTracker *CSVTracker
+		if config.CSV.Enabled {
+			csvTracker = &CSVTracker{}
+			csvTracker.Init(config)
+		}
+		var cloudTracker *CloudTracker
+		if config.GoogleCloud.Enabled {
+			cloudTracker = &CloudTracker{}
+			if err = cloudTracker.Init(config); err != nil {
+				log.Errorf("Failed to connect to Google Cloud: %v", err)
+				os.Exit(1)
+			}
+		}
+		err = runRetentionCommand(CreateRetention(db, config, csvTracker, cloudTracker), flag.Arg(1))
+		if err != nil {
+			log.Errorf("Failed to enforce retention: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if err != nil {
 		log.Errorf("Failed to connect to database: %v", err)
 		return
@@ -92,16 +170,43 @@ func main() {
 		return
 	}
 
-	var server = CreateServer(config, db)
+	configs := CreateConfigHolder(*configPath, config)
+	var server = CreateServer(configs, db)
 	if !*serverless {
 		go RunServer(server)
 	}
-	var trackers = CreateTrackers(config, db)
-	var handler = CreateHandler(*fileFolder, trackers, config, server)
+	var router = CreateTrackers(config, db)
+	queue, err := CreateTrackerQueue(config, db, router)
+	if err != nil {
+		log.Errorf("Failed to create tracker queue: %v", err)
+		return
+	}
+	queue.Start()
+
+	retention := CreateRetention(db, config, findCSVTracker(router.Trackers()), findCloudTracker(router.Trackers()))
+	if config.Retention.Enabled {
+		retention.Start(config.Retention.Interval)
+	}
+
+	directory, err := CreateDirectory(db)
+	if err != nil {
+		log.Errorf("Failed to load directory: %v", err)
+		return
+	}
+	config.UseChatNames(directory.ChatName)
 
-	// find trackers
-	dbTracker := findDBTracker(trackers)
-	cloudTracker := findCloudTracker(trackers)
+	var processors = CreateProcessorSet(config)
+	handler, history := CreateHandler(*fileFolder, db, queue, processors, directory, configs, server)
+
+	configs.OnReload(func(old *Config, config *Config) {
+		router := ReloadTrackers(queue.Router(), config, db)
+		queue.SetRouter(router)
+		processors.Reload(old, config)
+		retention.Reload(config, findCSVTracker(router.Trackers()), findCloudTracker(router.Trackers()))
+	})
+	if *watchConfig > 0 {
+		configs.Watch(*watchConfig)
+	}
 
 	var isWaitingForPair atomic.Bool
 	if !*clientless {
@@ -146,11 +251,18 @@ func main() {
 			log.Errorf("Failed to connect: %v", err)
 			return
 		}
+		directory.Start(cli, config.Directory.RefreshInterval)
+		err = history.Start()
+		if err != nil {
+			log.Errorf("Failed to start history import: %v", err)
+		}
 	}
 
 	c := make(chan os.Signal, 1)
 	input := make(chan string)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
 		defer close(input)
 		scan := bufio.NewScanner(os.Stdin)
@@ -163,11 +275,22 @@ func main() {
 	}()
 	for {
 		select {
+		case <-hup:
+			log.Infof("SIGHUP received, reloading configuration")
+			err := configs.Reload()
+			if err != nil {
+				log.Errorf("Failed to reload configuration, keeping the current one: %v", err)
+			}
 		case <-c:
 			log.Infof("Interrupt received, exiting")
 			if cli != nil && !*clientless {
 				cli.Disconnect()
 			}
+			configs.Stop()
+			directory.Stop()
+			history.Stop()
+			retention.Stop()
+			queue.Stop()
 			return
 		case cmd := <-input:
 			if len(cmd) == 0 {
@@ -178,6 +301,11 @@ func main() {
 				if cli != nil && !*clientless {
 					cli.Disconnect()
 				}
+				configs.Stop()
+				directory.Stop()
+				history.Stop()
+				retention.Stop()
+				queue.Stop()
 				return
 			}
 			if isWaitingForPair.Load() {
@@ -191,11 +319,22 @@ func main() {
 			args := strings.Fields(cmd)
 			cmd = args[0]
 			args = args[1:]
-			go handleCmd(strings.ToLower(cmd), args, dbTracker, cloudTracker)
+			go handleCmd(strings.ToLower(cmd), args, queue, directory, configs)
 		}
 	}
 }
 
+// isFlagSet reports whether the flag was given on the command line
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 func findDBTracker(trackers []Tracker) *DBTracker {
 	for _, tracker := range trackers {
 		if dbTracker, ok := tracker.(*DBTracker); ok {
@@ -205,6 +344,15 @@ func findDBTracker(trackers []Tracker) *DBTracker {
 	return nil
 }
 
+func findCSVTracker(trackers []Tracker) *CSVTracker {
+	for _, tracker := range trackers {
+		if csvTracker, ok := tracker.(*CSVTracker); ok {
+			return csvTracker
+		}
+	}
+	return nil
+}
+
 func findCloudTracker(trackers []Tracker) *CloudTracker {
 	for _, tracker := range trackers {
 		if cloudTracker, ok := tracker.(*CloudTracker); ok {
@@ -233,8 +381,43 @@ func parseJID(arg string) (types.JID, bool) {
 	}
 }
 
-func handleCmd(cmd string, args []string, dbTracker *DBTracker, cloudTracker *CloudTracker) {
+func handleCmd(cmd string, args []string, queue *TrackerQueue, directory *Directory, configs *ConfigHolder) {
+	// Trackers are looked up for each command, so they follow reloads of the config
+	dbTracker := findDBTracker(queue.Router().Trackers())
 	switch cmd {
+	case "reload-config":
+		err := configs.Reload()
+		if err != nil {
+			log.Errorf("Failed to reload configuration, keeping the current one: %v", err)
+		}
+	case "queue-status":
+		stats, err := queue.Stats()
+		if err != nil {
+			log.Errorf("Failed to get queue status: %v", err)
+			return
+		}
+		if len(stats) == 0 {
+			log.Infof("Tracker queue is empty")
+		}
+		for _, stat := range stats {
+			log.Infof("Tracker %s: %d %s", stat.Tracker, stat.Count, stat.Status)
+		}
+	case "queue-retry":
+		if len(args) < 1 {
+			log.Errorf("Usage: queue-retry <tracker>")
+			return
+		}
+		count, err := queue.RetryDead(args[0])
+		if err != nil {
+			log.Errorf("Failed to retry dead messages: %v", err)
+			return
+		}
+		log.Infof("Moved %d dead messages of tracker %s back to the queue", count, args[0])
+	case "refresh-directory":
+		err := directory.Refresh(cli)
+		if err != nil {
+			log.Errorf("Failed to refresh directory: %v", err)
+		}
 	case "get-db-chats":
 		chats, err := dbTracker.GetChats()
 		if err != nil {
@@ -278,6 +461,11 @@ func handleCmd(cmd string, args []string, dbTracker *DBTracker, cloudTracker *Cl
 		if !ok {
 			return
 		}
+		cloudTracker := findCloudTracker(queue.Router().Trackers())
+		if cloudTracker == nil {
+			log.Errorf("Google Cloud tracker is disabled")
+			return
+		}
 		log.Infof("Processing chat %s", recipient)
 
 		messages, err := dbTracker.GetMessagesByChat(recipient.String(), date)
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+func TestMain(m *testing.M) {
+	log = waLog.Stdout("Test", "WARN", false)
+	os.Exit(m.Run())
+}
+
+// newTestDB returns a migrated SQLite database in a temporary directory
+func newTestDB(t *testing.T) *DB {
+	sqlDB, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "whatsgo.db")+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	db, err := NewDB(sqlDB, "sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Migrate(db); err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	return db
+}
+
+func mustExec(t *testing.T, db *DB, query string, args ...interface{}) {
+	t.Helper()
+	if _, err := db.Exec(query, args...); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+}
+
+func countRows(t *testing.T, db *DB, query string, args ...interface{}) int {
+	t.Helper()
+	var count int
+	if err := db.QueryRow(query, args...).Scan(&count); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return count
+}
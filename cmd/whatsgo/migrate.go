@@ -0,0 +1,308 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Migrations are numbered SQL files `NNNN_name.sql` that are applied in order.
+// A file named `NNNN_name.<dialect>.sql` replaces the generic one for that dialect.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationHooks run in the same transaction right after the SQL of the migration
+var migrationHooks = map[int]func(tx *Tx) error{
+	1: upgradeLegacySchema,
+	2: backfillMessageTimestamps,
+}
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+?)(?:\.(\w+))?\.sql$`)
+
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// MigrationStatus is a known migration and the time it was applied, if it was
+type MigrationStatus struct {
+	Migration
+	AppliedAt string
+}
+
+// LoadMigrations returns migrations of the dialect sorted by version
+func LoadMigrations(dialect Dialect) ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make(map[int]Migration)
+	specific := make(map[int]bool)
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name: %s", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		fileDialect := match[3]
+		if fileDialect != "" && fileDialect != dialect.Name() {
+			continue
+		}
+		if _, ok := migrations[version]; ok {
+			// The dialect specific file takes precedence over the generic one
+			if specific[version] == (fileDialect != "") {
+				return nil, fmt.Errorf("duplicate migration version %d", version)
+			}
+			if specific[version] {
+				continue
+			}
+		}
+
+		content, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		query, err := renderMigration(entry.Name(), string(content), dialect)
+		if err != nil {
+			return nil, err
+		}
+		migrations[version] = Migration{Version: version, Name: match[2], SQL: query}
+		specific[version] = fileDialect != ""
+	}
+
+	var sorted []Migration
+	for _, migration := range migrations {
+		sorted = append(sorted, migration)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+	return sorted, nil
+}
+
+// renderMigration fills in the parts of the SQL that differ between dialects
+func renderMigration(name string, content string, dialect Dialect) (string, error) {
+	tmpl, err := template.New(name).Funcs(template.FuncMap{
+		"autoincrement": dialect.AutoIncrementPrimaryKey,
+	}).Parse(content)
+	if err != nil {
+		return "", err
+	}
+	var builder strings.Builder
+	err = tmpl.Execute(&builder, nil)
+	return builder.String(), err
+}
+
+func ensureMigrationsTable(db *DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT,
+			applied_at TEXT
+		)
+	`)
+	return err
+}
+
+// GetMigrationStatus returns all known migrations and the versions that were applied
+// by a newer binary and are unknown to this one
+func GetMigrationStatus(db *DB) ([]MigrationStatus, []int, error) {
+	err := ensureMigrationsTable(db)
+	if err != nil {
+		return nil, nil, err
+	}
+	migrations, err := LoadMigrations(db.Dialect)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows, err := db.Query(`SELECT version, applied_at FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]string)
+	for rows.Next() {
+		var version int
+		var appliedAt string
+		err = rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, nil, err
+		}
+		applied[version] = appliedAt
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var statuses []MigrationStatus
+	for _, migration := range migrations {
+		statuses = append(statuses, MigrationStatus{Migration: migration, AppliedAt: applied[migration.Version]})
+		delete(applied, migration.Version)
+	}
+	var unknown []int
+	for version := range applied {
+		unknown = append(unknown, version)
+	}
+	sort.Ints(unknown)
+	return statuses, unknown, nil
+}
+
+// Migrate applies pending migrations and syncs the search index. It refuses to touch a database
+// that has migrations this binary doesn't know about.
+func Migrate(db *DB) (int, error) {
+	statuses, unknown, err := GetMigrationStatus(db)
+	if err != nil {
+		return 0, err
+	}
+	if len(unknown) > 0 {
+		return 0, fmt.Errorf("database schema version %d is newer than this binary supports, please upgrade whatsgo", unknown[len(unknown)-1])
+	}
+
+	applied := 0
+	for _, status := range statuses {
+		if status.AppliedAt != "" {
+			continue
+		}
+		err = applyMigration(db, status.Migration)
+		if err != nil {
+			return applied, fmt.Errorf("failed to apply migration %04d_%s: %w", status.Version, status.Name, err)
+		}
+		log.Infof("Applied migration %04d_%s", status.Version, status.Name)
+		applied++
+	}
+	return applied, syncSearchIndex(db)
+}
+
+func applyMigration(db *DB, migration Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(migration.SQL)
+	if err != nil {
+		return err
+	}
+	if hook, ok := migrationHooks[migration.Version]; ok {
+		err = hook(tx)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+		migration.Version, migration.Name, time.Now().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// upgradeLegacySchema adds the columns that databases created before migrations may lack
+func upgradeLegacySchema(tx *Tx) error {
+	columns := []struct {
+		name       string
+		definition string
+	}{
+		{"parsed_content", "TEXT DEFAULT ''"},
+		{"latitude", "REAL"},
+		{"longitude", "REAL"},
+		{"location_accuracy", "INTEGER"},
+		{"location_name", "TEXT"},
+		{"location_address", "TEXT"},
+		{"live_location", "BOOLEAN"},
+		{"edited_at", "TEXT"},
+		{"deleted_at", "TEXT"},
+		{"quoted_message_id", "TEXT"},
+		{"quoted_sender", "TEXT"},
+		{"forwarded", "BOOLEAN DEFAULT FALSE"},
+		{"forwarding_score", "INTEGER DEFAULT 0"},
+	}
+	for _, column := range columns {
+		err := tx.EnsureColumn("messages", column.name, column.definition)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.Exec(`CREATE INDEX IF NOT EXISTS messages_quoted_message_id ON messages (quoted_message_id)`)
+	return err
+}
+
+// backfillMessageTimestamps fills the ts column from the text timestamp of messages
+func backfillMessageTimestamps(tx *Tx) error {
+	rows, err := tx.Query(`SELECT id, timestamp FROM messages WHERE ts IS NULL`)
+	if err != nil {
+		return err
+	}
+	timestamps := make(map[string]int64)
+	for rows.Next() {
+		var id string
+		var timestamp sql.NullString
+		err = rows.Scan(&id, &timestamp)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		parsed, err := parseMessageTimestamp(timestamp.String)
+		if err != nil {
+			log.Warnf("Failed to parse timestamp %q of message %s: %v", timestamp.String, id, err)
+			continue
+		}
+		timestamps[id] = parsed.Unix()
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for id, ts := range timestamps {
+		_, err = tx.Exec(`UPDATE messages SET ts = ? WHERE id = ?`, ts, id)
+		if err != nil {
+			return err
+		}
+	}
+	log.Infof("Backfilled timestamps of %d messages", len(timestamps))
+	return nil
+}
+
+// runMigrateCommand handles `whatsgo migrate status|up`
+func runMigrateCommand(db *DB, command string) error {
+	switch command {
+	case "status":
+		statuses, unknown, err := GetMigrationStatus(db)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			if status.AppliedAt == "" {
+				log.Infof("%04d_%s: pending", status.Version, status.Name)
+			} else {
+				log.Infof("%04d_%s: applied at %s", status.Version, status.Name, status.AppliedAt)
+			}
+		}
+		for _, version := range unknown {
+			log.Warnf("%04d: applied by a newer version of whatsgo", version)
+		}
+		return nil
+	case "up":
+		applied, err := Migrate(db)
+		if err != nil {
+			return err
+		}
+		log.Infof("Applied %d migrations", applied)
+		return nil
+	}
+	return fmt.Errorf("usage: whatsgo migrate status|up")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	for _, name := range []string{"sqlite3", "postgres"} {
+		t.Run(name, func(t *testing.T) {
+			dialect, err := NewDialect(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			migrations, err := LoadMigrations(dialect)
+			if err != nil {
+				t.Fatalf("LoadMigrations() error = %v", err)
+			}
+			for i, migration := range migrations {
+				if migration.Version != i+1 {
+					t.Fatalf("migration %d has version %d, want versions without gaps", i, migration.Version)
+				}
+				if strings.Contains(migration.SQL, "{{") {
+					t.Errorf("migration %04d_%s isn't rendered", migration.Version, migration.Name)
+				}
+			}
+			// The search migration has a file for each dialect
+			search := migrations[2].SQL
+			if name == "sqlite3" && strings.Contains(search, "tsvector") || name == "postgres" && !strings.Contains(search, "tsvector") {
+				t.Errorf("migration 0003 of %s = %s", name, search)
+			}
+		})
+	}
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	sqlDB, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "whatsgo.db")+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	db, err := NewDB(sqlDB, "sqlite3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tables created by versions before migrations
+	mustExec(t, db, `CREATE TABLE messages (id TEXT PRIMARY KEY, sender TEXT, chat TEXT, content TEXT, parsed_content TEXT, timestamp TEXT)`)
+	mustExec(t, db, `CREATE TABLE files (id TEXT PRIMARY KEY, path TEXT, message_id TEXT, FOREIGN KEY(message_id) REFERENCES messages(id))`)
+	sent := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	mustExec(t, db, `INSERT INTO messages (id, sender, chat, content, parsed_content, timestamp) VALUES (?, ?, ?, ?, ?, ?)`,
+		"M1", "1@s.whatsapp.net", "a@g.us", "hello", "", sent.String())
+
+	migrations, err := LoadMigrations(db.Dialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, err := Migrate(db)
+	if err != nil || applied != len(migrations) {
+		t.Fatalf("Migrate() = %d, %v, want %d migrations", applied, err, len(migrations))
+	}
+	if got := countRows(t, db, `SELECT count(*) FROM messages WHERE id = 'M1' AND ts = ? AND forwarding_score = 0`, sent.Unix()); got != 1 {
+		t.Error("the legacy message has no backfilled ts or new columns")
+	}
+	messages, err := (&DBTracker{db: db, config: &Config{}}).GetMessagesByChat("a@g.us", sent)
+	if err != nil || len(messages) != 1 || messages[0].Content != "hello" {
+		t.Errorf("GetMessagesByChat() = %+v, %v, want the legacy message", messages, err)
+	}
+
+	if applied, err = Migrate(db); applied != 0 || err != nil {
+		t.Errorf("Migrate() again = %d, %v, want nothing to apply", applied, err)
+	}
+	statuses, unknown, err := GetMigrationStatus(db)
+	if err != nil || len(unknown) != 0 {
+		t.Fatalf("GetMigrationStatus() = %v, %v", unknown, err)
+	}
+	for _, status := range statuses {
+		if status.AppliedAt == "" {
+			t.Errorf("migration %04d_%s isn't applied", status.Version, status.Name)
+		}
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	db := newTestDB(t)
+	mustExec(t, db, `INSERT INTO schema_migrations (version, name, applied_at) VALUES (999, 'future', ?)`, time.Now().Format(time.RFC3339))
+	_, unknown, err := GetMigrationStatus(db)
+	if err != nil || len(unknown) != 1 || unknown[0] != 999 {
+		t.Errorf("GetMigrationStatus() unknown = %v, %v, want [999]", unknown, err)
+	}
+	if _, err := Migrate(db); err == nil || !strings.Contains(err.Error(), "999") {
+		t.Errorf("Migrate() error = %v, want the newer schema version to be refused", err)
+	}
+}
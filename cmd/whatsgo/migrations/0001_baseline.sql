@@ -0,0 +1,116 @@
+-- Tables of the DB tracker and the tracker queue.
+-- Databases created before migrations existed already have some of these tables,
+-- the columns they lack are added by the Go hook of this migration.
+
+CREATE TABLE IF NOT EXISTS messages (
+	id TEXT PRIMARY KEY,
+	sender TEXT,
+	chat TEXT,
+	content TEXT,
+	parsed_content TEXT DEFAULT '',
+	timestamp TEXT,
+	latitude REAL,
+	longitude REAL,
+	location_accuracy INTEGER,
+	location_name TEXT,
+	location_address TEXT,
+	live_location BOOLEAN,
+	edited_at TEXT,
+	deleted_at TEXT,
+	quoted_message_id TEXT,
+	quoted_sender TEXT,
+	forwarded BOOLEAN DEFAULT FALSE,
+	forwarding_score INTEGER DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS files (
+	id TEXT PRIMARY KEY,
+	path TEXT,
+	message_id TEXT,
+	FOREIGN KEY(message_id) REFERENCES messages(id)
+);
+
+CREATE TABLE IF NOT EXISTS message_annotations (
+	message_id TEXT,
+	processor TEXT,
+	key TEXT,
+	value TEXT,
+	FOREIGN KEY(message_id) REFERENCES messages(id)
+);
+
+CREATE TABLE IF NOT EXISTS message_revisions (
+	id {{autoincrement}},
+	message_id TEXT,
+	content TEXT,
+	timestamp TEXT,
+	FOREIGN KEY(message_id) REFERENCES messages(id)
+);
+
+CREATE TABLE IF NOT EXISTS location_tracks (
+	id {{autoincrement}},
+	message_id TEXT,
+	sender TEXT,
+	chat TEXT,
+	latitude REAL,
+	longitude REAL,
+	accuracy INTEGER,
+	speed REAL,
+	heading INTEGER,
+	sequence BIGINT,
+	timestamp TEXT
+);
+
+CREATE TABLE IF NOT EXISTS mentions (
+	message_id TEXT,
+	jid TEXT,
+	PRIMARY KEY(message_id, jid),
+	FOREIGN KEY(message_id) REFERENCES messages(id)
+);
+
+CREATE TABLE IF NOT EXISTS reactions (
+	message_id TEXT,
+	sender TEXT,
+	chat TEXT,
+	emoji TEXT,
+	timestamp TEXT,
+	PRIMARY KEY(message_id, sender)
+);
+
+CREATE TABLE IF NOT EXISTS polls (
+	message_id TEXT PRIMARY KEY,
+	question TEXT,
+	selectable_count INTEGER,
+	FOREIGN KEY(message_id) REFERENCES messages(id)
+);
+
+CREATE TABLE IF NOT EXISTS poll_options (
+	poll_id TEXT,
+	hash TEXT,
+	name TEXT,
+	position INTEGER,
+	PRIMARY KEY(poll_id, hash),
+	FOREIGN KEY(poll_id) REFERENCES polls(message_id)
+);
+
+CREATE TABLE IF NOT EXISTS poll_votes (
+	poll_id TEXT,
+	voter TEXT,
+	option_hash TEXT,
+	timestamp TEXT,
+	PRIMARY KEY(poll_id, voter, option_hash)
+);
+
+CREATE TABLE IF NOT EXISTS tracker_queue (
+	id {{autoincrement}},
+	tracker TEXT NOT NULL,
+	message_id TEXT NOT NULL,
+	payload TEXT NOT NULL,
+	status TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at BIGINT NOT NULL,
+	last_error TEXT NOT NULL DEFAULT '',
+	created_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS tracker_queue_pending ON tracker_queue (tracker, status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS tracker_queue_message ON tracker_queue (message_id);
@@ -0,0 +1,7 @@
+-- UTC unix time of messages, so date ranges can be queried with an index.
+-- Existing rows are backfilled from the text timestamp by the Go hook of this migration.
+
+ALTER TABLE messages ADD COLUMN ts BIGINT;
+
+CREATE INDEX IF NOT EXISTS messages_chat_ts ON messages (chat, ts);
+CREATE INDEX IF NOT EXISTS messages_ts ON messages (ts);
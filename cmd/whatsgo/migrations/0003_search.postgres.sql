@@ -0,0 +1,39 @@
+-- Full-text index of message content, OCR text and attachment captions.
+-- The `simple` configuration lowercases words of any language without stemming.
+
+ALTER TABLE files ADD COLUMN IF NOT EXISTS caption TEXT;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS search tsvector;
+
+CREATE INDEX IF NOT EXISTS messages_search ON messages USING GIN (search);
+
+CREATE OR REPLACE FUNCTION messages_search_update() RETURNS trigger AS $$
+BEGIN
+	NEW.search :=
+		setweight(to_tsvector('simple', coalesce(NEW.content, '')), 'A') ||
+		setweight(to_tsvector('simple', coalesce(NEW.parsed_content, '')), 'B') ||
+		setweight(to_tsvector('simple', coalesce((SELECT string_agg(caption, ' ') FROM files WHERE message_id = NEW.id), '')), 'C');
+	RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS messages_search_update ON messages;
+CREATE TRIGGER messages_search_update BEFORE INSERT OR UPDATE ON messages
+	FOR EACH ROW EXECUTE FUNCTION messages_search_update();
+
+-- Touching the message recomputes its search vector when captions change
+CREATE OR REPLACE FUNCTION files_search_update() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP = 'DELETE' THEN
+		UPDATE messages SET id = id WHERE id = OLD.message_id;
+		RETURN OLD;
+	END IF;
+	UPDATE messages SET id = id WHERE id = NEW.message_id;
+	RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS files_search_update ON files;
+CREATE TRIGGER files_search_update AFTER INSERT OR UPDATE OF caption OR DELETE ON files
+	FOR EACH ROW EXECUTE FUNCTION files_search_update();
+
+UPDATE messages SET id = id;
@@ -0,0 +1,5 @@
+-- Captions of attachments are indexed for full-text search together with message content and OCR text.
+-- The FTS5 index itself is built by syncSearchIndex when SQLite has FTS5, i.e. when whatsgo is built with
+-- `-tags sqlite_fts5`, so binaries without it still migrate and search without the index.
+
+ALTER TABLE files ADD COLUMN caption TEXT;
@@ -0,0 +1,13 @@
+-- Metadata of attachments. Files of new messages get their own IDs,
+-- so a message can have more than one file.
+
+ALTER TABLE files ADD COLUMN mime_type TEXT;
+ALTER TABLE files ADD COLUMN size BIGINT;
+ALTER TABLE files ADD COLUMN sha256 TEXT;
+ALTER TABLE files ADD COLUMN file_name TEXT;
+ALTER TABLE files ADD COLUMN width INTEGER;
+ALTER TABLE files ADD COLUMN height INTEGER;
+ALTER TABLE files ADD COLUMN duration INTEGER;
+
+CREATE INDEX IF NOT EXISTS files_message_id ON files (message_id);
+CREATE INDEX IF NOT EXISTS files_sha256 ON files (sha256);
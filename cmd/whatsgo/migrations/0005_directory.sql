@@ -0,0 +1,30 @@
+-- Names of contacts and chats, and participants of groups.
+-- `name` is the best known name: from the address book, the business profile or the push name.
+
+CREATE TABLE IF NOT EXISTS contacts (
+	jid TEXT PRIMARY KEY,
+	name TEXT,
+	push_name TEXT,
+	full_name TEXT,
+	first_name TEXT,
+	business_name TEXT,
+	updated_at TEXT
+);
+
+CREATE TABLE IF NOT EXISTS chats (
+	jid TEXT PRIMARY KEY,
+	name TEXT,
+	topic TEXT,
+	is_group BOOLEAN DEFAULT FALSE,
+	owner TEXT,
+	created_at TEXT,
+	updated_at TEXT
+);
+
+CREATE TABLE IF NOT EXISTS group_participants (
+	group_jid TEXT,
+	jid TEXT,
+	is_admin BOOLEAN DEFAULT FALSE,
+	is_super_admin BOOLEAN DEFAULT FALSE,
+	PRIMARY KEY(group_jid, jid)
+);
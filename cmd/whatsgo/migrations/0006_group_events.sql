@@ -0,0 +1,19 @@
+-- Audit log of groups: who joined, left, was promoted or demoted,
+-- and changes of the subject, the description and the picture.
+-- Changes of several participants are stored as one row per participant.
+
+CREATE TABLE IF NOT EXISTS group_events (
+	id {{autoincrement}},
+	event_id TEXT,
+	chat TEXT,
+	type TEXT,
+	actor TEXT,
+	participant TEXT,
+	value TEXT,
+	reason TEXT,
+	timestamp TEXT,
+	ts BIGINT
+);
+
+CREATE INDEX IF NOT EXISTS group_events_chat_ts ON group_events (chat, ts);
+CREATE INDEX IF NOT EXISTS group_events_ts ON group_events (ts);
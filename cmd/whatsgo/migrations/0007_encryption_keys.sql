@@ -0,0 +1,8 @@
+-- Data keys of encryption at rest, wrapped with the master key.
+-- The newest key encrypts new content, older keys are kept to decrypt what they encrypted.
+
+CREATE TABLE IF NOT EXISTS encryption_keys (
+	id TEXT PRIMARY KEY,
+	wrapped_key TEXT NOT NULL,
+	created_at TEXT NOT NULL
+);
@@ -0,0 +1,20 @@
+-- Log of webhook deliveries: one row per attempt of sending an event to a webhook target.
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id {{autoincrement}},
+	target TEXT NOT NULL,
+	url TEXT,
+	message_id TEXT,
+	event TEXT,
+	idempotency_key TEXT,
+	attempt INTEGER,
+	status_code INTEGER,
+	success BOOLEAN,
+	error TEXT,
+	duration_ms BIGINT,
+	ts BIGINT
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_target_ts ON webhook_deliveries (target, ts);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_message_id ON webhook_deliveries (message_id);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_idempotency_key ON webhook_deliveries (idempotency_key);
@@ -0,0 +1,19 @@
+-- Plain texts that look like encrypted values are escaped with the `enc:plain:` prefix.
+-- Texts stored before the escaping that start with `enc:plain:`, or with `enc:v1:` without a known data key,
+-- were sent as they are, e.g. by a chat member, and are escaped here.
+
+UPDATE messages SET content = 'enc:plain:' || content
+WHERE content LIKE 'enc:plain:%' OR (content LIKE 'enc:v1:%'
+	AND NOT EXISTS (SELECT 1 FROM encryption_keys WHERE messages.content LIKE 'enc:v1:' || encryption_keys.id || ':%'));
+
+UPDATE messages SET parsed_content = 'enc:plain:' || parsed_content
+WHERE parsed_content LIKE 'enc:plain:%' OR (parsed_content LIKE 'enc:v1:%'
+	AND NOT EXISTS (SELECT 1 FROM encryption_keys WHERE messages.parsed_content LIKE 'enc:v1:' || encryption_keys.id || ':%'));
+
+UPDATE message_revisions SET content = 'enc:plain:' || content
+WHERE content LIKE 'enc:plain:%' OR (content LIKE 'enc:v1:%'
+	AND NOT EXISTS (SELECT 1 FROM encryption_keys WHERE message_revisions.content LIKE 'enc:v1:' || encryption_keys.id || ':%'));
+
+UPDATE files SET caption = 'enc:plain:' || caption
+WHERE caption LIKE 'enc:plain:%' OR (caption LIKE 'enc:v1:%'
+	AND NOT EXISTS (SELECT 1 FROM encryption_keys WHERE files.caption LIKE 'enc:v1:' || encryption_keys.id || ':%'));
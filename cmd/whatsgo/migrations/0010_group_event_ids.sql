@@ -0,0 +1,8 @@
+-- Group change IDs are derived from the notification, a notification that is delivered again
+-- is stored once: one row per change and participant.
+
+DELETE FROM group_events WHERE id NOT IN (
+	SELECT min(id) FROM group_events GROUP BY event_id, coalesce(participant, '')
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS group_events_event_participant ON group_events (event_id, coalesce(participant, ''));
@@ -0,0 +1,9 @@
+-- History syncs waiting for the import, so syncs that aren't imported when whatsgo stops are imported on the next start.
+-- WhatsApp sends every history sync once. data is the HistorySync protobuf, encrypted when encryption is enabled.
+
+CREATE TABLE IF NOT EXISTS history_syncs (
+	id {{autoincrement}},
+	sync_type TEXT,
+	data BLOB NOT NULL,
+	created_at BIGINT
+);
@@ -0,0 +1,5 @@
+-- Senders are stored without the device, e.g. 123@s.whatsapp.net instead of 123:12@s.whatsapp.net
+-- or 123.1:12@s.whatsapp.net, so their names are found in contacts.
+
+UPDATE messages SET sender = substr(sender, 1, strpos(replace(sender, '.', ':'), ':') - 1) || substr(sender, strpos(sender, '@'))
+WHERE sender LIKE '%:%@%';
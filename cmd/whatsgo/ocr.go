@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultOCRBinary    = "tesseract"
+	defaultOCRLanguages = "eng"
+	defaultOCRTimeout   = 30 * time.Second
+)
+
+// OCRProcessor extracts text from images attached to a message using a local tesseract binary
+type OCRProcessor struct {
+	config OCRConfig
+	binary string
+}
+
+func (p *OCRProcessor) Name() string {
+	return "ocr"
+}
+
+func (p *OCRProcessor) Init(config *Config) error {
+	p.config = config.OCR
+	if p.config.Binary == "" {
+		p.config.Binary = defaultOCRBinary
+	}
+	if p.config.Languages == "" {
+		p.config.Languages = defaultOCRLanguages
+	}
+	if p.config.Timeout <= 0 {
+		p.config.Timeout = defaultOCRTimeout
+	}
+
+	binary, err := exec.LookPath(p.config.Binary)
+	if err != nil {
+		return fmt.Errorf("tesseract binary %q not found: %v", p.config.Binary, err)
+	}
+	p.binary = binary
+	log.Infof("OCR enabled using %s (languages: %s)", p.binary, p.config.Languages)
+	return nil
+}
+
+// Process fills ParsedContent with the text recognized on all images of the message
+func (p *OCRProcessor) Process(message *TrackableMessage) error {
+	var texts []string
+	for _, file := range message.Files {
+		if !isImageFile(file) {
+			continue
+		}
+		text, err := p.recognize(file.Path)
+		if err != nil {
+			log.Warnf("Failed to recognize text on %s: %v", file.Path, err)
+			continue
+		}
+		if text != "" {
+			texts = append(texts, text)
+		}
+	}
+	message.ParsedContent = strings.Join(texts, "\n")
+	return nil
+}
+
+func (p *OCRProcessor) recognize(path string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.Timeout)
+	defer cancel()
+
+	data, err := encryptor.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	// The image is passed on stdin so decrypted content never touches the disk
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.binary, "stdin", "stdout", "-l", p.config.Languages)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return "", fmt.Errorf("tesseract timed out after %s", p.config.Timeout)
+	}
+	if err != nil {
+		return "", fmt.Errorf("tesseract failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func isImageFile(file Attachment) bool {
+	mimeType := file.MimeType
+	if mimeType == "" {
+		mimeType = mime.TypeByExtension(filepath.Ext(file.Path))
+	}
+	return strings.HasPrefix(mimeType, "image/")
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode"
+)
+
+// Annotation is a piece of structured data attached to a message by a processor
+type Annotation struct {
+	Processor string `json:"processor"`
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+}
+
+// Processor enriches a message before it is passed to trackers
+type Processor interface {
+	Name() string
+	Init(config *Config) error
+	Process(message *TrackableMessage) error
+}
+
+var processorFactories = map[string]func() Processor{
+	"ocr":         func() Processor { return &OCRProcessor{} },
+	"coordinates": func() Processor { return &CoordinatesProcessor{} },
+	"keywords":    func() Processor { return &KeywordsProcessor{} },
+	"language":    func() Processor { return &LanguageProcessor{} },
+}
+
+// CreateProcessors creates and initializes processors in the order they are listed in the config
+func CreateProcessors(config *Config) []Processor {
+	names := config.Processors
+	if names == nil && config.OCR.Enabled {
+		// Keep `ocr.enabled` working for configs without the `processors` section
+		names = []string{"ocr"}
+	}
+
+	var processors []Processor
+	for _, name := range names {
+		factory, ok := processorFactories[name]
+		if !ok {
+			log.Errorf("Unknown processor: %s", name)
+			continue
+		}
+		processor := factory()
+		err := processor.Init(config)
+		if err != nil {
+			log.Errorf("Failed to initialize processor %s, continuing without it: %v", name, err)
+			continue
+		}
+		processors = append(processors, processor)
+	}
+	return processors
+}
+
+// ProcessorSet holds the processors of the current config
+type ProcessorSet struct {
+	processors atomic.Pointer[[]Processor]
+}
+
+func CreateProcessorSet(config *Config) *ProcessorSet {
+	set := &ProcessorSet{}
+	processors := CreateProcessors(config)
+	set.processors.Store(&processors)
+	return set
+}
+
+// Get returns the current processors
+func (s *ProcessorSet) Get() []Processor {
+	return *s.processors.Load()
+}
+
+// Reload creates the processors again if their settings changed
+func (s *ProcessorSet) Reload(old *Config, config *Config) {
+	if reflect.DeepEqual(old.Processors, config.Processors) && reflect.DeepEqual(old.OCR, config.OCR) &&
+		reflect.DeepEqual(old.Keywords, config.Keywords) {
+		return
+	}
+	processors := CreateProcessors(config)
+	s.processors.Store(&processors)
+}
+
+func (message *TrackableMessage) Annotate(processor string, key string, value string) {
+	message.Annotations = append(message.Annotations, Annotation{
+		Processor: processor,
+		Key:       key,
+		Value:     value,
+	})
+}
+
+func formatAnnotations(annotations []Annotation) string {
+	parts := make([]string, len(annotations))
+	for i, annotation := range annotations {
+		parts[i] = fmt.Sprintf("%s=%s", annotation.Key, annotation.Value)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// CoordinatesProcessor finds coordinates like `55.7558,37.6176` in the message text
+type CoordinatesProcessor struct{}
+
+var coordinatePattern = regexp.MustCompile(`(-?\d{1,2}\.\d+)\s*,\s*(-?\d{1,3}\.\d+)`)
+
+func (p *CoordinatesProcessor) Name() string {
+	return "coordinates"
+}
+
+func (p *CoordinatesProcessor) Init(config *Config) error {
+	return nil
+}
+
+func (p *CoordinatesProcessor) Process(message *TrackableMessage) error {
+	if message.Location != nil {
+		message.Annotate(p.Name(), "coordinates", fmt.Sprintf("%f,%f", message.Location.Latitude, message.Location.Longitude))
+	}
+	for _, text := range []string{message.Content, message.ParsedContent} {
+		for _, match := range coordinatePattern.FindAllStringSubmatch(text, -1) {
+			lat, _ := strconv.ParseFloat(match[1], 64)
+			lon, _ := strconv.ParseFloat(match[2], 64)
+			if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+				continue
+			}
+			message.Annotate(p.Name(), "coordinates", fmt.Sprintf("%s,%s", match[1], match[2]))
+		}
+	}
+	return nil
+}
+
+// KeywordsProcessor tags messages that contain configured keywords
+type KeywordsProcessor struct {
+	keywords map[string][]string
+}
+
+func (p *KeywordsProcessor) Name() string {
+	return "keywords"
+}
+
+func (p *KeywordsProcessor) Init(config *Config) error {
+	if len(config.Keywords) == 0 {
+		return fmt.Errorf("no keywords configured")
+	}
+	p.keywords = make(map[string][]string, len(config.Keywords))
+	for tag, words := range config.Keywords {
+		for _, word := range words {
+			p.keywords[tag] = append(p.keywords[tag], strings.ToLower(word))
+		}
+	}
+	return nil
+}
+
+func (p *KeywordsProcessor) Process(message *TrackableMessage) error {
+	text := strings.ToLower(message.Content + "\n" + message.ParsedContent)
+	for tag, words := range p.keywords {
+		for _, word := range words {
+			if strings.Contains(text, word) {
+				message.Annotate(p.Name(), "tag", tag)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// LanguageProcessor guesses the language of the message text by its alphabet
+type LanguageProcessor struct{}
+
+func (p *LanguageProcessor) Name() string {
+	return "language"
+}
+
+func (p *LanguageProcessor) Init(config *Config) error {
+	return nil
+}
+
+func (p *LanguageProcessor) Process(message *TrackableMessage) error {
+	language := detectLanguage(message.Content)
+	if language == "" {
+		language = detectLanguage(message.ParsedContent)
+	}
+	if language != "" {
+		message.Annotate(p.Name(), "language", language)
+	}
+	return nil
+}
+
+func detectLanguage(text string) string {
+	var latin, cyrillic, ukrainian, russian int
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case strings.ContainsRune("іїєґ", r):
+			ukrainian++
+			cyrillic++
+		case strings.ContainsRune("ыэъё", r):
+			russian++
+			cyrillic++
+		case unicode.Is(unicode.Cyrillic, r):
+			cyrillic++
+		case unicode.Is(unicode.Latin, r):
+			latin++
+		}
+	}
+
+	switch {
+	case cyrillic == 0 && latin == 0:
+		return ""
+	case latin > cyrillic:
+		return "en"
+	case ukrainian > russian:
+		return "uk"
+	case russian > ukrainian:
+		return "ru"
+	default:
+		return "cyrillic"
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	queueStatusPending    = "pending"
+	queueStatusProcessing = "processing"
+	queueStatusDead       = "dead"
+)
+
+const (
+	defaultQueueWorkers      = 1
+	defaultQueueMaxAttempts  = 10
+	defaultQueueBaseDelay    = 5 * time.Second
+	defaultQueueMaxDelay     = 30 * time.Minute
+	defaultQueuePollInterval = 10 * time.Second
+)
+
+// TrackerQueue is a durable outbox that delivers messages to trackers in background workers
+type TrackerQueue struct {
+	db      *DB
+	config  QueueConfig
+	router  atomic.Pointer[Router]
+	mu      sync.Mutex
+	notify  map[string]chan struct{}
+	stop    map[string]chan struct{}
+	started bool
+	quit    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// RetryPolicy is implemented by trackers that retry failed jobs differently from the queue
+type RetryPolicy interface {
+	// MaxAttempts returns the number of attempts before a job is marked as dead, zero keeps the queue setting
+	MaxAttempts() int
+	// RetryDelay returns the delay after the given number of failed attempts
+	RetryDelay(attempts int) time.Duration
+}
+
+// PermanentError is returned by trackers for jobs that fail the same way on every attempt,
+// such jobs are marked as dead without being retried
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// errMessageNotStored is returned by trackers for an edit or revocation of a message they don't have.
+// The job is retried while an older job of the message is queued for the tracker, otherwise it's skipped.
+var errMessageNotStored = errors.New("message is not stored")
+
+// QueueStats is a number of jobs of a tracker in a given status
+type QueueStats struct {
+	Tracker string
+	Status  string
+	Count   int
+}
+
+func CreateTrackerQueue(config *Config, db *DB, router *Router) (*TrackerQueue, error) {
+	queue := &TrackerQueue{
+		db:     db,
+		config: config.Queue,
+		notify: make(map[string]chan struct{}),
+		stop:   make(map[string]chan struct{}),
+		quit:   make(chan struct{}),
+	}
+	queue.router.Store(router)
+	if queue.config.Workers <= 0 {
+		queue.config.Workers = defaultQueueWorkers
+	}
+	if queue.config.MaxAttempts <= 0 {
+		queue.config.MaxAttempts = defaultQueueMaxAttempts
+	}
+	if queue.config.BaseDelay <= 0 {
+		queue.config.BaseDelay = defaultQueueBaseDelay
+	}
+	if queue.config.MaxDelay <= 0 {
+		queue.config.MaxDelay = defaultQueueMaxDelay
+	}
+	if queue.config.PollInterval <= 0 {
+		queue.config.PollInterval = defaultQueuePollInterval
+	}
+
+	err := queue.init()
+	if err != nil {
+		return nil, err
+	}
+	return queue, nil
+}
+
+func (q *TrackerQueue) init() error {
+	// Jobs that were in progress when the application stopped are delivered again
+	_, err := q.db.Exec(`UPDATE tracker_queue SET status = ? WHERE status = ?`, queueStatusPending, queueStatusProcessing)
+	return err
+}
+
+// Start runs workers for every tracker
+func (q *TrackerQueue) Start() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.started = true
+	for _, tracker := range q.router.Load().Trackers() {
+		q.startWorkers(tracker.Name())
+	}
+}
+
+func (q *TrackerQueue) startWorkers(tracker string) {
+	if _, ok := q.notify[tracker]; !ok {
+		q.notify[tracker] = make(chan struct{}, 1)
+	}
+	stop := make(chan struct{})
+	q.stop[tracker] = stop
+	for i := 0; i < q.config.Workers; i++ {
+		q.wg.Add(1)
+		go q.work(tracker, q.notify[tracker], stop)
+	}
+}
+
+// Router returns the router that new messages are enqueued with
+func (q *TrackerQueue) Router() *Router {
+	return q.router.Load()
+}
+
+// SetRouter replaces the trackers at once: new messages are routed with the new router,
+// workers of removed trackers stop and jobs that are left for them wait until the tracker is enabled again
+func (q *TrackerQueue) SetRouter(router *Router) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	old := q.router.Swap(router)
+	for _, tracker := range old.Trackers() {
+		if router.findTracker(tracker.Name()) == nil && q.stop[tracker.Name()] != nil {
+			close(q.stop[tracker.Name()])
+			delete(q.stop, tracker.Name())
+		}
+	}
+	for _, tracker := range router.Trackers() {
+		if q.started && q.stop[tracker.Name()] == nil {
+			q.startWorkers(tracker.Name())
+		}
+	}
+}
+
+// Stop waits for workers to finish the jobs they are processing
+func (q *TrackerQueue) Stop() {
+	close(q.quit)
+	q.wg.Wait()
+}
+
+// Enqueue stores the message for every tracker it's routed to and wakes up their workers
+func (q *TrackerQueue) Enqueue(message *TrackableMessage) error {
+	trackers := q.router.Load().Route(message)
+	if len(trackers) == 0 {
+		log.Debugf("Message %s isn't routed to any tracker", message.MessageID)
+		return nil
+	}
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	encrypted, err := encryptor.EncryptText(string(payload))
+	if err != nil {
+		return err
+	}
+
+	tx, err := q.db.Begin()
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for _, tracker := range trackers {
+		_, err = tx.Exec(`INSERT INTO tracker_queue (tracker, message_id, payload, status, next_attempt_at, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+			tracker.Name(), message.MessageID, encrypted, queueStatusPending, now, now)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	for _, tracker := range trackers {
+		q.wake(tracker.Name())
+	}
+	return nil
+}
+
+func (q *TrackerQueue) wake(tracker string) {
+	q.mu.Lock()
+	notify := q.notify[tracker]
+	q.mu.Unlock()
+	select {
+	case notify <- struct{}{}:
+	default:
+	}
+}
+
+// work delivers jobs of the tracker, the tracker is looked up for every job as it's replaced when the config is reloaded
+func (q *TrackerQueue) work(name string, notify chan struct{}, stop chan struct{}) {
+	defer q.wg.Done()
+	ticker := time.NewTicker(q.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		tracker := q.router.Load().findTracker(name)
+		if tracker == nil {
+			return
+		}
+		processed, err := q.processNext(tracker)
+		if err != nil {
+			log.Errorf("Failed to process queue of tracker(%s): %v", tracker.Name(), err)
+		}
+		if processed {
+			select {
+			case <-q.quit:
+				return
+			case <-stop:
+				return
+			default:
+				continue
+			}
+		}
+
+		select {
+		case <-q.quit:
+			return
+		case <-stop:
+			return
+		case <-notify:
+		case <-ticker.C:
+		}
+	}
+}
+
+// processNext delivers the oldest due job of the tracker and reports whether there was one
+func (q *TrackerQueue) processNext(tracker Tracker) (bool, error) {
+	var id int64
+	var payload string
+	var attempts int
+	err := q.db.QueryRow(`
+		UPDATE tracker_queue SET status = ?, attempts = attempts + 1
+		WHERE id = (
+			SELECT id FROM tracker_queue AS job
+			WHERE tracker = ? AND status = ? AND next_attempt_at <= ?
+			-- Jobs of a message are delivered in order, e.g. an edit waits for the retries of the message
+			AND NOT EXISTS (
+				SELECT 1 FROM tracker_queue AS earlier
+				WHERE earlier.tracker = job.tracker AND earlier.message_id = job.message_id
+				AND earlier.id < job.id AND earlier.status != ?
+			)
+			ORDER BY id LIMIT 1
+		) AND status = ?
+		RETURNING id, payload, attempts`,
+		queueStatusProcessing, tracker.Name(), queueStatusPending, time.Now().Unix(), queueStatusDead, queueStatusPending,
+	).Scan(&id, &payload, &attempts)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var message TrackableMessage
+	payload, err = encryptor.DecryptText(payload)
+	if err == nil {
+		err = json.Unmarshal([]byte(payload), &message)
+	}
+	if err == nil {
+		log.Debugf("Processing message %s with tracker: %s", message.MessageID, tracker.Name())
+		err = trackMessage(tracker, &message)
+	}
+	if errors.Is(err, errMessageNotStored) {
+		// The message was sent before tracking started or was filtered out, unless an older job
+		// of the message, e.g. a dead one, is still to be delivered
+		var earlier int
+		checkErr := q.db.QueryRow(`SELECT COUNT(*) FROM tracker_queue WHERE tracker = ? AND message_id = ? AND id < ?`,
+			tracker.Name(), message.MessageID, id).Scan(&earlier)
+		if checkErr != nil {
+			return true, checkErr
+		}
+		if earlier == 0 {
+			log.Warnf("Changed message %s is not in tracker(%s), skipping", message.MessageID, tracker.Name())
+			err = nil
+		}
+	}
+	if err == nil {
+		_, err = q.db.Exec(`DELETE FROM tracker_queue WHERE id = ?`, id)
+		return true, err
+	}
+
+	maxAttempts := q.config.MaxAttempts
+	policy, hasPolicy := tracker.(RetryPolicy)
+	if hasPolicy && policy.MaxAttempts() > 0 {
+		maxAttempts = policy.MaxAttempts()
+	}
+	var permanent *PermanentError
+	if attempts >= maxAttempts || errors.As(err, &permanent) {
+		log.Errorf("Giving up on message %s in tracker(%s) after %d attempts: %v", message.MessageID, tracker.Name(), attempts, err)
+		_, err = q.db.Exec(`UPDATE tracker_queue SET status = ?, last_error = ? WHERE id = ?`, queueStatusDead, err.Error(), id)
+		return true, err
+	}
+
+	delay := q.backoff(attempts)
+	if hasPolicy {
+		delay = policy.RetryDelay(attempts)
+	}
+	log.Warnf("Failed to store message %s in tracker(%s), attempt %d, retrying in %s: %v", message.MessageID, tracker.Name(), attempts, delay, err)
+	_, err = q.db.Exec(`UPDATE tracker_queue SET status = ?, last_error = ?, next_attempt_at = ? WHERE id = ?`,
+		queueStatusPending, err.Error(), time.Now().Add(delay).Unix(), id)
+	return true, err
+}
+
+// trackMessage passes the message to the tracker, a panic of the tracker fails the job instead of the worker
+func trackMessage(tracker Tracker, message *TrackableMessage) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("Tracker(%s) panicked on message %s: %v\n%s", tracker.Name(), message.MessageID, r, debug.Stack())
+			err = fmt.Errorf("tracker panicked: %v", r)
+		}
+	}()
+	return tracker.TrackMessage(message)
+}
+
+func (q *TrackerQueue) backoff(attempts int) time.Duration {
+	delay := q.config.BaseDelay
+	for i := 1; i < attempts && delay < q.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > q.config.MaxDelay {
+		delay = q.config.MaxDelay
+	}
+	return delay
+}
+
+// HasMessage reports whether the message is waiting in the queue of any tracker
+func (q *TrackerQueue) HasMessage(messageID string) (bool, error) {
+	var count int
+	err := q.db.QueryRow(`SELECT COUNT(*) FROM tracker_queue WHERE message_id = ?`, messageID).Scan(&count)
+	return count > 0, err
+}
+
+// Stats returns the number of queued jobs per tracker and status
+func (q *TrackerQueue) Stats() ([]QueueStats, error) {
+	rows, err := q.db.Query(`SELECT tracker, status, COUNT(*) FROM tracker_queue GROUP BY tracker, status ORDER BY tracker, status`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []QueueStats
+	for rows.Next() {
+		var stat QueueStats
+		err := rows.Scan(&stat.Tracker, &stat.Status, &stat.Count)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
+
+// RetryDead moves dead jobs of the tracker back to the queue
+func (q *TrackerQueue) RetryDead(tracker string) (int64, error) {
+	if q.router.Load().findTracker(tracker) == nil {
+		return 0, fmt.Errorf("unknown tracker: %s", tracker)
+	}
+	result, err := q.db.Exec(`UPDATE tracker_queue SET status = ?, attempts = 0, next_attempt_at = ? WHERE tracker = ? AND status = ?`,
+		queueStatusPending, time.Now().Unix(), tracker, queueStatusDead)
+	if err != nil {
+		return 0, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	q.wake(tracker)
+	return count, nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// queueJob returns the status and attempts of the job of the tracker
+func queueJob(t *testing.T, db *DB, tracker string) (string, int) {
+	t.Helper()
+	var status string
+	var attempts int
+	err := db.QueryRow(`SELECT status, attempts FROM tracker_queue WHERE tracker = ?`, tracker).Scan(&status, &attempts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status, attempts
+}
+
+// processDue makes the jobs due and delivers the next one
+func processDue(t *testing.T, db *DB, queue *TrackerQueue, tracker Tracker) bool {
+	t.Helper()
+	mustExec(t, db, `UPDATE tracker_queue SET next_attempt_at = 0`)
+	processed, err := queue.processNext(tracker)
+	if err != nil {
+		t.Fatalf("processNext() error = %v", err)
+	}
+	return processed
+}
+
+func TestQueueDelivers(t *testing.T) {
+	db := newTestDB(t)
+	tracker := &testTracker{name: "test"}
+	queue := newTestQueue(t, db, &Config{}, tracker)
+	if err := queue.Enqueue(&TrackableMessage{Event: EventMessageCreated, MessageID: "M1", Content: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if queued, _ := queue.HasMessage("M1"); !queued {
+		t.Error("HasMessage() = false for a queued message")
+	}
+	if !processDue(t, db, queue, tracker) {
+		t.Fatal("processNext() found no job")
+	}
+	if messages := tracker.messages(); len(messages) != 1 || messages[0].MessageID != "M1" || messages[0].Content != "hi" {
+		t.Errorf("tracked messages = %+v, want M1", messages)
+	}
+	if got := countRows(t, db, `SELECT count(*) FROM tracker_queue`); got != 0 {
+		t.Errorf("%d jobs are left after the delivery", got)
+	}
+	if processDue(t, db, queue, tracker) {
+		t.Error("processNext() found a job in the empty queue")
+	}
+}
+
+func TestQueueRetriesAndDeadLetters(t *testing.T) {
+	db := newTestDB(t)
+	fail := true
+	tracker := &testTracker{name: "test", track: func(message *TrackableMessage) error {
+		if fail {
+			return errors.New("unavailable")
+		}
+		return nil
+	}}
+	queue := newTestQueue(t, db, &Config{Queue: QueueConfig{MaxAttempts: 3, BaseDelay: time.Hour}}, tracker)
+	if err := queue.Enqueue(&TrackableMessage{Event: EventMessageCreated, MessageID: "M1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	processDue(t, db, queue, tracker)
+	if status, attempts := queueJob(t, db, "test"); status != queueStatusPending || attempts != 1 {
+		t.Errorf("job = %s after %d attempts, want pending after 1", status, attempts)
+	}
+	// The retry waits for the backoff delay
+	if processed, err := queue.processNext(tracker); processed || err != nil {
+		t.Errorf("processNext() = %v, %v before the retry is due", processed, err)
+	}
+	processDue(t, db, queue, tracker)
+	processDue(t, db, queue, tracker)
+	if status, attempts := queueJob(t, db, "test"); status != queueStatusDead || attempts != 3 {
+		t.Errorf("job = %s after %d attempts, want dead after 3", status, attempts)
+	}
+	if processDue(t, db, queue, tracker) {
+		t.Error("processNext() delivered a dead job")
+	}
+	stats, err := queue.Stats()
+	if err != nil || !reflect.DeepEqual(stats, []QueueStats{{Tracker: "test", Status: queueStatusDead, Count: 1}}) {
+		t.Errorf("Stats() = %+v, %v", stats, err)
+	}
+
+	if _, err := queue.RetryDead("unknown"); err == nil {
+		t.Error("RetryDead() of an unknown tracker succeeded")
+	}
+	if count, err := queue.RetryDead("test"); count != 1 || err != nil {
+		t.Fatalf("RetryDead() = %d, %v, want 1 job", count, err)
+	}
+	fail = false
+	if !processDue(t, db, queue, tracker) {
+		t.Fatal("processNext() found no job after RetryDead()")
+	}
+	if got := countRows(t, db, `SELECT count(*) FROM tracker_queue`); got != 0 {
+		t.Errorf("%d jobs are left after the retried delivery", got)
+	}
+	if got := len(tracker.messages()); got != 4 {
+		t.Errorf("tracker got %d attempts, want 4", got)
+	}
+}
+
+func TestQueuePermanentError(t *testing.T) {
+	db := newTestDB(t)
+	tracker := &testTracker{name: "test", track: func(message *TrackableMessage) error {
+		return &PermanentError{Err: errors.New("invalid payload")}
+	}}
+	queue := newTestQueue(t, db, &Config{}, tracker)
+	if err := queue.Enqueue(&TrackableMessage{Event: EventMessageCreated, MessageID: "M1"}); err != nil {
+		t.Fatal(err)
+	}
+	processDue(t, db, queue, tracker)
+	if status, attempts := queueJob(t, db, "test"); status != queueStatusDead || attempts != 1 {
+		t.Errorf("job = %s after %d attempts, want dead after 1", status, attempts)
+	}
+	var lastError string
+	if err := db.QueryRow(`SELECT last_error FROM tracker_queue`).Scan(&lastError); err != nil || lastError != "invalid payload" {
+		t.Errorf("last_error = %q, %v", lastError, err)
+	}
+}
+
+// retryTestTracker fails every attempt and retries by its own policy
+type retryTestTracker struct {
+	testTracker
+}
+
+func (tracker *retryTestTracker) MaxAttempts() int {
+	return 2
+}
+
+func (tracker *retryTestTracker) RetryDelay(attempts int) time.Duration {
+	return 0
+}
+
+func TestQueueRetryPolicy(t *testing.T) {
+	db := newTestDB(t)
+	tracker := &retryTestTracker{testTracker{name: "test", track: func(message *TrackableMessage) error {
+		return errors.New("unavailable")
+	}}}
+	queue := newTestQueue(t, db, &Config{Queue: QueueConfig{MaxAttempts: 10, BaseDelay: time.Hour}}, tracker)
+	if err := queue.Enqueue(&TrackableMessage{Event: EventMessageCreated, MessageID: "M1"}); err != nil {
+		t.Fatal(err)
+	}
+	// Without a delay the retry is due at once
+	for i := 0; i < 2; i++ {
+		if processed, err := queue.processNext(tracker); !processed || err != nil {
+			t.Fatalf("processNext() = %v, %v, want a due job", processed, err)
+		}
+	}
+	if status, attempts := queueJob(t, db, "test"); status != queueStatusDead || attempts != 2 {
+		t.Errorf("job = %s after %d attempts, want dead after 2", status, attempts)
+	}
+}
+
+func TestQueueBackoff(t *testing.T) {
+	queue := &TrackerQueue{config: QueueConfig{BaseDelay: 5 * time.Second, MaxDelay: 30 * time.Second}}
+	want := []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second}
+	for i, delay := range want {
+		if got := queue.backoff(i + 1); got != delay {
+			t.Errorf("backoff(%d) = %s, want %s", i+1, got, delay)
+		}
+	}
+}
+
+func TestQueueResumesInterruptedJobs(t *testing.T) {
+	db := newTestDB(t)
+	tracker := &testTracker{name: "test"}
+	queue := newTestQueue(t, db, &Config{}, tracker)
+	if err := queue.Enqueue(&TrackableMessage{Event: EventMessageCreated, MessageID: "M1"}); err != nil {
+		t.Fatal(err)
+	}
+	// The application stopped while the job was delivered
+	mustExec(t, db, `UPDATE tracker_queue SET status = ?`, queueStatusProcessing)
+	queue = newTestQueue(t, db, &Config{}, tracker)
+	if status, _ := queueJob(t, db, "test"); status != queueStatusPending {
+		t.Errorf("job = %s after a restart, want pending", status)
+	}
+	if !processDue(t, db, queue, tracker) || len(tracker.messages()) != 1 {
+		t.Error("the interrupted job isn't delivered again")
+	}
+}
+
+func TestQueueDeliversChangesAfterTheMessage(t *testing.T) {
+	db := newTestDB(t)
+	available := false
+	dbTracker := &DBTracker{db: db}
+	tracker := &testTracker{name: "db", track: func(message *TrackableMessage) error {
+		if !available {
+			return errors.New("unavailable")
+		}
+		return dbTracker.TrackMessage(message)
+	}}
+	queue := newTestQueue(t, db, &Config{Queue: QueueConfig{BaseDelay: time.Hour}}, tracker)
+	sent := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC).String()
+	for _, message := range []*TrackableMessage{
+		{Event: EventMessageCreated, MessageID: "M1", Chat: "a@g.us", Content: "helo", Timestamp: sent},
+		{Event: EventMessageEdited, MessageID: "M1", Content: "hello", EventTimestamp: "1714557700"},
+		{Event: EventMessageEdited, MessageID: "UNKNOWN", Content: "edited", EventTimestamp: "1714557700"},
+	} {
+		if err := queue.Enqueue(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The message is waiting for a retry, its edit waits as well
+	if processed, err := queue.processNext(tracker); !processed || err != nil {
+		t.Fatalf("processNext() = %v, %v", processed, err)
+	}
+	available = true
+	if processed, err := queue.processNext(tracker); !processed || err != nil {
+		t.Fatalf("processNext() = %v, %v", processed, err)
+	}
+	if messages := tracker.messages(); messages[len(messages)-1].MessageID != "UNKNOWN" {
+		t.Errorf("delivered %s before the retry of M1", messages[len(messages)-1].MessageID)
+	}
+	// The edit of a message that was never stored is skipped
+	if got := countRows(t, db, `SELECT count(*) FROM tracker_queue WHERE message_id = 'UNKNOWN'`); got != 0 {
+		t.Errorf("%d jobs of the unknown message are left", got)
+	}
+
+	for processDue(t, db, queue, tracker) {
+	}
+	var content string
+	if err := db.QueryRow(`SELECT content FROM messages WHERE id = 'M1'`).Scan(&content); err != nil || content != "hello" {
+		t.Errorf("content = %q, %v, want the edited content", content, err)
+	}
+}
+
+func TestQueueRetriesChangesOfDeadMessages(t *testing.T) {
+	db := newTestDB(t)
+	tracker := &testTracker{name: "db", track: func(message *TrackableMessage) error {
+		if message.Event == EventMessageCreated {
+			return &PermanentError{Err: errors.New("rejected")}
+		}
+		return (&DBTracker{db: db}).TrackMessage(message)
+	}}
+	queue := newTestQueue(t, db, &Config{Queue: QueueConfig{MaxAttempts: 2}}, tracker)
+	for _, message := range []*TrackableMessage{
+		{Event: EventMessageCreated, MessageID: "M1", Content: "helo"},
+		{Event: EventMessageRevoked, MessageID: "M1", EventTimestamp: "1714557700"},
+	} {
+		if err := queue.Enqueue(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for processDue(t, db, queue, tracker) {
+	}
+	// The revocation isn't lost, it's retried with the message by queue-retry
+	if got := countRows(t, db, `SELECT count(*) FROM tracker_queue WHERE status = ?`, queueStatusDead); got != 2 {
+		t.Errorf("dead jobs = %d, want the message and its revocation", got)
+	}
+}
+
+func TestQueueRecoversPanics(t *testing.T) {
+	db := newTestDB(t)
+	tracker := &testTracker{name: "test", track: func(message *TrackableMessage) error {
+		panic("broken tracker")
+	}}
+	queue := newTestQueue(t, db, &Config{}, tracker)
+	if err := queue.Enqueue(&TrackableMessage{Event: EventMessageCreated, MessageID: "M1"}); err != nil {
+		t.Fatal(err)
+	}
+	if !processDue(t, db, queue, tracker) {
+		t.Fatal("processNext() found no job")
+	}
+	if status, attempts := queueJob(t, db, "test"); status != queueStatusPending || attempts != 1 {
+		t.Errorf("job is %s after %d attempts, want it pending for a retry", status, attempts)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/hex"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Reaction is an emoji reaction to a message, an empty emoji removes the reaction of the sender
+type Reaction struct {
+	MessageID string `json:"message_id"`
+	Emoji     string `json:"emoji"`
+}
+
+// Poll is a poll created by a message
+type Poll struct {
+	Question        string       `json:"question"`
+	Options         []PollOption `json:"options"`
+	SelectableCount uint32       `json:"selectable_count"`
+}
+
+// PollOption is an option of a poll, votes reference options by the SHA-256 hash of their name
+type PollOption struct {
+	Hash string `json:"hash"`
+	Name string `json:"name"`
+}
+
+// PollVote is the current selection of the sender in a poll, it replaces previous votes of the sender
+type PollVote struct {
+	PollID  string       `json:"poll_id"`
+	Options []PollOption `json:"options"`
+}
+
+// getPoll returns the poll created by the message or nil
+func getPoll(msg *waProto.Message) *Poll {
+	creation := msg.GetPollCreationMessage()
+	if creation == nil {
+		creation = msg.GetPollCreationMessageV2()
+	}
+	if creation == nil {
+		creation = msg.GetPollCreationMessageV3()
+	}
+	if creation == nil {
+		return nil
+	}
+
+	names := make([]string, len(creation.GetOptions()))
+	for i, option := range creation.GetOptions() {
+		names[i] = option.GetOptionName()
+	}
+	poll := &Poll{
+		Question:        creation.GetName(),
+		SelectableCount: creation.GetSelectableOptionsCount(),
+	}
+	for i, hash := range whatsmeow.HashPollOptions(names) {
+		poll.Options = append(poll.Options, PollOption{Hash: hex.EncodeToString(hash), Name: names[i]})
+	}
+	return poll
+}
+
+// trackReactionOrVote passes reactions and poll votes to trackers and reports whether the message was one of them
+func trackReactionOrVote(evt *events.Message, queue *TrackerQueue, dbTracker *DBTracker, server *Server) bool {
+	message := TrackableMessage{
+		MessageID: evt.Info.ID,
+		Sender:    evt.Info.Sender.String(),
+		Chat:      evt.Info.Chat.String(),
+		Timestamp: evt.Info.Timestamp.String(),
+		Metadata: MessageMetadata{
+			Date:      evt.Info.Timestamp.Format("02.01.2006"),
+			Timestamp: evt.Info.Timestamp,
+		},
+	}
+
+	switch {
+	case evt.Message.GetReactionMessage() != nil:
+		reaction := evt.Message.GetReactionMessage()
+		message.Event = EventReaction
+		message.Reaction = &Reaction{MessageID: reaction.GetKey().GetID(), Emoji: reaction.GetText()}
+	case evt.Message.GetEncReactionMessage() != nil:
+		reaction, err := cli.DecryptReaction(evt)
+		if err != nil {
+			log.Errorf("Failed to decrypt encrypted reaction: %v", err)
+			return true
+		}
+		message.Event = EventReaction
+		message.Reaction = &Reaction{MessageID: evt.Message.GetEncReactionMessage().GetTargetMessageKey().GetID(), Emoji: reaction.GetText()}
+	case evt.Message.GetPollUpdateMessage() != nil:
+		vote, err := cli.DecryptPollVote(evt)
+		if err != nil {
+			log.Errorf("Failed to decrypt vote: %v", err)
+			return true
+		}
+		pollID := evt.Message.GetPollUpdateMessage().GetPollCreationMessageKey().GetID()
+		options, err := dbTracker.GetPollOptions(pollID)
+		if err != nil {
+			log.Errorf("Failed to get options of poll %s: %v", pollID, err)
+		}
+		message.Event = EventPollVote
+		message.PollVote = &PollVote{PollID: pollID, Options: resolvePollOptions(vote.GetSelectedOptions(), options)}
+	default:
+		return false
+	}
+
+	log.Infof("Tracking %s from %s in chat %s", message.Event, message.Sender, message.Chat)
+	err := queue.Enqueue(&message)
+	if err != nil {
+		log.Errorf("Failed to enqueue %s %s: %v", message.Event, message.MessageID, err)
+		return true
+	}
+	if server != nil {
+		server.broadcastEvent(message.Event, message)
+	}
+	return true
+}
+
+// resolvePollOptions finds names of the selected option hashes, unknown hashes are kept without a name
+func resolvePollOptions(selected [][]byte, options []PollOption) []PollOption {
+	names := make(map[string]string, len(options))
+	for _, option := range options {
+		names[option.Hash] = option.Name
+	}
+
+	resolved := make([]PollOption, len(selected))
+	for i, hash := range selected {
+		encoded := hex.EncodeToString(hash)
+		resolved[i] = PollOption{Hash: encoded, Name: names[encoded]}
+	}
+	return resolved
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConfigHolder keeps the current config. Readers take a snapshot with Get for every event,
+// so a reload never changes the config in the middle of handling one.
+type ConfigHolder struct {
+	path     string
+	current  atomic.Pointer[Config]
+	mu       sync.Mutex
+	modTime  time.Time
+	onReload []func(old *Config, config *Config)
+	quit     chan struct{}
+}
+
+func CreateConfigHolder(path string, config *Config) *ConfigHolder {
+	holder := &ConfigHolder{path: path, quit: make(chan struct{})}
+	holder.current.Store(config)
+	if info, err := os.Stat(path); err == nil {
+		holder.modTime = info.ModTime()
+	}
+	return holder
+}
+
+// Get returns the current config
+func (h *ConfigHolder) Get() *Config {
+	return h.current.Load()
+}
+
+// OnReload registers a function that applies a reloaded config before it replaces the current one
+func (h *ConfigHolder) OnReload(apply func(old *Config, config *Config)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onReload = append(h.onReload, apply)
+}
+
+// restartSettings are the parts of the config that are only applied on startup
+func restartSettings(config *Config) map[string]interface{} {
+	return map[string]interface{}{
+		"database":           config.Database,
+		"file_storage_path":  config.FileStoragePath,
+		"encryption":         config.Encryption,
+		"queue":              config.Queue,
+		"directory":          config.Directory,
+		"retention.enabled":  config.Retention.Enabled,
+		"retention.interval": config.Retention.Interval,
+	}
+}
+
+// Reload reads the config file again and replaces the current config if it's valid.
+// Settings that are only applied on startup keep their current values until a restart.
+func (h *ConfigHolder) Reload() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if info, err := os.Stat(h.path); err == nil {
+		h.modTime = info.ModTime()
+	}
+	config, err := LoadConfig(h.path)
+	if err != nil {
+		return err
+	}
+
+	old := h.Get()
+	oldSettings, newSettings := restartSettings(old), restartSettings(config)
+	for name, value := range oldSettings {
+		if !reflect.DeepEqual(value, newSettings[name]) {
+			log.Warnf("Changes of %s are applied after a restart", name)
+		}
+	}
+	config.Database, config.FileStoragePath, config.Encryption = old.Database, old.FileStoragePath, old.Encryption
+	config.Queue, config.Directory = old.Queue, old.Directory
+	config.Retention.Enabled, config.Retention.Interval = old.Retention.Enabled, old.Retention.Interval
+	config.UseChatNames(old.chatFilter().chatName)
+
+	for _, apply := range h.onReload {
+		apply(old, config)
+	}
+	h.current.Store(config)
+	log.Infof("Reloaded configuration from %s", h.path)
+	return nil
+}
+
+// Watch reloads the config when the modification time of the file changes
+func (h *ConfigHolder) Watch(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.quit:
+				return
+			case <-ticker.C:
+				info, err := os.Stat(h.path)
+				if err != nil {
+					continue
+				}
+				h.mu.Lock()
+				changed := !info.ModTime().Equal(h.modTime)
+				h.mu.Unlock()
+				if !changed {
+					continue
+				}
+				err = h.Reload()
+				if err != nil {
+					log.Errorf("Failed to reload configuration, keeping the current one: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops watching the config file
+func (h *ConfigHolder) Stop() {
+	close(h.quit)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReloadedTrackersUseNewConfig(t *testing.T) {
+	db := newTestDB(t)
+	config := &Config{Chats: []Chat{{ID: "a@g.us"}}}
+	queue, err := CreateTrackerQueue(config, db, CreateTrackers(config, db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	message := &TrackableMessage{Event: EventMessageCreated, MessageID: "M1", Chat: "a@g.us", Content: "hi", Timestamp: sent.String()}
+	if err := findDBTracker(queue.Router().Trackers()).TrackMessage(message); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := &Config{Chats: []Chat{{ID: "a@g.us", Alias: "team"}}}
+	queue.SetRouter(ReloadTrackers(queue.Router(), reloaded, db))
+	messages, err := findDBTracker(queue.Router().Trackers()).GetMessagesByChat("a@g.us", sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].Metadata.Folder != "team" {
+		t.Errorf("messages = %+v, want M1 in the folder of the reloaded alias", messages)
+	}
+}
@@ -0,0 +1,735 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultRetentionInterval = 24 * time.Hour
+
+// RetentionReport is what a retention run deleted, or would delete in a dry run, in a chat.
+// Undated are messages and group events whose time is unknown, they are kept.
+type RetentionReport struct {
+	Chat        string
+	Messages    int
+	GroupEvents int
+	Files       int
+	Bytes       int64
+	Undated     int
+}
+
+// expiredMessage is a message past the message retention of its chat
+type expiredMessage struct {
+	ID string
+	TS int64
+}
+
+// expiredFile is an attachment past the media retention of its chat
+type expiredFile struct {
+	Attachment
+	MessageID string `json:"message_id"`
+	TS        int64  `json:"-"`
+}
+
+// retentionBatch is the expired data of a chat
+type retentionBatch struct {
+	chat        string
+	messages    []expiredMessage
+	groupEvents []int64
+	files       []expiredFile
+}
+
+// Retention deletes media and messages that are older than the retention rules of their chats
+type Retention struct {
+	db     *DB
+	mu     sync.Mutex
+	config *Config
+	csv    *CSVTracker
+	cloud  *CloudTracker
+	quit   chan struct{}
+}
+
+// CreateRetention creates the retention job, csv and cloud are the trackers whose copies are kept in sync or nil
+func CreateRetention(db *DB, config *Config, csv *CSVTracker, cloud *CloudTracker) *Retention {
+	return &Retention{
+		db:     db,
+		config: config,
+		csv:    csv,
+		cloud:  cloud,
+		quit:   make(chan struct{}),
+	}
+}
+
+// Reload applies rules of a reloaded config, it waits for a running job to finish
+func (r *Retention) Reload(config *Config, csv *CSVTracker, cloud *CloudTracker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.config = config
+	r.csv = csv
+	r.cloud = cloud
+}
+
+// Run deletes expired data, or only reports it in a dry run.
+// If an archive path is configured, the data is archived first and nothing is deleted if that fails.
+func (r *Retention) Run(dryRun bool) ([]RetentionReport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	dated, undated, err := r.readTimestamps()
+	if err != nil {
+		return nil, err
+	}
+	// A dry run doesn't write, rows without ts are dated in memory instead
+	pending := make(map[string][]datedRow)
+	if dryRun {
+		for _, row := range dated {
+			pending[row.chat] = append(pending[row.chat], row)
+		}
+	} else if err = r.backfillTimestamps(dated); err != nil {
+		return nil, err
+	}
+	chats, err := r.chats()
+	if err != nil {
+		return nil, err
+	}
+
+	var batches []*retentionBatch
+	var reports []RetentionReport
+	for _, chat := range chats {
+		rule := r.config.GetRetentionRule(chat)
+		if rule == nil {
+			continue
+		}
+		batch, err := r.collect(chat, rule, now, pending[chat])
+		if err != nil {
+			return nil, err
+		}
+		if undated[chat] > 0 {
+			log.Warnf("%d messages and group events of chat %s have no valid timestamp and are kept", undated[chat], chat)
+		}
+		if len(batch.messages) == 0 && len(batch.groupEvents) == 0 && len(batch.files) == 0 {
+			if undated[chat] > 0 {
+				reports = append(reports, RetentionReport{Chat: chat, Undated: undated[chat]})
+			}
+			continue
+		}
+		batches = append(batches, batch)
+
+		report := RetentionReport{Chat: chat, Messages: len(batch.messages), GroupEvents: len(batch.groupEvents), Files: len(batch.files),
+			Undated: undated[chat]}
+		for _, file := range batch.files {
+			report.Bytes += file.Size
+		}
+		reports = append(reports, report)
+	}
+	if dryRun || len(batches) == 0 {
+		return reports, nil
+	}
+
+	if r.config.Retention.ArchivePath != "" {
+		name, err := r.archive(batches, now)
+		if err != nil {
+			return nil, fmt.Errorf("failed to archive expired data: %w", err)
+		}
+		log.Infof("Archived expired data to %s", name)
+	}
+
+	for _, batch := range batches {
+		err = r.delete(batch)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete expired data of chat %s: %w", batch.chat, err)
+		}
+		r.removeFiles(batch)
+		if r.csv != nil {
+			r.pruneCSV(batch)
+		}
+		if r.cloud != nil {
+			r.pruneCloud(batch)
+		}
+	}
+	return reports, nil
+}
+
+// chats returns the chats that have messages or group events
+func (r *Retention) chats() ([]string, error) {
+	rows, err := r.db.Query(`SELECT chat FROM messages UNION SELECT chat FROM group_events`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chats []string
+	for rows.Next() {
+		var chat sql.NullString
+		err = rows.Scan(&chat)
+		if err != nil {
+			return nil, err
+		}
+		if chat.Valid {
+			chats = append(chats, chat.String)
+		}
+	}
+	return chats, rows.Err()
+}
+
+// datedTables are the tables whose rows expire by the ts column
+var datedTables = []string{"messages", "group_events"}
+
+// datedRow is a row stored without ts whose text timestamp can be parsed
+type datedRow struct {
+	table string
+	id    string
+	chat  string
+	ts    int64
+}
+
+// readTimestamps parses the text timestamp of rows stored without ts.
+// It returns the rows that can be dated and the number of rows that can't be dated per chat.
+func (r *Retention) readTimestamps() ([]datedRow, map[string]int, error) {
+	var dated []datedRow
+	undated := make(map[string]int)
+	for _, table := range datedTables {
+		rows, err := r.db.Query(`SELECT id, chat, timestamp FROM ` + table + ` WHERE ts IS NULL`)
+		if err != nil {
+			return nil, nil, err
+		}
+		for rows.Next() {
+			var id string
+			var chat, timestamp sql.NullString
+			err = rows.Scan(&id, &chat, &timestamp)
+			if err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+			parsed, err := parseMessageTimestamp(timestamp.String)
+			if err != nil {
+				undated[chat.String]++
+				continue
+			}
+			dated = append(dated, datedRow{table: table, id: id, chat: chat.String, ts: parsed.Unix()})
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return dated, undated, nil
+}
+
+// backfillTimestamps fills the ts column of the dated rows, so they expire like other rows
+func (r *Retention) backfillTimestamps(dated []datedRow) error {
+	backfilled := make(map[string]int)
+	for _, row := range dated {
+		_, err := r.db.Exec(`UPDATE `+row.table+` SET ts = ? WHERE id = ?`, row.ts, row.id)
+		if err != nil {
+			return err
+		}
+		backfilled[row.table]++
+	}
+	for _, table := range datedTables {
+		if backfilled[table] > 0 {
+			log.Infof("Backfilled timestamps of %d rows of %s", backfilled[table], table)
+		}
+	}
+	return nil
+}
+
+// collect finds messages, group changes and files of the chat that are past the rule.
+// Group changes expire with messages, and files of expired messages expire with them even if media are kept longer.
+// Pending are rows of the chat without ts that are dated by their text timestamp.
+func (r *Retention) collect(chat string, rule *RetentionRule, now time.Time, pending []datedRow) (*retentionBatch, error) {
+	batch := &retentionBatch{chat: chat}
+	var messagesCutoff, mediaCutoff int64
+	if rule.MessagesDays > 0 {
+		messagesCutoff = now.AddDate(0, 0, -rule.MessagesDays).Unix()
+	}
+	if rule.MediaDays > 0 {
+		mediaCutoff = now.AddDate(0, 0, -rule.MediaDays).Unix()
+	}
+	if messagesCutoff > mediaCutoff {
+		mediaCutoff = messagesCutoff
+	}
+
+	if messagesCutoff > 0 {
+		rows, err := r.db.Query(`SELECT id, ts FROM messages WHERE chat = ? AND ts < ?`, chat, messagesCutoff)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var message expiredMessage
+			err = rows.Scan(&message.ID, &message.TS)
+			if err != nil {
+				return nil, err
+			}
+			batch.messages = append(batch.messages, message)
+		}
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+		rows.Close()
+
+		rows, err = r.db.Query(`SELECT id FROM group_events WHERE chat = ? AND ts < ?`, chat, messagesCutoff)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int64
+			err = rows.Scan(&id)
+			if err != nil {
+				return nil, err
+			}
+			batch.groupEvents = append(batch.groupEvents, id)
+		}
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+		rows.Close()
+
+		for _, row := range pending {
+			if row.ts >= messagesCutoff {
+				continue
+			}
+			if row.table == "messages" {
+				batch.messages = append(batch.messages, expiredMessage{ID: row.id, TS: row.ts})
+				continue
+			}
+			id, err := strconv.ParseInt(row.id, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			batch.groupEvents = append(batch.groupEvents, id)
+		}
+	}
+
+	if mediaCutoff > 0 {
+		files, err := r.expiredFiles(`messages.chat = ? AND messages.ts < ?`, chat, mediaCutoff)
+		if err != nil {
+			return nil, err
+		}
+		batch.files = append(batch.files, files...)
+
+		for _, row := range pending {
+			if row.table != "messages" || row.ts >= mediaCutoff {
+				continue
+			}
+			files, err = r.expiredFiles(`messages.id = ?`, row.id)
+			if err != nil {
+				return nil, err
+			}
+			for i := range files {
+				files[i].TS = row.ts
+			}
+			batch.files = append(batch.files, files...)
+		}
+	}
+	return batch, nil
+}
+
+// expiredFiles returns the files of the messages that match the condition
+func (r *Retention) expiredFiles(condition string, args ...interface{}) ([]expiredFile, error) {
+	rows, err := r.db.Query(`
+		SELECT files.id, files.path, files.mime_type, files.size, files.sha256, files.file_name, files.caption, files.message_id, messages.ts
+		FROM files JOIN messages ON messages.id = files.message_id
+		WHERE `+condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []expiredFile
+	for rows.Next() {
+		var file expiredFile
+		var mimeType, hash, fileName, caption sql.NullString
+		var size, ts sql.NullInt64
+		err = rows.Scan(&file.ID, &file.Path, &mimeType, &size, &hash, &fileName, &caption, &file.MessageID, &ts)
+		if err != nil {
+			return nil, err
+		}
+		file.MimeType, file.SHA256, file.FileName, file.Caption = mimeType.String, hash.String, fileName.String, caption.String
+		file.Size, file.TS = size.Int64, ts.Int64
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
+
+// messageTables are the tables with rows of a message, in the order they are deleted
+var messageTables = []struct {
+	table  string
+	column string
+}{
+	{"poll_votes", "poll_id"},
+	{"poll_options", "poll_id"},
+	{"polls", "message_id"},
+	{"files", "message_id"},
+	{"message_annotations", "message_id"},
+	{"message_revisions", "message_id"},
+	{"mentions", "message_id"},
+	{"reactions", "message_id"},
+	{"location_tracks", "message_id"},
+	{"webhook_deliveries", "message_id"},
+	{"messages", "id"},
+}
+
+// delete removes the rows of the batch in one transaction
+func (r *Retention) delete(batch *retentionBatch) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, file := range batch.files {
+		_, err = tx.Exec(`DELETE FROM files WHERE id = ?`, file.ID)
+		if err != nil {
+			return err
+		}
+	}
+	for _, message := range batch.messages {
+		for _, table := range messageTables {
+			_, err = tx.Exec(`DELETE FROM `+table.table+` WHERE `+table.column+` = ?`, message.ID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, id := range batch.groupEvents {
+		_, err = tx.Exec(`DELETE FROM group_events WHERE id = ?`, id)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// removeFiles deletes files of the batch from disk unless other messages still reference them
+func (r *Retention) removeFiles(batch *retentionBatch) {
+	removed := make(map[string]bool)
+	for _, file := range batch.files {
+		if removed[file.Path] {
+			continue
+		}
+		removed[file.Path] = true
+
+		var references int
+		err := r.db.QueryRow(`SELECT COUNT(*) FROM files WHERE path = ?`, file.Path).Scan(&references)
+		if err != nil {
+			log.Errorf("Failed to count references to %s: %v", file.Path, err)
+			continue
+		}
+		if references > 0 {
+			continue
+		}
+		err = os.Remove(file.Path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("Failed to delete %s: %v", file.Path, err)
+			continue
+		}
+		// The folder of the date is removed once it's empty
+		os.Remove(filepath.Dir(file.Path))
+	}
+}
+
+// expiredByDate groups the expired messages and the messages with expired files of the batch by their date
+func expiredByDate(batch *retentionBatch) (dates []string, messages map[string]map[string]bool, media map[string]map[string]bool) {
+	messages = make(map[string]map[string]bool)
+	media = make(map[string]map[string]bool)
+	add := func(byDate map[string]map[string]bool, ts int64, id string) {
+		date := time.Unix(ts, 0).Format("02.01.2006")
+		if messages[date] == nil && media[date] == nil {
+			dates = append(dates, date)
+		}
+		if byDate[date] == nil {
+			byDate[date] = make(map[string]bool)
+		}
+		byDate[date][id] = true
+	}
+	for _, message := range batch.messages {
+		add(messages, message.TS, message.ID)
+	}
+	for _, file := range batch.files {
+		add(media, file.TS, file.MessageID)
+	}
+	return dates, messages, media
+}
+
+// pruneCSV removes the expired messages and file paths from CSV files
+func (r *Retention) pruneCSV(batch *retentionBatch) {
+	folder := r.config.GetChatFolder(batch.chat)
+	dates, messages, media := expiredByDate(batch)
+	for _, date := range dates {
+		err := r.csv.RemoveRecords(folder, date, messages[date], media[date])
+		if err != nil {
+			log.Errorf("Failed to remove expired records from CSV of %s/%s: %v", folder, date, err)
+		}
+	}
+}
+
+// pruneCloud removes the expired messages and file links from spreadsheets and the expired files from Google Drive.
+// A file stays on Drive while another message of the chat references it.
+func (r *Retention) pruneCloud(batch *retentionBatch) {
+	folder := r.config.GetChatFolder(batch.chat)
+	dates, messages, media := expiredByDate(batch)
+	fileNames := make(map[string][]string)
+	listed := make(map[string]bool)
+	for _, file := range batch.files {
+		date := time.Unix(file.TS, 0).Format("02.01.2006")
+		name := filepath.Base(file.Path)
+		if listed[date+"/"+name] {
+			continue
+		}
+		listed[date+"/"+name] = true
+
+		var references int
+		err := r.db.QueryRow(`SELECT COUNT(*) FROM files JOIN messages ON messages.id = files.message_id
+			WHERE files.path = ? AND messages.chat = ?`, file.Path, batch.chat).Scan(&references)
+		if err != nil {
+			log.Errorf("Failed to count references to %s: %v", file.Path, err)
+			continue
+		}
+		if references == 0 {
+			fileNames[date] = append(fileNames[date], name)
+		}
+	}
+	for _, date := range dates {
+		err := r.cloud.RemoveRecords(folder, date, batch.chat, messages[date], media[date], fileNames[date])
+		if err != nil {
+			log.Errorf("Failed to remove expired records from Google Drive of %s/%s: %v", folder, date, err)
+		}
+	}
+}
+
+// archive writes the batches to a tar.gz file before they are deleted: every row of the tables in messageTables
+// and of group_events with all its columns to <table>.jsonl, the expired files to files.jsonl and the media under files/
+func (r *Retention) archive(batches []*retentionBatch, now time.Time) (string, error) {
+	err := os.MkdirAll(r.config.Retention.ArchivePath, 0700)
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Join(r.config.Retention.ArchivePath, "whatsgo-"+now.Format("20060102-150405")+".tar.gz")
+	file, err := os.OpenFile(name+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(name + ".tmp")
+	defer file.Close()
+
+	gzipWriter := gzip.NewWriter(file)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	// Files are listed in files.jsonl, all files of expired messages expire with them
+	var tables []string
+	for _, table := range messageTables {
+		if table.table != "files" {
+			tables = append(tables, table.table)
+		}
+	}
+	tables = append(tables, "group_events", "files")
+	contents := make(map[string]*bytes.Buffer)
+	for _, table := range tables {
+		contents[table] = &bytes.Buffer{}
+	}
+
+	archived := make(map[string]bool)
+	for _, batch := range batches {
+		for _, message := range batch.messages {
+			for _, table := range messageTables {
+				if table.table == "files" {
+					continue
+				}
+				err = r.archiveRows(contents[table.table], `SELECT * FROM `+table.table+` WHERE `+table.column+` = ?`, message.ID)
+				if err != nil {
+					return "", err
+				}
+			}
+		}
+		for _, id := range batch.groupEvents {
+			err = r.archiveRows(contents["group_events"], `SELECT * FROM group_events WHERE id = ?`, id)
+			if err != nil {
+				return "", err
+			}
+		}
+		filesEncoder := json.NewEncoder(contents["files"])
+		for _, expired := range batch.files {
+			err = filesEncoder.Encode(expired)
+			if err != nil {
+				return "", err
+			}
+			if archived[expired.Path] {
+				continue
+			}
+			archived[expired.Path] = true
+			err = addFileToArchive(tarWriter, expired.Path)
+			if os.IsNotExist(err) {
+				log.Warnf("Expired file %s doesn't exist, it's not archived", expired.Path)
+				continue
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	for _, table := range tables {
+		content := contents[table].Bytes()
+		err = tarWriter.WriteHeader(&tar.Header{Name: table + ".jsonl", Mode: 0600, Size: int64(len(content)), ModTime: now})
+		if err != nil {
+			return "", err
+		}
+		_, err = tarWriter.Write(content)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err = tarWriter.Close(); err != nil {
+		return "", err
+	}
+	if err = gzipWriter.Close(); err != nil {
+		return "", err
+	}
+	if err = file.Close(); err != nil {
+		return "", err
+	}
+	return name, os.Rename(name+".tmp", name)
+}
+
+// archiveRows writes the rows of the query as JSON objects keyed by column
+func (r *Retention) archiveRows(content *bytes.Buffer, query string, args ...interface{}) error {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(content)
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		err = rows.Scan(pointers...)
+		if err != nil {
+			return err
+		}
+		row := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			// Text comes as bytes from some drivers
+			if value, ok := values[i].([]byte); ok {
+				values[i] = string(value)
+			}
+			row[column] = values[i]
+		}
+		err = encoder.Encode(row)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// addFileToArchive adds the file under files/ keeping its path relative to the working directory
+func addFileToArchive(tarWriter *tar.Writer, path string) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+
+	entry := filepath.ToSlash(filepath.Clean(path))
+	for strings.HasPrefix(entry, "../") {
+		entry = strings.TrimPrefix(entry, "../")
+	}
+	err = tarWriter.WriteHeader(&tar.Header{Name: "files/" + strings.TrimPrefix(entry, "/"), Mode: 0600, Size: info.Size(), ModTime: info.ModTime()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tarWriter, source)
+	return err
+}
+
+// Start enforces retention now and then periodically
+func (r *Retention) Start(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultRetentionInterval
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			reports, err := r.Run(false)
+			if err != nil {
+				log.Errorf("Failed to enforce retention: %v", err)
+			}
+			for _, report := range reports {
+				log.Infof("Retention deleted %d messages, %d group events and %d files (%d bytes) of chat %s",
+					report.Messages, report.GroupEvents, report.Files, report.Bytes, report.Chat)
+			}
+			select {
+			case <-r.quit:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops the periodic enforcement
+func (r *Retention) Stop() {
+	close(r.quit)
+}
+
+// runRetentionCommand handles `whatsgo retention report|run`
+func runRetentionCommand(retention *Retention, command string) error {
+	var dryRun bool
+	switch command {
+	case "report":
+		dryRun = true
+	case "run":
+	default:
+		return fmt.Errorf("usage: whatsgo retention report|run")
+	}
+
+	reports, err := retention.Run(dryRun)
+	if err != nil {
+		return err
+	}
+	verb := "Deleted"
+	if dryRun {
+		verb = "Would delete"
+	}
+	var total RetentionReport
+	for _, report := range reports {
+		log.Infof("%s: %s %d messages, %d group events and %d files (%d bytes), %d undated kept",
+			report.Chat, strings.ToLower(verb), report.Messages, report.GroupEvents, report.Files, report.Bytes, report.Undated)
+		total.Messages += report.Messages
+		total.GroupEvents += report.GroupEvents
+		total.Files += report.Files
+		total.Bytes += report.Bytes
+		total.Undated += report.Undated
+	}
+	log.Infof("%s %d messages, %d group events and %d files (%d bytes) in %d chats, %d undated kept",
+		verb, total.Messages, total.GroupEvents, total.Files, total.Bytes, len(reports), total.Undated)
+	return nil
+}
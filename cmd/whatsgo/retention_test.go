@@ -0,0 +1,318 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
+)
+
+func TestRetentionRun(t *testing.T) {
+	db := newTestDB(t)
+	dir := t.TempDir()
+	config := &Config{
+		FileStoragePath: filepath.Join(dir, "files"),
+		Retention: RetentionConfig{ArchivePath: filepath.Join(dir, "archive"), Rules: []RetentionRule{
+			{Chats: []string{"keep@g.us"}},
+			{MediaDays: 10, MessagesDays: 30},
+		}},
+	}
+	tracker := &DBTracker{db: db}
+	tracker.Init(config)
+
+	now := time.Now().Round(0)
+	old, recent := now.AddDate(0, 0, -40), now.AddDate(0, 0, -20)
+	mediaPath := filepath.Join(dir, "files", "photo.jpg")
+	os.MkdirAll(filepath.Dir(mediaPath), 0700)
+	os.WriteFile(mediaPath, []byte("jpeg"), 0600)
+	messages := []TrackableMessage{
+		{Event: EventMessageCreated, MessageID: "OLD", Chat: "a@g.us", Sender: "1@s.whatsapp.net", Content: "old", Timestamp: old.String(),
+			Metadata: MessageMetadata{Timestamp: old}, Context: &MessageContext{QuotedMessageID: "Q"}},
+		{Event: EventReaction, MessageID: "R", Chat: "a@g.us", Sender: "2@s.whatsapp.net", Timestamp: old.String(),
+			Metadata: MessageMetadata{Timestamp: old}, Reaction: &Reaction{MessageID: "OLD", Emoji: "👍"}},
+		{Event: EventMessageCreated, MessageID: "MEDIA", Chat: "a@g.us", Sender: "1@s.whatsapp.net", Timestamp: recent.String(),
+			Metadata: MessageMetadata{Timestamp: recent}, Files: []Attachment{{ID: "F", Path: mediaPath, Size: 4}}},
+		{Event: EventMessageCreated, MessageID: "KEPT", Chat: "keep@g.us", Sender: "1@s.whatsapp.net", Timestamp: old.String(),
+			Metadata: MessageMetadata{Timestamp: old}},
+		{Event: EventGroupChange, MessageID: "G", Chat: "events-only@g.us", Timestamp: old.String(),
+			Metadata: MessageMetadata{Timestamp: old}, GroupChange: &GroupChange{Type: GroupChangeSubject, Value: "Team"}},
+	}
+	for i := range messages {
+		if err := tracker.TrackMessage(&messages[i]); err != nil {
+			t.Fatalf("TrackMessage(%s) error = %v", messages[i].MessageID, err)
+		}
+	}
+	// Rows stored without ts are dated by their text timestamp, or kept if it can't be parsed
+	mustExec(t, db, `INSERT INTO messages (id, chat, sender, timestamp) VALUES (?, ?, ?, ?)`, "NOTS", "a@g.us", "1@s.whatsapp.net", old.String())
+	mustExec(t, db, `INSERT INTO messages (id, chat, sender, timestamp) VALUES (?, ?, ?, ?)`, "UNDATED", "a@g.us", "1@s.whatsapp.net", "yesterday")
+
+	retention := CreateRetention(db, config, nil, nil)
+	reports, err := retention.Run(true)
+	if err != nil {
+		t.Fatalf("Run(true) error = %v", err)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Chat < reports[j].Chat })
+	want := []RetentionReport{
+		{Chat: "a@g.us", Messages: 2, Files: 1, Bytes: 4, Undated: 1},
+		{Chat: "events-only@g.us", GroupEvents: 1},
+	}
+	if len(reports) != len(want) {
+		t.Fatalf("Run(true) = %+v, want %+v", reports, want)
+	}
+	for i := range want {
+		if reports[i] != want[i] {
+			t.Errorf("Run(true)[%d] = %+v, want %+v", i, reports[i], want[i])
+		}
+	}
+	if count := countRows(t, db, `SELECT COUNT(*) FROM messages`); count != 5 {
+		t.Errorf("dry run left %d messages, want 5", count)
+	}
+	if count := countRows(t, db, `SELECT COUNT(*) FROM messages WHERE ts IS NULL`); count != 2 {
+		t.Errorf("dry run left %d messages without ts, want 2", count)
+	}
+
+	if _, err = retention.Run(false); err != nil {
+		t.Fatalf("Run(false) error = %v", err)
+	}
+	for query, want := range map[string]int{
+		`SELECT COUNT(*) FROM messages WHERE id IN ('OLD', 'NOTS')`:              0,
+		`SELECT COUNT(*) FROM messages WHERE id IN ('MEDIA', 'KEPT', 'UNDATED')`: 3,
+		`SELECT COUNT(*) FROM reactions`:                                         0,
+		`SELECT COUNT(*) FROM files`:                                             0,
+		`SELECT COUNT(*) FROM group_events`:                                      0,
+	} {
+		if count := countRows(t, db, query); count != want {
+			t.Errorf("%s = %d, want %d", query, count, want)
+		}
+	}
+	if _, err := os.Stat(mediaPath); !os.IsNotExist(err) {
+		t.Errorf("expired media %s wasn't removed", mediaPath)
+	}
+
+	archives, _ := filepath.Glob(filepath.Join(dir, "archive", "*.tar.gz"))
+	if len(archives) != 1 {
+		t.Fatalf("found archives %v, want one", archives)
+	}
+	for name, want := range map[string]os.FileMode{filepath.Join(dir, "archive"): 0700, archives[0]: 0600} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != want {
+			t.Errorf("%s has mode %v, want %v", name, info.Mode().Perm(), want)
+		}
+	}
+	entries := readArchive(t, archives[0])
+	for name, want := range map[string]string{
+		"messages.jsonl":     `"quoted_message_id":"Q"`,
+		"reactions.jsonl":    `"emoji":"👍"`,
+		"group_events.jsonl": `"value":"Team"`,
+		"files.jsonl":        `"message_id":"MEDIA"`,
+	} {
+		if !strings.Contains(entries[name], want) {
+			t.Errorf("%s = %q, want it to contain %s", name, entries[name], want)
+		}
+	}
+	if !strings.Contains(entries["messages.jsonl"], `"id":"NOTS"`) {
+		t.Errorf("messages.jsonl = %q, want the message without ts", entries["messages.jsonl"])
+	}
+	for _, table := range messageTables {
+		if _, ok := entries[table.table+".jsonl"]; !ok {
+			t.Errorf("archive has no %s.jsonl", table.table)
+		}
+	}
+	if entries["files/"+strings.TrimPrefix(filepath.ToSlash(mediaPath), "/")] != "jpeg" {
+		t.Errorf("archive has no media, entries: %v", entries)
+	}
+}
+
+// fakeDrive serves the Drive and Sheets calls of retention from files and spreadsheet rows in memory
+type fakeDrive struct {
+	mu     sync.Mutex
+	files  map[string][2]string // ID to name and parent
+	sheets map[string][][]interface{}
+}
+
+func (f *fakeDrive) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := r.URL.Path
+	switch {
+	case r.Method == "GET" && path == "/drive/v3/files":
+		query := regexp.MustCompile(`name='(.*)' and '(.*)' in parents`).FindStringSubmatch(r.URL.Query().Get("q"))
+		var files []*drive.File
+		for id, file := range f.files {
+			if file[0] == query[1] && file[1] == query[2] {
+				files = append(files, &drive.File{Id: id, Name: file[0]})
+			}
+		}
+		json.NewEncoder(w).Encode(&drive.FileList{Files: files})
+	case r.Method == "DELETE" && strings.HasPrefix(path, "/drive/v3/files/"):
+		id := strings.TrimPrefix(path, "/drive/v3/files/")
+		delete(f.files, id)
+		delete(f.sheets, id)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "GET" && strings.Contains(path, "/values/"):
+		id := strings.TrimPrefix(path[:strings.Index(path, "/values/")], "/v4/spreadsheets/")
+		json.NewEncoder(w).Encode(&sheets.ValueRange{Values: f.sheets[id]})
+	case r.Method == "GET":
+		id := strings.TrimPrefix(path, "/v4/spreadsheets/")
+		json.NewEncoder(w).Encode(&sheets.Spreadsheet{SpreadsheetId: id,
+			Sheets: []*sheets.Sheet{{Properties: &sheets.SheetProperties{SheetId: 0, Title: "Sheet1"}}}})
+	case strings.HasSuffix(path, "/values:batchClear"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/v4/spreadsheets/"), "/values:batchClear")
+		var request sheets.BatchClearValuesRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		for _, cleared := range request.Ranges {
+			var row int
+			fmt.Sscanf(cleared, "'Sheet1'!G%d:", &row)
+			f.sheets[id][row-1] = f.sheets[id][row-1][:6]
+		}
+		json.NewEncoder(w).Encode(&sheets.BatchClearValuesResponse{})
+	case strings.HasSuffix(path, ":batchUpdate"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/v4/spreadsheets/"), ":batchUpdate")
+		var request sheets.BatchUpdateSpreadsheetRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		for _, update := range request.Requests {
+			index := update.DeleteDimension.Range.StartIndex
+			f.sheets[id] = append(f.sheets[id][:index], f.sheets[id][index+1:]...)
+		}
+		json.NewEncoder(w).Encode(&sheets.BatchUpdateSpreadsheetResponse{})
+	default:
+		http.Error(w, "unexpected request "+r.Method+" "+path, http.StatusBadRequest)
+	}
+}
+
+func TestRetentionPrunesGoogleDrive(t *testing.T) {
+	db := newTestDB(t)
+	dir := t.TempDir()
+	config := &Config{
+		FileStoragePath: filepath.Join(dir, "files"),
+		Retention:       RetentionConfig{Rules: []RetentionRule{{MediaDays: 10, MessagesDays: 30}}},
+	}
+	tracker := &DBTracker{db: db}
+	tracker.Init(config)
+
+	now := time.Now().Round(0)
+	old, recent := now.AddDate(0, 0, -40), now.AddDate(0, 0, -20)
+	oldPath, recentPath := filepath.Join(dir, "files", "old.jpg"), filepath.Join(dir, "files", "recent.jpg")
+	messages := []TrackableMessage{
+		{Event: EventMessageCreated, MessageID: "OLD", Chat: "a@g.us", Sender: "1@s.whatsapp.net", Timestamp: old.String(),
+			Metadata: MessageMetadata{Timestamp: old}, Files: []Attachment{{ID: "F1", Path: oldPath, Size: 4}}},
+		{Event: EventMessageCreated, MessageID: "MEDIA", Chat: "a@g.us", Sender: "1@s.whatsapp.net", Timestamp: recent.String(),
+			Metadata: MessageMetadata{Timestamp: recent}, Files: []Attachment{{ID: "F2", Path: recentPath, Size: 4}}},
+	}
+	for i := range messages {
+		if err := tracker.TrackMessage(&messages[i]); err != nil {
+			t.Fatalf("TrackMessage(%s) error = %v", messages[i].MessageID, err)
+		}
+	}
+
+	oldDate, recentDate := old.Format("02.01.2006"), recent.Format("02.01.2006")
+	link := func(id string) []interface{} {
+		return []interface{}{"=IMAGE(\"https://drive.google.com/uc?id=" + id + "\")", "https://drive.google.com/uc?id=" + id}
+	}
+	fake := &fakeDrive{
+		files: map[string][2]string{
+			"chat": {"a@g.us", "root"}, "old": {oldDate, "chat"}, "recent": {recentDate, "chat"},
+			"old-sheet": {"a@g.us", "old"}, "old-file": {"old.jpg", "old"},
+			"recent-sheet": {"a@g.us", "recent"}, "recent-file": {"recent.jpg", "recent"},
+		},
+		sheets: map[string][][]interface{}{
+			"old-sheet": {
+				append([]interface{}{"OLD", "10:00:00", "1@s.whatsapp.net", "", "", ""}, link("old-file")...),
+				{"OTHER", "11:00:00", "1@s.whatsapp.net", "not stored", "", ""},
+			},
+			"recent-sheet": {append([]interface{}{"MEDIA", "10:00:00", "1@s.whatsapp.net", "", "", ""}, link("recent-file")...)},
+		},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	ctx := context.Background()
+	driveService, err := drive.NewService(ctx, option.WithEndpoint(server.URL+"/drive/v3/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sheetsService, err := sheets.NewService(ctx, option.WithEndpoint(server.URL+"/"), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloud := &CloudTracker{driveService: driveService, sheetsService: sheetsService, folderID: "root"}
+
+	if _, err = CreateRetention(db, config, nil, cloud).Run(false); err != nil {
+		t.Fatalf("Run(false) error = %v", err)
+	}
+	for _, id := range []string{"old-file", "recent-file"} {
+		if _, ok := fake.files[id]; ok {
+			t.Errorf("expired file %s is still on Drive", id)
+		}
+	}
+	if rows := fake.sheets["old-sheet"]; len(rows) != 1 || rows[0][0] != "OTHER" {
+		t.Errorf("rows of the old spreadsheet = %v, want only OTHER", rows)
+	}
+	if rows := fake.sheets["recent-sheet"]; len(rows) != 1 || len(rows[0]) != 6 {
+		t.Errorf("rows of the recent spreadsheet = %v, want MEDIA without file links", rows)
+	}
+}
+
+func TestGetRetentionRule(t *testing.T) {
+	config := &Config{
+		Chats: []Chat{{ID: "aliased@g.us", Alias: "Team"}},
+		Retention: RetentionConfig{Rules: []RetentionRule{
+			{MediaDays: 30},
+			{Chats: []string{"a@g.us"}, MediaDays: 90},
+			{Chats: []string{"Team"}, MediaDays: 60},
+			{MediaDays: 10},
+		}},
+	}
+	for chat, want := range map[string]int{"a@g.us": 90, "aliased@g.us": 60, "other@g.us": 30} {
+		if rule := config.GetRetentionRule(chat); rule == nil || rule.MediaDays != want {
+			t.Errorf("GetRetentionRule(%s) = %+v, want the rule of %d days", chat, rule, want)
+		}
+	}
+	config.Retention.Rules = config.Retention.Rules[1:3]
+	if rule := config.GetRetentionRule("other@g.us"); rule != nil {
+		t.Errorf("GetRetentionRule(other@g.us) = %+v, want nil", rule)
+	}
+}
+
+func readArchive(t *testing.T, name string) map[string]string {
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]string)
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(tarReader)
+		entries[header.Name] = string(content)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"strings"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Types of messages that routes can match
+const (
+	MessageTypeText        = "text"
+	MessageTypeImage       = "image"
+	MessageTypeVideo       = "video"
+	MessageTypeAudio       = "audio"
+	MessageTypeDocument    = "document"
+	MessageTypeLocation    = "location"
+	MessageTypePoll        = "poll"
+	MessageTypeReaction    = "reaction"
+	MessageTypePollVote    = "poll_vote"
+	MessageTypeGroupChange = "group_change"
+	MessageTypeConnection  = "connection"
+)
+
+var messageTypes = []string{MessageTypeText, MessageTypeImage, MessageTypeVideo, MessageTypeAudio, MessageTypeDocument,
+	MessageTypeLocation, MessageTypePoll, MessageTypeReaction, MessageTypePollVote, MessageTypeGroupChange, MessageTypeConnection}
+
+// Router decides which trackers receive a message. A tracker without routes receives every tracked message,
+// a tracker with routes receives the messages that match at least one of them.
+type Router struct {
+	config   *Config
+	trackers []Tracker
+	routes   map[string][]Route
+}
+
+func CreateRouter(config *Config, trackers []Tracker) *Router {
+	router := &Router{
+		config:   config,
+		trackers: trackers,
+		routes:   make(map[string][]Route),
+	}
+	// A route for `webhook` applies to every webhook target, `webhook:<name>` to one of them
+	for _, route := range config.Routes {
+		matched := false
+		for _, tracker := range trackers {
+			if tracker.Name() == route.Tracker || strings.HasPrefix(tracker.Name(), route.Tracker+":") {
+				router.routes[tracker.Name()] = append(router.routes[tracker.Name()], route)
+				matched = true
+			}
+		}
+		if !matched {
+			log.Warnf("Route for tracker %q is ignored, the tracker isn't enabled", route.Tracker)
+		}
+	}
+	return router
+}
+
+// Trackers returns all enabled trackers
+func (r *Router) Trackers() []Tracker {
+	return r.trackers
+}
+
+func (r *Router) findTracker(name string) Tracker {
+	for _, tracker := range r.trackers {
+		if tracker.Name() == name {
+			return tracker
+		}
+	}
+	return nil
+}
+
+// Route returns the trackers that receive the message
+func (r *Router) Route(message *TrackableMessage) []Tracker {
+	var trackers []Tracker
+	for _, tracker := range r.trackers {
+		routes, ok := r.routes[tracker.Name()]
+		if !ok {
+			trackers = append(trackers, tracker)
+			continue
+		}
+		for _, route := range routes {
+			if r.matches(route, message) {
+				trackers = append(trackers, tracker)
+				break
+			}
+		}
+	}
+	return trackers
+}
+
+// matches reports whether the message satisfies all conditions of the route
+func (r *Router) matches(route Route, message *TrackableMessage) bool {
+	if len(route.Chats) > 0 && !containsString(route.Chats, message.Chat) &&
+		!containsString(route.Chats, r.config.GetChatFolder(message.Chat)) {
+		return false
+	}
+	if len(route.Senders) > 0 && !matchesSender(route.Senders, message.Sender) {
+		return false
+	}
+	// Changes are routed like the message they change, the type and keywords of an unknown message can't be checked
+	if message.Event == EventMessageEdited || message.Event == EventMessageRevoked {
+		if message.Original == nil {
+			return true
+		}
+		message = message.Original
+	}
+	if len(route.Types) > 0 && !containsString(route.Types, messageType(message)) {
+		return false
+	}
+	if len(route.Keywords) > 0 && !containsKeyword(message, route.Keywords) {
+		return false
+	}
+	return true
+}
+
+// matchesSender compares the sender by JID or by phone number
+func matchesSender(senders []string, sender string) bool {
+	user := sender
+	if jid, err := types.ParseJID(sender); err == nil {
+		user = jid.User
+	}
+	for _, allowed := range senders {
+		allowed = strings.TrimPrefix(allowed, "+")
+		if allowed == sender || allowed == user {
+			return true
+		}
+	}
+	return false
+}
+
+// messageType returns the type of the message, media messages are typed by their first file
+func messageType(message *TrackableMessage) string {
+	switch message.Event {
+	case EventReaction:
+		return MessageTypeReaction
+	case EventPollVote:
+		return MessageTypePollVote
+	case EventGroupChange:
+		return MessageTypeGroupChange
+	case EventConnection:
+		return MessageTypeConnection
+	}
+	switch {
+	case message.Poll != nil:
+		return MessageTypePoll
+	case message.Location != nil:
+		return MessageTypeLocation
+	case len(message.Files) > 0:
+		mimeType := message.Files[0].MimeType
+		switch {
+		case strings.HasPrefix(mimeType, "image/"):
+			return MessageTypeImage
+		case strings.HasPrefix(mimeType, "video/"):
+			return MessageTypeVideo
+		case strings.HasPrefix(mimeType, "audio/"):
+			return MessageTypeAudio
+		}
+		return MessageTypeDocument
+	}
+	return MessageTypeText
+}
+
+// containsKeyword reports whether the text, recognized text or a caption of the message contains a keyword, ignoring case
+func containsKeyword(message *TrackableMessage, keywords []string) bool {
+	texts := []string{message.Content, message.ParsedContent}
+	for _, file := range message.Files {
+		texts = append(texts, file.Caption)
+	}
+	text := strings.ToLower(strings.Join(texts, "\n"))
+	for _, keyword := range keywords {
+		if keyword != "" && strings.Contains(text, strings.ToLower(keyword)) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRouteChangesLikeTheirMessage(t *testing.T) {
+	db := newTestDB(t)
+	config := &Config{Routes: []Route{
+		{Tracker: "polls", Types: []string{MessageTypePoll}},
+		{Tracker: "urgent", Keywords: []string{"urgent"}},
+	}}
+	dbTracker := &DBTracker{db: db}
+	dbTracker.Init(config)
+	queue := newTestQueue(t, db, config, &testTracker{name: "polls"}, &testTracker{name: "urgent"})
+
+	now := time.Now()
+	for _, message := range []TrackableMessage{
+		{Event: EventMessageCreated, MessageID: "POLL", Chat: "a@g.us", Sender: "1@s.whatsapp.net", Timestamp: now.String(),
+			Metadata: MessageMetadata{Timestamp: now}, Poll: &Poll{Question: "Lunch?", Options: []PollOption{{Hash: "h", Name: "Yes"}}}},
+		{Event: EventMessageCreated, MessageID: "TEXT", Chat: "a@g.us", Sender: "1@s.whatsapp.net", Content: "Urgent: call me",
+			Timestamp: now.String(), Metadata: MessageMetadata{Timestamp: now}},
+	} {
+		if err := dbTracker.TrackMessage(&message); err != nil {
+			t.Fatalf("TrackMessage(%s) error = %v", message.MessageID, err)
+		}
+	}
+
+	chat, sender := types.NewJID("a", types.GroupServer), types.NewJID("1", types.DefaultUserServer)
+	change := func(changeType waProto.ProtocolMessage_Type, messageID string) {
+		evt := &events.Message{Info: types.MessageInfo{MessageSource: types.MessageSource{Chat: chat, Sender: sender},
+			ID: "CHANGE-" + messageID, Timestamp: now}}
+		protocol := &waProto.ProtocolMessage{Type: changeType.Enum(), Key: &waProto.MessageKey{ID: proto.String(messageID)}}
+		if changeType == waProto.ProtocolMessage_MESSAGE_EDIT {
+			protocol.EditedMessage = &waProto.Message{Conversation: proto.String("never mind")}
+		}
+		trackMessageChange(evt, protocol, queue, dbTracker, config)
+	}
+	change(waProto.ProtocolMessage_MESSAGE_EDIT, "TEXT")
+	change(waProto.ProtocolMessage_REVOKE, "POLL")
+	change(waProto.ProtocolMessage_MESSAGE_EDIT, "UNKNOWN")
+
+	for query, want := range map[string]int{
+		`SELECT COUNT(*) FROM tracker_queue WHERE message_id = 'TEXT' AND tracker = 'urgent'`: 1,
+		`SELECT COUNT(*) FROM tracker_queue WHERE message_id = 'TEXT' AND tracker = 'polls'`:  0,
+		`SELECT COUNT(*) FROM tracker_queue WHERE message_id = 'POLL' AND tracker = 'polls'`:  1,
+		`SELECT COUNT(*) FROM tracker_queue WHERE message_id = 'POLL' AND tracker = 'urgent'`: 0,
+		`SELECT COUNT(*) FROM tracker_queue WHERE message_id = 'UNKNOWN'`:                     2,
+	} {
+		if count := countRows(t, db, query); count != want {
+			t.Errorf("%s = %d, want %d", query, count, want)
+		}
+	}
+}
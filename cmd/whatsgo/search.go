@@ -0,0 +1,226 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// searchSnippetWords is the number of words in snippets of messages that are matched without the index
+const searchSnippetWords = 12
+
+// SearchTerm is a word or a quoted phrase of a full-text query.
+// A term with a trailing `*` matches words that start with its last word.
+type SearchTerm struct {
+	Words  []string
+	Prefix bool
+}
+
+// SearchFilter is a full-text query with optional chat and paging
+type SearchFilter struct {
+	Terms  []SearchTerm
+	Chat   string
+	Limit  int
+	Offset int
+}
+
+// ParseSearchQuery splits a query like `"exact phrase" word prefix*` into terms that all must match
+func ParseSearchQuery(query string) []SearchTerm {
+	var terms []SearchTerm
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+
+		var text string
+		if runes[i] == '"' {
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			text = string(runes[i+1 : end])
+			i = end + 1
+		} else {
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && runes[end] != '"' {
+				end++
+			}
+			text = string(runes[i:end])
+			i = end
+		}
+
+		prefix := strings.HasSuffix(text, "*")
+		if i < len(runes) && runes[i] == '*' {
+			prefix = true
+			i++
+		}
+
+		var words []string
+		for _, word := range strings.Fields(strings.TrimRight(text, "*")) {
+			if strings.IndexFunc(word, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) >= 0 {
+				words = append(words, word)
+			}
+		}
+		if len(words) > 0 {
+			terms = append(terms, SearchTerm{Words: words, Prefix: prefix})
+		}
+	}
+	return terms
+}
+
+// fts5Query formats terms as an FTS5 MATCH expression
+func fts5Query(terms []SearchTerm) string {
+	var parts []string
+	for _, term := range terms {
+		part := `"` + strings.ReplaceAll(strings.Join(term.Words, " "), `"`, `""`) + `"`
+		if term.Prefix {
+			part += "*"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " ")
+}
+
+// tsQuery formats terms as a PostgreSQL tsquery, the weights limit matches to the weighted parts of the vector
+func tsQuery(terms []SearchTerm, weights string) string {
+	var parts []string
+	for _, term := range terms {
+		var words []string
+		for i, word := range term.Words {
+			word = strings.NewReplacer(`\`, `\\`, `'`, `''`).Replace(word)
+			lexeme := "'" + word + "'"
+			if term.Prefix && i == len(term.Words)-1 {
+				lexeme += ":*" + weights
+			} else if weights != "" {
+				lexeme += ":" + weights
+			}
+			words = append(words, lexeme)
+		}
+		parts = append(parts, "("+strings.Join(words, " <-> ")+")")
+	}
+	return strings.Join(parts, " & ")
+}
+
+// foldSearchText lowercases the text and removes diacritics like the tokenizer of the SQLite index
+func foldSearchText(text string) string {
+	var builder strings.Builder
+	for _, r := range norm.NFD.String(text) {
+		if !unicode.Is(unicode.Mn, r) {
+			builder.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return builder.String()
+}
+
+// searchWords splits the text into folded words
+func searchWords(text string) []string {
+	return strings.FieldsFunc(foldSearchText(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// matchSearchTerm returns the position of the first match of the term in the words or -1
+func matchSearchTerm(term SearchTerm, words []string) int {
+	phrase := searchWords(strings.Join(term.Words, " "))
+	if len(phrase) == 0 {
+		return -1
+	}
+	for i := 0; i+len(phrase) <= len(words); i++ {
+		matched := true
+		for j, word := range phrase {
+			if words[i+j] != word && !(term.Prefix && j == len(phrase)-1 && strings.HasPrefix(words[i+j], word)) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return i
+		}
+	}
+	return -1
+}
+
+// matchSearchTerms tells if every term is found in one of the texts, the same way the index matches them
+func matchSearchTerms(terms []SearchTerm, texts ...string) bool {
+	words := make([][]string, len(texts))
+	for i, text := range texts {
+		words[i] = searchWords(text)
+	}
+	for _, term := range terms {
+		found := false
+		for _, textWords := range words {
+			if matchSearchTerm(term, textWords) >= 0 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// searchSnippet returns the words around the first match in the texts with matched words wrapped in `<b></b>`
+func searchSnippet(terms []SearchTerm, texts ...string) string {
+	for _, text := range texts {
+		fields := strings.Fields(text)
+		highlighted := make([]bool, len(fields))
+		first := -1
+		for i, field := range fields {
+			for _, word := range searchWords(field) {
+				if isSearchWord(terms, word) {
+					highlighted[i] = true
+				}
+			}
+			if highlighted[i] && first < 0 {
+				first = i
+			}
+		}
+		if first < 0 {
+			continue
+		}
+
+		start := first - searchSnippetWords/4
+		if start < 0 {
+			start = 0
+		}
+		end := start + searchSnippetWords
+		if end > len(fields) {
+			end = len(fields)
+		}
+		parts := make([]string, 0, end-start)
+		for i := start; i < end; i++ {
+			if highlighted[i] {
+				parts = append(parts, "<b>"+fields[i]+"</b>")
+			} else {
+				parts = append(parts, fields[i])
+			}
+		}
+		snippet := strings.Join(parts, " ")
+		if start > 0 {
+			snippet = "…" + snippet
+		}
+		if end < len(fields) {
+			snippet += "…"
+		}
+		return snippet
+	}
+	return ""
+}
+
+// isSearchWord tells if the folded word is one of the words of the terms
+func isSearchWord(terms []SearchTerm, word string) bool {
+	for _, term := range terms {
+		phrase := searchWords(strings.Join(term.Words, " "))
+		for i, termWord := range phrase {
+			if word == termWord || term.Prefix && i == len(phrase)-1 && strings.HasPrefix(word, termWord) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// sqliteSearchIndex is the FTS5 index of message content, OCR text and attachment captions,
+// the triggers keep it in sync with messages and files
+const sqliteSearchIndex = `
+CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(
+	content,
+	parsed_content,
+	captions,
+	tokenize = 'unicode61 remove_diacritics 2'
+);
+
+DELETE FROM messages_fts;
+
+INSERT INTO messages_fts (rowid, content, parsed_content, captions)
+SELECT rowid, coalesce(content, ''), coalesce(parsed_content, ''),
+	coalesce((SELECT group_concat(caption, ' ') FROM files WHERE message_id = messages.id), '')
+FROM messages;
+
+CREATE TRIGGER messages_fts_insert AFTER INSERT ON messages BEGIN
+	INSERT INTO messages_fts (rowid, content, parsed_content, captions)
+	VALUES (new.rowid, coalesce(new.content, ''), coalesce(new.parsed_content, ''),
+		coalesce((SELECT group_concat(caption, ' ') FROM files WHERE message_id = new.id), ''));
+END;
+
+CREATE TRIGGER messages_fts_update AFTER UPDATE OF content, parsed_content ON messages BEGIN
+	UPDATE messages_fts SET content = coalesce(new.content, ''), parsed_content = coalesce(new.parsed_content, '')
+	WHERE rowid = new.rowid;
+END;
+
+CREATE TRIGGER messages_fts_delete AFTER DELETE ON messages BEGIN
+	DELETE FROM messages_fts WHERE rowid = old.rowid;
+END;
+
+CREATE TRIGGER files_fts_insert AFTER INSERT ON files BEGIN
+	UPDATE messages_fts
+	SET captions = coalesce((SELECT group_concat(caption, ' ') FROM files WHERE message_id = new.message_id), '')
+	WHERE rowid = (SELECT rowid FROM messages WHERE id = new.message_id);
+END;
+
+CREATE TRIGGER files_fts_update AFTER UPDATE OF caption ON files BEGIN
+	UPDATE messages_fts
+	SET captions = coalesce((SELECT group_concat(caption, ' ') FROM files WHERE message_id = new.message_id), '')
+	WHERE rowid = (SELECT rowid FROM messages WHERE id = new.message_id);
+END;
+
+CREATE TRIGGER files_fts_delete AFTER DELETE ON files BEGIN
+	UPDATE messages_fts
+	SET captions = coalesce((SELECT group_concat(caption, ' ') FROM files WHERE message_id = old.message_id), '')
+	WHERE rowid = (SELECT rowid FROM messages WHERE id = old.message_id);
+END;
+`
+
+// sqliteSearchTriggers are the triggers that keep messages_fts in sync
+var sqliteSearchTriggers = []string{"messages_fts_insert", "messages_fts_update", "messages_fts_delete",
+	"files_fts_insert", "files_fts_update", "files_fts_delete"}
+
+// hasFTS5 tells if SQLite is built with FTS5
+func hasFTS5(db *sql.DB) bool {
+	var used bool
+	err := db.QueryRow(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&used)
+	return err == nil && used
+}
+
+// syncSearchIndex builds the FTS5 index of a SQLite database when SQLite has FTS5 and the index is missing
+// or was detached. Without FTS5 it detaches the index, so writes don't fail on the missing module,
+// and the index is rebuilt when a binary with FTS5 opens the database again.
+func syncSearchIndex(db *DB) error {
+	if db.Dialect.Name() != "sqlite3" {
+		return nil
+	}
+	var triggers int
+	err := db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'trigger' AND name IN (?`+
+		strings.Repeat(", ?", len(sqliteSearchTriggers)-1)+`)`, stringArgs(sqliteSearchTriggers)...).Scan(&triggers)
+	if err != nil {
+		return err
+	}
+	if !db.Dialect.FullTextSearch() {
+		log.Warnf("SQLite is built without FTS5, search scans messages instead of the index (build whatsgo with `-tags sqlite_fts5`)")
+		if triggers == 0 {
+			return nil
+		}
+		log.Warnf("Detaching the full-text search index, it's rebuilt when whatsgo with FTS5 opens the database")
+		return dropSearchTriggers(db)
+	}
+	if triggers == len(sqliteSearchTriggers) {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err = dropSearchTriggers(tx); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(sqliteSearchIndex); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	log.Infof("Built the full-text search index")
+	return nil
+}
+
+func dropSearchTriggers(db execer) error {
+	for _, trigger := range sqliteSearchTriggers {
+		if _, err := db.Exec(`DROP TRIGGER IF EXISTS ` + trigger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func stringArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		args[i] = value
+	}
+	return args
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMatchSearchTerms(t *testing.T) {
+	tests := []struct {
+		query string
+		texts []string
+		want  bool
+	}{
+		{"bus", []string{"The BUS is late"}, true},
+		{"bus", []string{"The business is late"}, false},
+		{"bus*", []string{"The business is late"}, true},
+		{"ПРИВІТ", []string{"привіт усім"}, true},
+		{"cafe", []string{"Meet at the Café"}, true},
+		{"café", []string{"meet at the cafe"}, true},
+		{`"bus station"`, []string{"at the bus station"}, true},
+		{`"bus station"`, []string{"station of the bus"}, false},
+		{"bus kyiv", []string{"bus to Lviv"}, false},
+		{"bus kyiv", []string{"bus", "", "photo of Kyiv"}, true},
+		{"don't", []string{"I don't know"}, true},
+	}
+	for _, tt := range tests {
+		if got := matchSearchTerms(ParseSearchQuery(tt.query), tt.texts...); got != tt.want {
+			t.Errorf("matchSearchTerms(%q, %q) = %v, want %v", tt.query, tt.texts, got, tt.want)
+		}
+	}
+}
+
+func TestSearchSnippet(t *testing.T) {
+	tests := []struct {
+		query string
+		texts []string
+		want  string
+	}{
+		{"bus", []string{"The BUS is late"}, "The <b>BUS</b> is late"},
+		{"stat*", []string{"", "meet at the station, ok?"}, "meet at the <b>station,</b> ok?"},
+		{"twelve", []string{"one two three four five six seven eight nine ten eleven twelve thirteen fourteen fifteen sixteen"},
+			"…nine ten eleven <b>twelve</b> thirteen fourteen fifteen sixteen"},
+		{"one", []string{"one two three four five six seven eight nine ten eleven twelve thirteen"},
+			"<b>one</b> two three four five six seven eight nine ten eleven twelve…"},
+		{"missing", []string{"some text"}, ""},
+	}
+	for _, tt := range tests {
+		if got := searchSnippet(ParseSearchQuery(tt.query), tt.texts...); got != tt.want {
+			t.Errorf("searchSnippet(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestTSQuery(t *testing.T) {
+	terms := ParseSearchQuery(`"bus station" kyi* it's`)
+	if got, want := tsQuery(terms, ""), `('bus' <-> 'station') & ('kyi':*) & ('it''s')`; got != want {
+		t.Errorf("tsQuery() = %s, want %s", got, want)
+	}
+	if got, want := tsQuery(terms, "A"), `('bus':A <-> 'station':A) & ('kyi':*A) & ('it''s':A)`; got != want {
+		t.Errorf("tsQuery() = %s, want %s", got, want)
+	}
+}
+
+// storeSearchMessages stores messages for search tests, the newest last
+func storeSearchMessages(t *testing.T, db *DB) {
+	t.Helper()
+	tracker := &DBTracker{db: db}
+	sent := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	messages := []TrackableMessage{
+		{MessageID: "M1", Sender: "1@s.whatsapp.net", Chat: "a@g.us", Content: "Meet at the bus station"},
+		{MessageID: "M2", Sender: "1@s.whatsapp.net", Chat: "b@g.us", Content: "Кава в café о 10?"},
+		{MessageID: "M3", Sender: "2@s.whatsapp.net", Chat: "a@g.us", Content: "photo",
+			Files: []Attachment{{ID: "M3", Path: "files/M3.jpg", Caption: "Bus to Kyiv"}}},
+		{MessageID: "M4", Sender: "2@s.whatsapp.net", Chat: "a@g.us", ParsedContent: "STATION TIMETABLE"},
+		{MessageID: "M5", Sender: "2@s.whatsapp.net", Chat: "a@g.us", Content: "the business plan"},
+	}
+	for i, message := range messages {
+		message.Event = EventMessageCreated
+		message.Timestamp = sent.Add(time.Duration(i) * time.Minute).String()
+		if err := tracker.TrackMessage(&message); err != nil {
+			t.Fatalf("TrackMessage(%s) error = %v", message.MessageID, err)
+		}
+	}
+}
+
+func TestSearchHandler(t *testing.T) {
+	db := newTestDB(t)
+	storeSearchMessages(t, db)
+	server := &Server{DB: db}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"q=bus", []string{"M1", "M3"}},
+		{"q=bus*", []string{"M1", "M3", "M5"}},
+		{"q=BUS+kyiv", []string{"M3"}},
+		{"q=station", []string{"M1", "M4"}},
+		{`q="bus+station"`, []string{"M1"}},
+		{"q=кава+cafe", []string{"M2"}},
+		{"q=bus&chat=b@g.us", []string{}},
+		{"q=bus*&limit=1", []string{"M5"}},
+		{"q=bus*&limit=1&offset=1", []string{"M3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			server.getDBSearchHandler(recorder, httptest.NewRequest("GET", "/search?"+tt.query, nil))
+			if recorder.Code != 200 {
+				t.Fatalf("status = %d, body %s", recorder.Code, recorder.Body)
+			}
+			var results []WebSearchResult
+			if err := json.Unmarshal(recorder.Body.Bytes(), &results); err != nil {
+				t.Fatal(err)
+			}
+			ids := []string{}
+			for _, result := range results {
+				ids = append(ids, result.ID)
+				if result.Snippet == "" {
+					t.Errorf("result %s has no snippet", result.ID)
+				}
+			}
+			// The index orders by rank, only the paged queries depend on the order
+			if tt.query == "q=bus*&limit=1" || tt.query == "q=bus*&limit=1&offset=1" {
+				if len(ids) != 1 {
+					t.Errorf("ids = %v, want one result", ids)
+				}
+				return
+			}
+			if !sameStrings(ids, tt.want) {
+				t.Errorf("ids = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessagesHandlerContentFilter(t *testing.T) {
+	db := newTestDB(t)
+	storeSearchMessages(t, db)
+	server := &Server{DB: db}
+
+	tests := []struct {
+		content string
+		want    []string
+	}{
+		{"", []string{"M5", "M4", "M3", "M2", "M1"}},
+		{"bus", []string{"M1"}},
+		{"BUS*", []string{"M5", "M1"}},
+		{"кава", []string{"M2"}},
+		{"cafe", []string{"M2"}},
+		// Only the content is matched, not the OCR text or captions
+		{"timetable", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.content, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest("GET", "/messages?from=01.05.2024&to=01.05.2024", nil)
+			query := request.URL.Query()
+			query.Set("content", tt.content)
+			request.URL.RawQuery = query.Encode()
+			server.getDBMessagesHandler(recorder, request)
+			if recorder.Code != 200 {
+				t.Fatalf("status = %d, body %s", recorder.Code, recorder.Body)
+			}
+			var messages []WebMessage
+			if err := json.Unmarshal(recorder.Body.Bytes(), &messages); err != nil {
+				t.Fatal(err)
+			}
+			ids := []string{}
+			for _, message := range messages {
+				ids = append(ids, message.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("ids = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncSearchIndexRebuildsDetachedIndex(t *testing.T) {
+	db := newTestDB(t)
+	if !db.Dialect.FullTextSearch() {
+		t.Skip("SQLite is built without FTS5")
+	}
+	// A binary without FTS5 detached the index and stored a message
+	if err := dropSearchTriggers(db); err != nil {
+		t.Fatal(err)
+	}
+	storeSearchMessages(t, db)
+	if err := syncSearchIndex(db); err != nil {
+		t.Fatalf("syncSearchIndex() error = %v", err)
+	}
+	if got := countRows(t, db, `SELECT count(*) FROM messages_fts WHERE messages_fts MATCH 'kyiv'`); got != 1 {
+		t.Errorf("indexed captions matching kyiv = %d, want 1", got)
+	}
+	if got := countRows(t, db, `SELECT count(*) FROM messages_fts`); got != 5 {
+		t.Errorf("indexed messages = %d, want 5", got)
+	}
+}
+
+// sameStrings tells if the slices have the same values in any order
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[string]int)
+	for _, value := range a {
+		counts[value]++
+	}
+	for _, value := range b {
+		counts[value]--
+		if counts[value] < 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+)
+
+// MessageContext is the reply, forwarding and mention information of a message
+type MessageContext struct {
+	QuotedMessageID string   `json:"quoted_message_id,omitempty"`
+	QuotedSender    string   `json:"quoted_sender,omitempty"`
+	Forwarded       bool     `json:"forwarded,omitempty"`
+	ForwardingScore uint32   `json:"forwarding_score,omitempty"`
+	Mentions        []string `json:"mentions,omitempty"`
+}
+
+// getMessageContext returns the context of the message or nil if it is not a reply, forward or mention
+func getMessageContext(msg *waProto.Message) *MessageContext {
+	var info *waProto.ContextInfo
+	switch {
+	case msg.GetExtendedTextMessage() != nil:
+		info = msg.GetExtendedTextMessage().GetContextInfo()
+	case msg.GetImageMessage() != nil:
+		info = msg.GetImageMessage().GetContextInfo()
+	case msg.GetVideoMessage() != nil:
+		info = msg.GetVideoMessage().GetContextInfo()
+	case msg.GetAudioMessage() != nil:
+		info = msg.GetAudioMessage().GetContextInfo()
+	case msg.GetDocumentMessage() != nil:
+		info = msg.GetDocumentMessage().GetContextInfo()
+	case msg.GetStickerMessage() != nil:
+		info = msg.GetStickerMessage().GetContextInfo()
+	case msg.GetLocationMessage() != nil:
+		info = msg.GetLocationMessage().GetContextInfo()
+	case msg.GetLiveLocationMessage() != nil:
+		info = msg.GetLiveLocationMessage().GetContextInfo()
+	}
+	if info == nil {
+		return nil
+	}
+
+	context := &MessageContext{
+		QuotedMessageID: info.GetStanzaID(),
+		QuotedSender:    info.GetParticipant(),
+		Forwarded:       info.GetIsForwarded(),
+		ForwardingScore: info.GetForwardingScore(),
+		Mentions:        info.GetMentionedJID(),
+	}
+	if context.QuotedMessageID == "" && !context.Forwarded && len(context.Mentions) == 0 {
+		return nil
+	}
+	return context
+}
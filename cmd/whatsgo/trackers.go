@@ -1,7 +1,7 @@
 package main
 
 import (
-	"database/sql"
+	"reflect"
 	"time"
 )
 
@@ -11,23 +11,103 @@ type MessageMetadata struct {
 	Timestamp time.Time
 }
 
+// Events that are passed to trackers
+const (
+	EventMessageCreated = "message.created"
+	EventMessageEdited  = "message.edited"
+	EventMessageRevoked = "message.revoked"
+	EventReaction       = "reaction"
+	EventPollVote       = "poll.vote"
+	EventGroupChange    = "group.change"
+	EventConnection     = "connection.state"
+)
+
+// trackableEvents are all events passed to trackers
+var trackableEvents = []string{EventMessageCreated, EventMessageEdited, EventMessageRevoked, EventReaction, EventPollVote,
+	EventGroupChange, EventConnection}
+
 type TrackableMessage struct {
+	Event         string
 	MessageID     string
 	Sender        string
+	SenderName    string
 	Chat          string
+	ChatName      string
 	Content       string
 	ParsedContent string
 	Timestamp     string
-	Files         []string
+	Files         []Attachment
+	Location      *Location
+	Context       *MessageContext
+	Poll          *Poll
+	Reaction      *Reaction
+	PollVote      *PollVote
+	GroupChange   *GroupChange
+	Connection    *ConnectionState
+	Annotations   []Annotation
 	Metadata      MessageMetadata
+	// EventTimestamp is the time of the edit or revocation for such events
+	EventTimestamp string
+	// Original is the stored message that an edit or revocation changes, the change is routed like it
+	Original *TrackableMessage `json:"-"`
+}
+
+// Location is a shared location or a live location update
+type Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Accuracy  uint32  `json:"accuracy,omitempty"`
+	Name      string  `json:"name,omitempty"`
+	Address   string  `json:"address,omitempty"`
+	Live      bool    `json:"live"`
+	Speed     float32 `json:"speed,omitempty"`
+	Heading   uint32  `json:"heading,omitempty"`
+	Sequence  int64   `json:"sequence,omitempty"`
 }
 
 type Tracker interface {
+	Name() string
 	Init(config *Config) error
 	TrackMessage(message *TrackableMessage) error
 }
 
-func CreateTrackers(config *Config, db *sql.DB) []Tracker {
+// IsMessageEvent reports whether the event creates or changes a message, as opposed to reactions, votes,
+// group changes and connection events
+func (message *TrackableMessage) IsMessageEvent() bool {
+	switch message.Event {
+	case EventReaction, EventPollVote, EventGroupChange, EventConnection:
+		return false
+	}
+	return true
+}
+
+// changeAnnotation describes an edit or a revocation for trackers that store annotations as text
+func changeAnnotation(message *TrackableMessage) string {
+	switch message.Event {
+	case EventMessageEdited:
+		return "edited_at=" + message.EventTimestamp
+	case EventMessageRevoked:
+		return "revoked_at=" + message.EventTimestamp
+	}
+	return ""
+}
+
+// CreateTrackers initializes the enabled trackers and routes messages to them
+func CreateTrackers(config *Config, db *DB) *Router {
+	return createTrackers(config, db, nil)
+}
+
+// ReloadTrackers creates the trackers of a reloaded config. The Google Drive tracker is kept
+// while its settings don't change, so it isn't authorized again.
+func ReloadTrackers(old *Router, config *Config, db *DB) *Router {
+	var cloudTracker *CloudTracker
+	if reflect.DeepEqual(old.config.GoogleCloud, config.GoogleCloud) {
+		cloudTracker = findCloudTracker(old.Trackers())
+	}
+	return createTrackers(config, db, cloudTracker)
+}
+
+func createTrackers(config *Config, db *DB, cloudTracker *CloudTracker) *Router {
 	var trackers []Tracker
 
 	trackers = append(trackers, &DBTracker{db: db})
@@ -35,43 +115,47 @@ func CreateTrackers(config *Config, db *sql.DB) []Tracker {
 		trackers = append(trackers, &CSVTracker{})
 	}
 	if config.Webhook.Enabled {
-		trackers = append(trackers, &WebhookTracker{})
+		for _, target := range config.Webhook.GetTargets() {
+			trackers = append(trackers, &WebhookTracker{db: db, target: WebhookTarget{Name: target.Name}})
+		}
 	}
-	if config.GoogleCloud.Enabled {
+	if config.GoogleCloud.Enabled && cloudTracker == nil {
 		trackers = append(trackers, &CloudTracker{})
 	}
 
-	// Init all trackers
+	// Trackers that fail to initialize aren't routed, their queued jobs wait until a reload initializes them
+	var initialized []Tracker
 	for _, tracker := range trackers {
 		err := tracker.Init(config)
 		if err != nil {
-			log.Errorf("Failed to initialize tracker: %v", err)
+			log.Errorf("Failed to initialize tracker(%s), it's disabled: %v", tracker.Name(), err)
+			continue
 		}
-
+		initialized = append(initialized, tracker)
+	}
+	if config.GoogleCloud.Enabled && cloudTracker != nil {
+		initialized = append(initialized, cloudTracker)
 	}
-	return trackers
+	return CreateRouter(config, initialized)
 }
 
-func ProcessMessage(trackers []Tracker, messageID string, sender string, chat string, content string, timestamp string, files []string, metadata MessageMetadata, server *Server) error {
-	message := TrackableMessage{
-		MessageID:     messageID,
-		Sender:        sender,
-		Chat:          chat,
-		Content:       content,
-		ParsedContent: "",
-		Timestamp:     timestamp,
-		Files:         files,
-		Metadata:      metadata,
+func ProcessMessage(queue *TrackerQueue, processors []Processor, message TrackableMessage, server *Server) error {
+	for _, processor := range processors {
+		err := processor.Process(&message)
+		if err != nil {
+			log.Errorf("Failed to process message with processor(%s) : %v", processor.Name(), err)
+		}
 	}
 
-	server.broadcastToClients(message)
+	err := queue.Enqueue(&message)
+	if err != nil {
+		log.Errorf("Failed to enqueue message %s for trackers: %v", message.MessageID, err)
+		return err
+	}
 
-	for _, tracker := range trackers {
-		log.Debugf("Processing message with tracker: %v", tracker)
-		err := tracker.TrackMessage(&message)
-		if err != nil {
-			log.Errorf("Failed to store message in tracker(%v) : %v", tracker, err)
-		}
+	// Web clients see the message once it's committed to the queue, with the annotations of processors
+	if server != nil {
+		server.broadcastToClients(message)
 	}
 	return nil
 }
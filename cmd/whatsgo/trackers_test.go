@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testTracker records the messages it tracks, track returns the result of an attempt
+type testTracker struct {
+	name    string
+	mu      sync.Mutex
+	tracked []TrackableMessage
+	track   func(message *TrackableMessage) error
+}
+
+func (tracker *testTracker) Name() string {
+	return tracker.name
+}
+
+func (tracker *testTracker) Init(config *Config) error {
+	return nil
+}
+
+func (tracker *testTracker) TrackMessage(message *TrackableMessage) error {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	tracker.tracked = append(tracker.tracked, *message)
+	if tracker.track != nil {
+		return tracker.track(message)
+	}
+	return nil
+}
+
+func (tracker *testTracker) messages() []TrackableMessage {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	return append([]TrackableMessage{}, tracker.tracked...)
+}
+
+// newTestQueue returns a queue of the trackers that isn't started
+func newTestQueue(t *testing.T, db *DB, config *Config, trackers ...Tracker) *TrackerQueue {
+	queue, err := CreateTrackerQueue(config, db, CreateRouter(config, trackers))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queue
+}
+
+// dialTestWebSocket connects a client to the WebSocket of new messages
+func dialTestWebSocket(t *testing.T, server *Server) *websocket.Conn {
+	httpServer := httptest.NewServer(http.HandlerFunc(server.handleWebSocket))
+	t.Cleanup(httpServer.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	for deadline := time.Now().Add(time.Second); ; {
+		server.mu.Lock()
+		connected := len(server.clients) > 0
+		server.mu.Unlock()
+		if connected {
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("WebSocket client isn't registered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestProcessMessageBroadcastsAfterEnqueue(t *testing.T) {
+	db := newTestDB(t)
+	queue := newTestQueue(t, db, &Config{}, &testTracker{name: "test"})
+	server := &Server{DB: db}
+	server.InitWebSocket()
+	conn := dialTestWebSocket(t, server)
+
+	processor := &testProcessor{annotation: Annotation{Processor: "test", Key: "k", Value: "v"}}
+	message := TrackableMessage{Event: EventMessageCreated, MessageID: "M1", Chat: "a@g.us", Content: "hi", Timestamp: "1714546800"}
+	if err := ProcessMessage(queue, []Processor{processor}, message, server); err != nil {
+		t.Fatalf("ProcessMessage() error = %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("no message was broadcast: %v", err)
+	}
+	var received WebMessage
+	if err := json.Unmarshal(data, &received); err != nil || received.ID != "M1" {
+		t.Errorf("broadcast %s, %v", data, err)
+	}
+	if queued, _ := queue.HasMessage("M1"); !queued {
+		t.Error("the message was broadcast before it was queued")
+	}
+
+	// Messages that fail to be queued aren't shown
+	db.Close()
+	message.MessageID = "M2"
+	if err := ProcessMessage(queue, nil, message, server); err == nil {
+		t.Fatal("ProcessMessage() with a closed database succeeded")
+	}
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, data, err := conn.ReadMessage(); err == nil {
+		t.Errorf("broadcast %s, though it wasn't queued", data)
+	}
+}
+
+// testProcessor adds the annotation to every message
+type testProcessor struct {
+	annotation Annotation
+}
+
+func (p *testProcessor) Name() string {
+	return p.annotation.Processor
+}
+
+func (p *testProcessor) Init(config *Config) error {
+	return nil
+}
+
+func (p *testProcessor) Process(message *TrackableMessage) error {
+	message.Annotations = append(message.Annotations, p.annotation)
+	return nil
+}
+
+func TestTrackersFailingToInitializeAreNotRouted(t *testing.T) {
+	db := newTestDB(t)
+	config := &Config{GoogleCloud: GoogleCloudConfig{Enabled: true, CredentialsFile: filepath.Join(t.TempDir(), "missing.json")}}
+	router := CreateTrackers(config, db)
+	if findCloudTracker(router.Trackers()) != nil {
+		t.Error("the Google Drive tracker is routed although it failed to initialize")
+	}
+	if findDBTracker(router.Trackers()) == nil {
+		t.Error("the DB tracker isn't routed")
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// trackerNames are the names of trackers that routes can refer to
+var trackerNames = []string{"db", "csv", "webhook", "google_cloud"}
+
+// Validate checks the config and returns all problems it finds joined into one error
+func (c *Config) Validate() error {
+	var problems []error
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	if _, err := NewDialect(c.Database.Dialect); err != nil {
+		add("database.dialect: %v", err)
+	}
+	if c.Database.ConnectionString == "" {
+		add("database.connection_string is required")
+	}
+
+	for i, chat := range c.Chats {
+		if !strings.Contains(chat.ID, "@") {
+			add("chats[%d].id: %q is not a JID like 123456789@g.us", i, chat.ID)
+		}
+	}
+	if _, err := CompileChatFilter(c); err != nil {
+		add("%v", err)
+	}
+
+	if c.CSV.Enabled && c.CSV.Path == "" {
+		add("csv.path is required when csv is enabled")
+	}
+	if c.GoogleCloud.Enabled && (c.GoogleCloud.CredentialsFile == "" || c.GoogleCloud.TokenFile == "") {
+		add("google_cloud.credentials_file and google_cloud.token_file are required when google_cloud is enabled")
+	}
+	if c.Webhook.Enabled && len(c.Webhook.GetTargets()) == 0 {
+		add("webhook.targets: at least one target is required when webhook is enabled")
+	}
+	for i, webhookURL := range c.Webhook.URLs {
+		if !isHTTPURL(webhookURL) {
+			add("webhook.urls[%d]: %q is not an http(s) URL", i, webhookURL)
+		}
+	}
+	if c.Webhook.FilesBaseURL != "" && !isHTTPURL(c.Webhook.FilesBaseURL) {
+		add("webhook.files_base_url: %q is not an http(s) URL", c.Webhook.FilesBaseURL)
+	}
+	targetNames := make(map[string]bool)
+	for i, target := range c.Webhook.Targets {
+		if !webhookTargetName.MatchString(target.Name) {
+			add("webhook.targets[%d].name: %q must consist of letters, digits, - and _", i, target.Name)
+		} else if targetNames[target.Name] {
+			add("webhook.targets[%d].name: duplicate target %q", i, target.Name)
+		}
+		targetNames[target.Name] = true
+		if !isHTTPURL(target.URL) {
+			add("webhook.targets[%d].url: %q is not an http(s) URL", i, target.URL)
+		}
+		if target.Timeout < 0 || target.Retry.MaxAttempts < 0 || target.Retry.BaseDelay < 0 || target.Retry.MaxDelay < 0 {
+			add("webhook.targets[%d]: timeout and retry values must not be negative", i)
+		}
+		if target.Payload != "" && target.Payload != webhookPayloadEnvelope && target.Payload != webhookPayloadRaw {
+			add("webhook.targets[%d].payload: unknown payload %q, known payloads: %s, %s", i, target.Payload, webhookPayloadEnvelope, webhookPayloadRaw)
+		}
+		for _, event := range target.Events {
+			if !containsString(trackableEvents, event) {
+				add("webhook.targets[%d].events: unknown event %q, known events: %s", i, event, strings.Join(trackableEvents, ", "))
+			}
+		}
+		if target.Template != "" {
+			if target.Payload == webhookPayloadRaw {
+				add("webhook.targets[%d]: a template can't be used with the raw payload", i)
+			}
+			if _, err := parseWebhookTemplate(target.Name, target.Template, c); err != nil {
+				add("webhook.targets[%d].template: %v", i, err)
+			}
+		}
+		for _, code := range target.AcceptedCodes {
+			if code < 100 || code > 599 {
+				add("webhook.targets[%d].accepted_codes: %d is not an HTTP status code", i, code)
+			}
+		}
+	}
+	for _, name := range webhookURLNames(c.Webhook) {
+		if targetNames[name] {
+			add("webhook.targets: target %q has the name of a URL of webhook.urls", name)
+		}
+		targetNames[name] = true
+	}
+
+	if c.OCR.Timeout < 0 {
+		add("ocr.timeout must not be negative")
+	}
+	if c.Queue.Workers < 0 || c.Queue.MaxAttempts < 0 || c.Queue.BaseDelay < 0 || c.Queue.MaxDelay < 0 || c.Queue.PollInterval < 0 {
+		add("queue: values must not be negative")
+	}
+	if c.Directory.RefreshInterval < 0 {
+		add("directory.refresh_interval must not be negative")
+	}
+	if c.Retention.Interval < 0 {
+		add("retention.interval must not be negative")
+	}
+	for i, rule := range c.Retention.Rules {
+		if rule.MediaDays < 0 || rule.MessagesDays < 0 {
+			add("retention.rules[%d]: days must not be negative", i)
+		}
+	}
+	if c.Encryption.Enabled && c.Encryption.KeyFile == "" && os.Getenv(encryptionKeyEnv) == "" {
+		add("encryption.key_file or %s is required when encryption is enabled", encryptionKeyEnv)
+	}
+
+	for i, name := range c.Processors {
+		if _, ok := processorFactories[name]; !ok {
+			add("processors[%d]: unknown processor %q, known processors: %s", i, name, strings.Join(processorNames(), ", "))
+		}
+	}
+	// ocr.enabled only applies to configs without the processors section
+	if c.OCR.Enabled && c.Processors != nil && !containsString(c.Processors, "ocr") {
+		add("ocr.enabled: OCR runs only if processors lists ocr, add it to processors or remove ocr.enabled")
+	}
+	for i, route := range c.Routes {
+		name, isTarget := strings.CutPrefix(route.Tracker, webhookTrackerPrefix)
+		if isTarget && !targetNames[name] {
+			add("routes[%d].tracker: unknown webhook target %q", i, name)
+		} else if !isTarget && !containsString(trackerNames, route.Tracker) {
+			add("routes[%d].tracker: unknown tracker %q, known trackers: %s, webhook:<target>", i, route.Tracker, strings.Join(trackerNames, ", "))
+		}
+		for _, messageType := range route.Types {
+			if !containsString(messageTypes, messageType) {
+				add("routes[%d].types: unknown type %q, known types: %s", i, messageType, strings.Join(messageTypes, ", "))
+			}
+		}
+	}
+	return errors.Join(problems...)
+}
+
+var webhookTargetName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func isHTTPURL(value string) bool {
+	parsed, err := url.Parse(value)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// webhookURLNames returns the names of targets of the plain `urls` list
+func webhookURLNames(config WebhookConfig) []string {
+	var names []string
+	for i := range config.URLs {
+		names = append(names, strconv.Itoa(i+1))
+	}
+	return names
+}
+
+func processorNames() []string {
+	var names []string
+	for name := range processorFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runConfigCommand handles `whatsgo config validate`
+func runConfigCommand(config *Config, loadErr error, command string) error {
+	switch command {
+	case "validate":
+		if loadErr != nil {
+			return loadErr
+		}
+		log.Infof("Configuration is valid: %d chats, %d routes", len(config.Chats), len(config.Routes))
+		return nil
+	}
+	return fmt.Errorf("usage: whatsgo config validate")
+}
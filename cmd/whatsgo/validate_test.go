@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateOCRProcessors(t *testing.T) {
+	tests := []struct {
+		name       string
+		processors []string
+		wantErr    bool
+	}{
+		{"without processors", nil, false},
+		{"with ocr", []string{"ocr", "language"}, false},
+		{"without ocr", []string{"language"}, true},
+		{"empty list", []string{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := GetDefaultConfig()
+			config.OCR.Enabled = true
+			config.Processors = tt.processors
+			err := config.Validate()
+			if got := err != nil && strings.Contains(err.Error(), "ocr.enabled"); got != tt.wantErr {
+				t.Errorf("Validate() error = %v, want an ocr.enabled error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDemoConfigIsValid(t *testing.T) {
+	config, err := LoadConfig("../../config/demo-config.yaml")
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if config.Processors != nil {
+		t.Errorf("processors = %v, the demo config should leave them opt-in", config.Processors)
+	}
+}
+
+func TestLoadConfigRejectsUnknownKeys(t *testing.T) {
+	file := writeTestFile(t, "config.yaml", "database:\n  dialect: sqlite3\n  connection_string: whatsgo.db\ncsv:\n  enabled: true\n  pth: csv\n")
+	if _, err := LoadConfig(file); err == nil || !strings.Contains(err.Error(), "pth") {
+		t.Errorf("LoadConfig() error = %v, want the unknown key", err)
+	}
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	config := GetDefaultConfig()
+	config.Database.Dialect = "mysql"
+	config.Chats = []Chat{{ID: "team"}}
+	config.Queue.Workers = -1
+	config.Processors = []string{"unknown"}
+	config.Routes = []Route{{Tracker: "ftp"}}
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("Validate() succeeded")
+	}
+	for _, problem := range []string{"database.dialect", "chats[0].id", "queue", "processors[0]", "routes[0].tracker"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Validate() error doesn't report %s:\n%v", problem, err)
+		}
+	}
+	if err := GetDefaultConfig().Validate(); err != nil {
+		t.Errorf("Validate() of the default config error = %v", err)
+	}
+}
+
+func TestLoadConfigAppliesEnvBeforeValidation(t *testing.T) {
+	file := writeTestFile(t, "config.yaml", "database:\n  dialect: sqlite3\n  connection_string: \"\"\n")
+	if _, err := LoadConfig(file); err == nil {
+		t.Error("LoadConfig() accepted an empty connection string")
+	}
+	t.Setenv("WHATSGO_DATABASE_CONNECTION_STRING", "whatsgo.db")
+	config, err := LoadConfig(file)
+	if err != nil || config.Database.ConnectionString != "whatsgo.db" {
+		t.Errorf("LoadConfig() = %+v, %v, want the connection string from the environment", config, err)
+	}
+}
+
+func TestValidateDialects(t *testing.T) {
+	for dialect, valid := range map[string]bool{"sqlite3": true, "postgres": true, "sqlite": false, "pgx": false, "mysql": false} {
+		config := GetDefaultConfig()
+		config.Database.Dialect = dialect
+		if err := config.Validate(); (err == nil) != valid {
+			t.Errorf("Validate() of dialect %s error = %v", dialect, err)
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/websocket"
+	"io"
 	"net/http"
+	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -14,10 +18,11 @@ import (
 const FileWebPathPrefix = "/files"
 
 type Server struct {
-	DB              *sql.DB
-	config          *Config
+	DB              *DB
+	config          *ConfigHolder
 	fileStoragePath string
 	clients         map[*websocket.Conn]bool
+	eventClients    map[*websocket.Conn]bool
 	broadcast       chan []byte
 	upgrader        websocket.Upgrader
 	mu              sync.Mutex
@@ -25,6 +30,7 @@ type Server struct {
 
 func (s *Server) InitWebSocket() {
 	s.clients = make(map[*websocket.Conn]bool)
+	s.eventClients = make(map[*websocket.Conn]bool)
 	s.broadcast = make(chan []byte)
 	s.upgrader = websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
@@ -36,6 +42,15 @@ func (s *Server) InitWebSocket() {
 
 // WebSocket endpoint
 func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	s.serveWebSocket(w, r, s.clients)
+}
+
+// WebSocket endpoint for events other than new messages
+func (s *Server) handleEventsWebSocket(w http.ResponseWriter, r *http.Request) {
+	s.serveWebSocket(w, r, s.eventClients)
+}
+
+func (s *Server) serveWebSocket(w http.ResponseWriter, r *http.Request, clients map[*websocket.Conn]bool) {
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Errorf("WebSocket upgrade error: %v", err)
@@ -44,75 +59,146 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	defer conn.Close()
 
 	s.mu.Lock()
-	s.clients[conn] = true
+	clients[conn] = true
 	s.mu.Unlock()
 
 	for {
 		_, _, err := conn.ReadMessage()
 		if err != nil {
 			s.mu.Lock()
-			delete(s.clients, conn)
+			delete(clients, conn)
 			s.mu.Unlock()
 			break
 		}
 	}
 }
 
-// Broadcast messages to all connected clients
-func (s *Server) broadcastToClients(message TrackableMessage) {
-	//create WebMessage
-	webMsg := WebMessage{
-		ID:        message.MessageID,
-		Sender:    message.Sender,
-		Chat:      message.Chat,
-		Content:   message.Content,
-		Timestamp: message.Timestamp,
-		Filename:  nil,
-	}
-	if len(message.Files) > 0 {
-		filename := FileWebPathPrefix + strings.TrimPrefix(message.Files[0], s.fileStoragePath)
-		webMsg.Filename = &filename
-	}
+// WebEvent is an event sent to clients of the events WebSocket
+type WebEvent struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
 
-	//convert the message to JSON
-	wsMsg, err := json.Marshal(webMsg)
+// Broadcast an event to all clients of the events WebSocket
+func (s *Server) broadcastEvent(eventType string, data interface{}) {
+	wsMsg, err := json.Marshal(WebEvent{Type: eventType, Data: data})
 	if err != nil {
-		return // Ignore messages that can't be marshalled
+		return // Ignore events that can't be marshalled
 	}
+	s.writeToClients(s.eventClients, wsMsg)
+}
 
+func (s *Server) writeToClients(clients map[*websocket.Conn]bool, wsMsg []byte) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	for client := range s.clients {
+	for client := range clients {
 		err := client.WriteMessage(websocket.TextMessage, wsMsg)
 		if err != nil {
 			client.Close()
-			delete(s.clients, client)
+			delete(clients, client)
+		}
+	}
+}
+
+// Broadcast messages to all connected clients
+func (s *Server) broadcastToClients(message TrackableMessage) {
+	//create WebMessage
+	webMsg := WebMessage{
+		ID:         message.MessageID,
+		Sender:     message.Sender,
+		SenderName: message.SenderName,
+		Chat:       message.Chat,
+		ChatName:   message.ChatName,
+		Content:    message.Content,
+		Timestamp:  message.Timestamp,
+		Filename:   nil,
+		Location:   message.Location,
+		Context:    message.Context,
+	}
+	s.setWebAttachments(&webMsg, message.Files)
+	if message.Poll != nil {
+		webMsg.Poll = &WebPoll{ID: message.MessageID, Question: message.Poll.Question,
+			SelectableCount: int(message.Poll.SelectableCount), Options: []WebPollOption{}}
+		for _, option := range message.Poll.Options {
+			webMsg.Poll.Options = append(webMsg.Poll.Options, WebPollOption{Name: option.Name, Voters: []string{}})
 		}
 	}
+
+	//convert the message to JSON
+	wsMsg, err := json.Marshal(webMsg)
+	if err != nil {
+		return // Ignore messages that can't be marshalled
+	}
+	s.writeToClients(s.clients, wsMsg)
 }
 
 func (s *Server) getDBChatsHandler(w http.ResponseWriter, r *http.Request) {
 	// Return chats from config
-	if s.config.Chats == nil {
+	chats := s.config.Get().Chats
+	if chats == nil {
 		json.NewEncoder(w).Encode([]interface{}{})
 	} else {
-		json.NewEncoder(w).Encode(s.config.Chats)
+		json.NewEncoder(w).Encode(chats)
 	}
 }
 
 type WebMessage struct {
-	ID        string  `json:"id"`
-	Sender    string  `json:"sender"`
-	Chat      string  `json:"chat"`
-	Content   string  `json:"content"`
-	Timestamp string  `json:"timestamp"`
-	Filename  *string `json:"filename"`
+	ID         string          `json:"id"`
+	Sender     string          `json:"sender"`
+	SenderName string          `json:"sender_name,omitempty"`
+	Chat       string          `json:"chat"`
+	ChatName   string          `json:"chat_name,omitempty"`
+	Content    string          `json:"content"`
+	Timestamp  string          `json:"timestamp"`
+	Filename   *string         `json:"filename"`
+	Files      []WebAttachment `json:"files,omitempty"`
+	Location   *Location       `json:"location,omitempty"`
+	Context    *MessageContext `json:"context,omitempty"`
+	EditedAt   *string         `json:"edited_at,omitempty"`
+	DeletedAt  *string         `json:"deleted_at,omitempty"`
+	Reactions  *WebReactions   `json:"reactions,omitempty"`
+	Poll       *WebPoll        `json:"poll,omitempty"`
 }
 
-func removeFilePrefixFromWebMessage(message *WebMessage, prefix string) {
-	if message.Filename != nil {
-		*message.Filename = FileWebPathPrefix + strings.TrimPrefix(*message.Filename, prefix)
+// WebAttachment is an attachment of a message with the URL it is served at
+type WebAttachment struct {
+	ID       string `json:"id"`
+	URL      string `json:"url"`
+	MimeType string `json:"mime_type,omitempty"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256,omitempty"`
+	FileName string `json:"file_name,omitempty"`
+	Caption  string `json:"caption,omitempty"`
+	Width    uint32 `json:"width,omitempty"`
+	Height   uint32 `json:"height,omitempty"`
+	Duration uint32 `json:"duration,omitempty"`
+}
+
+// fileURL returns the path that a stored file is served at by the files server
+func fileURL(fileStoragePath string, filePath string) string {
+	return FileWebPathPrefix + "/" + strings.TrimPrefix(strings.TrimPrefix(filePath, fileStoragePath), "/")
+}
+
+// setWebAttachments sets the files of the message, filename is kept as the URL of the first one
+func (s *Server) setWebAttachments(message *WebMessage, files []Attachment) {
+	message.Files = nil
+	for _, file := range files {
+		message.Files = append(message.Files, WebAttachment{
+			ID:       file.ID,
+			URL:      fileURL(s.fileStoragePath, file.Path),
+			MimeType: file.MimeType,
+			Size:     file.Size,
+			SHA256:   file.SHA256,
+			FileName: file.FileName,
+			Caption:  file.Caption,
+			Width:    file.Width,
+			Height:   file.Height,
+			Duration: file.Duration,
+		})
+	}
+	if len(message.Files) > 0 {
+		message.Filename = &message.Files[0].URL
 	}
 }
 
@@ -120,6 +206,7 @@ func (s *Server) getDBMessagesHandler(w http.ResponseWriter, r *http.Request) {
 	dateFromStr := r.URL.Query().Get("from")
 	dateToStr := r.URL.Query().Get("to")
 	content := r.URL.Query().Get("content")
+	terms := ParseSearchQuery(content)
 
 	if dateFromStr == "" || dateToStr == "" {
 		http.Error(w, "Missing date_from or date_to", http.StatusBadRequest)
@@ -138,25 +225,31 @@ func (s *Server) getDBMessagesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if content != "" && len(terms) == 0 {
+		http.Error(w, "Invalid content, it has no words to match", http.StatusBadRequest)
+		return
+	}
+
 	// Prepare the base SQL query
 	sqlQuery := `
-        SELECT messages.id, sender, chat, content, timestamp, path
+        SELECT ` + webMessageColumns + `
         FROM messages
-        LEFT JOIN files ON messages.id = files.message_id
-        WHERE date(substr(timestamp,0,11)) >= date(?) AND date(substr(timestamp,0,11)) <= date(?)`
+        WHERE ts >= ? AND ts < ?`
 
 	// If a content filter is provided, add it to the query
 	var args []interface{}
-	args = append(args, dateFrom.Format("2006-01-02"), dateTo.Format("2006-01-02"))
-
-	if content != "" {
-		sqlQuery += " AND (content LIKE ? OR lower(content) LIKE ?)"
-		loweredContent := "%" + strings.ToLower(content) + "%"
-		args = append(args, "%"+content+"%", loweredContent)
+	args = append(args, startOfDay(dateFrom).Unix(), startOfDay(dateTo).AddDate(0, 0, 1).Unix())
+
+	// Without the index or with encrypted content, messages are filtered after they are read
+	indexed := s.DB.Dialect.FullTextSearch() && encryptor == nil
+	if content != "" && indexed {
+		condition, conditionArgs := s.DB.Dialect.MatchContent(terms)
+		sqlQuery += " AND " + condition
+		args = append(args, conditionArgs...)
 	}
 
 	// Order by timestamp in descending order
-	sqlQuery += " ORDER BY timestamp DESC"
+	sqlQuery += " ORDER BY ts DESC"
 
 	// Query messages from the DB
 	messages, err := s.DB.Query(sqlQuery, args...)
@@ -166,20 +259,690 @@ func (s *Server) getDBMessagesHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer messages.Close()
 
+	messageList, err := s.scanWebMessages(messages)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to scan message: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if content != "" && !indexed {
+		messageList = filterWebMessages(messageList, terms)
+	}
+
+	json.NewEncoder(w).Encode(messageList)
+}
+
+// fileHandler serves stored attachments, encrypted and escaped ones are decrypted on the fly
+func (s *Server) fileHandler() http.Handler {
+	root := http.Dir(s.fileStoragePath)
+	files := http.FileServer(root)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, err := root.Open(path.Clean("/" + r.URL.Path))
+		if err != nil {
+			files.ServeHTTP(w, r)
+			return
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil || info.IsDir() {
+			files.ServeHTTP(w, r)
+			return
+		}
+		magic := make([]byte, len(encryptedFileMagic))
+		if _, err := io.ReadFull(file, magic); err != nil || !hasFileMagic(magic) {
+			files.ServeHTTP(w, r)
+			return
+		}
+
+		encrypted, err := io.ReadAll(io.MultiReader(bytes.NewReader(magic), file))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read file: %v", err), http.StatusInternalServerError)
+			return
+		}
+		data, err := encryptor.DecryptBytes(encrypted)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decrypt file: %v", err), http.StatusInternalServerError)
+			return
+		}
+		http.ServeContent(w, r, info.Name(), info.ModTime(), bytes.NewReader(data))
+	})
+}
+
+// filterWebMessages returns messages whose content matches all terms
+func filterWebMessages(messages []WebMessage, terms []SearchTerm) []WebMessage {
+	filtered := []WebMessage{}
+	for _, message := range messages {
+		if matchSearchTerms(terms, message.Content) {
+			filtered = append(filtered, message)
+		}
+	}
+	return filtered
+}
+
+// webMessageColumns are the columns read by scanWebMessages
+const webMessageColumns = `messages.id, sender, chat, content, timestamp, edited_at, deleted_at, ` + locationColumns + `, ` + contextColumns + `, ` + directoryColumns
+
+func (s *Server) scanWebMessages(rows *sql.Rows) ([]WebMessage, error) {
 	var messageList []WebMessage
-	for messages.Next() {
+	var contexts []nullContext
+	for rows.Next() {
 		var message WebMessage
-		if err := messages.Scan(&message.ID, &message.Sender, &message.Chat, &message.Content, &message.Timestamp, &message.Filename); err != nil {
-			http.Error(w, fmt.Sprintf("Failed to scan message: %v", err), http.StatusInternalServerError)
-			return
+		var location nullLocation
+		var context nullContext
+		var senderName, chatName sql.NullString
+		if err := rows.Scan(&message.ID, &message.Sender, &message.Chat, &message.Content, &message.Timestamp, &message.EditedAt, &message.DeletedAt,
+			&location.latitude, &location.longitude, &location.accuracy, &location.name, &location.address, &location.live,
+			&context.quotedMessageID, &context.quotedSender, &context.forwarded, &context.forwardingScore,
+			&senderName, &chatName); err != nil {
+			return nil, err
+		}
+		if err := encryptor.decryptTexts(&message.Content); err != nil {
+			return nil, err
 		}
-		removeFilePrefixFromWebMessage(&message, s.fileStoragePath)
+		message.SenderName, message.ChatName = senderName.String, chatName.String
+		message.Location = location.Location()
 		messageList = append(messageList, message)
+		contexts = append(contexts, context)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// Files, mentions, reactions and polls are queried after the rows are closed to not hold two connections at once
+	for i := range messageList {
+		files, err := queryAttachments(s.DB, messageList[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		s.setWebAttachments(&messageList[i], files)
+
+		contexts[i].mentions, err = queryMentions(s.DB, messageList[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		messageList[i].Context = contexts[i].Context()
+
+		reactions, err := queryWebReactions(s.DB, messageList[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		if len(reactions.Reactions) > 0 {
+			messageList[i].Reactions = reactions
+		}
+		messageList[i].Poll, err = queryWebPoll(s.DB, messageList[i].ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return messageList, nil
+}
+
+// Returns the conversation chain of a message: the messages it replies to and all replies to it
+func (s *Server) getDBThreadHandler(w http.ResponseWriter, r *http.Request) {
+	messageID := r.URL.Query().Get("id")
+	if messageID == "" {
+		http.Error(w, "Missing id", http.StatusBadRequest)
+		return
+	}
+
+	sqlQuery := `
+        WITH RECURSIVE
+            ancestors(id, quoted_message_id) AS (
+                SELECT id, quoted_message_id FROM messages WHERE id = ?
+                UNION
+                SELECT messages.id, messages.quoted_message_id FROM messages JOIN ancestors ON messages.id = ancestors.quoted_message_id
+            ),
+            replies(id) AS (
+                SELECT id FROM messages WHERE id = ?
+                UNION
+                SELECT messages.id FROM messages JOIN replies ON messages.quoted_message_id = replies.id
+            )
+        SELECT ` + webMessageColumns + `
+        FROM messages
+        WHERE messages.id IN (SELECT id FROM ancestors UNION SELECT id FROM replies)
+        ORDER BY ts`
+
+	messages, err := s.DB.Query(sqlQuery, messageID, messageID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get thread: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer messages.Close()
+
+	messageList, err := s.scanWebMessages(messages)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to scan message: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if len(messageList) == 0 {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
 	}
 
 	json.NewEncoder(w).Encode(messageList)
 }
 
+// MessageRevision is a version of an edited message
+type MessageRevision struct {
+	Content   string `json:"content"`
+	Timestamp string `json:"timestamp"`
+}
+
+// Returns all versions of an edited message, starting with the original one
+func (s *Server) getDBRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	messageID := r.URL.Query().Get("id")
+	if messageID == "" {
+		http.Error(w, "Missing id", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := s.DB.Query(`SELECT content, timestamp FROM message_revisions WHERE message_id = ? ORDER BY id`, messageID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get revisions: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	revisions := []MessageRevision{}
+	for rows.Next() {
+		var revision MessageRevision
+		if err := rows.Scan(&revision.Content, &revision.Timestamp); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to scan revision: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err := encryptor.decryptTexts(&revision.Content); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decrypt revision: %v", err), http.StatusInternalServerError)
+			return
+		}
+		revisions = append(revisions, revision)
+	}
+
+	json.NewEncoder(w).Encode(revisions)
+}
+
+// WebReaction is a reaction of a sender to a message
+type WebReaction struct {
+	Sender    string `json:"sender"`
+	Emoji     string `json:"emoji"`
+	Timestamp string `json:"timestamp"`
+}
+
+// WebReactions are reactions to a message with the number of every emoji
+type WebReactions struct {
+	Counts    map[string]int `json:"counts"`
+	Reactions []WebReaction  `json:"reactions"`
+}
+
+// Returns reactions to a message
+func (s *Server) getDBReactionsHandler(w http.ResponseWriter, r *http.Request) {
+	messageID := r.URL.Query().Get("id")
+	if messageID == "" {
+		http.Error(w, "Missing id", http.StatusBadRequest)
+		return
+	}
+
+	result, err := queryWebReactions(s.DB, messageID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get reactions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(result)
+}
+
+// queryWebReactions returns the reactions to a message with the number of every emoji
+func queryWebReactions(db *DB, messageID string) (*WebReactions, error) {
+	rows, err := db.Query(`SELECT sender, emoji, timestamp FROM reactions WHERE message_id = ? ORDER BY timestamp`, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := &WebReactions{Counts: map[string]int{}, Reactions: []WebReaction{}}
+	for rows.Next() {
+		var reaction WebReaction
+		if err := rows.Scan(&reaction.Sender, &reaction.Emoji, &reaction.Timestamp); err != nil {
+			return nil, err
+		}
+		result.Counts[reaction.Emoji]++
+		result.Reactions = append(result.Reactions, reaction)
+	}
+	return result, rows.Err()
+}
+
+// WebSearchResult is a message matching a full-text query
+type WebSearchResult struct {
+	ID         string  `json:"id"`
+	Sender     string  `json:"sender"`
+	SenderName string  `json:"sender_name,omitempty"`
+	Chat       string  `json:"chat"`
+	ChatName   string  `json:"chat_name,omitempty"`
+	Content    string  `json:"content"`
+	Timestamp  string  `json:"timestamp"`
+	Rank       float64 `json:"rank"`
+	Snippet    string  `json:"snippet"`
+}
+
+// Returns messages matching a full-text query over content, OCR text and captions
+func (s *Server) getDBSearchHandler(w http.ResponseWriter, r *http.Request) {
+	terms := ParseSearchQuery(r.URL.Query().Get("q"))
+	if len(terms) == 0 {
+		http.Error(w, "Missing q", http.StatusBadRequest)
+		return
+	}
+
+	filter := SearchFilter{Terms: terms, Chat: r.URL.Query().Get("chat"), Limit: 50}
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 1 || value > 500 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = value
+	}
+	if offset := r.URL.Query().Get("offset"); offset != "" {
+		value, err := strconv.Atoi(offset)
+		if err != nil || value < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+		filter.Offset = value
+	}
+
+	// Encrypted content is indexed as ciphertext, so it's decrypted and matched before paging
+	if !s.DB.Dialect.FullTextSearch() || encryptor != nil {
+		results, err := s.scanSearchMessages(filter)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to search messages: %v", err), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(results)
+		return
+	}
+
+	query, args := s.DB.Dialect.SearchMessages(filter)
+	rows, err := s.DB.Query(query, args...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to search messages: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	results := []WebSearchResult{}
+	for rows.Next() {
+		var result WebSearchResult
+		var sender, chat, content, timestamp, senderName, chatName sql.NullString
+		if err := rows.Scan(&result.ID, &sender, &chat, &content, &timestamp, &result.Rank, &result.Snippet, &senderName, &chatName); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to scan message: %v", err), http.StatusInternalServerError)
+			return
+		}
+		result.Sender, result.Chat, result.Content, result.Timestamp = sender.String, chat.String, content.String, timestamp.String
+		result.SenderName, result.ChatName = senderName.String, chatName.String
+		// Unescapes plain content that starts like encrypted content
+		if err := encryptor.decryptTexts(&result.Content); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decrypt message: %v", err), http.StatusInternalServerError)
+			return
+		}
+		results = append(results, result)
+	}
+
+	json.NewEncoder(w).Encode(results)
+}
+
+// scanSearchMessages matches messages one by one, newest first, when the full-text index can't be used
+// or holds encrypted content
+func (s *Server) scanSearchMessages(filter SearchFilter) ([]WebSearchResult, error) {
+	query := `
+		SELECT messages.id, messages.sender, messages.chat, messages.content, messages.parsed_content,
+			messages.timestamp, files.caption, ` + directoryColumns + `
+		FROM messages
+		LEFT JOIN files ON files.message_id = messages.id`
+	var args []interface{}
+	if filter.Chat != "" {
+		query += ` WHERE messages.chat = ?`
+		args = append(args, filter.Chat)
+	}
+	query += ` ORDER BY messages.ts DESC, messages.id`
+	rows, err := s.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []WebSearchResult{}
+	skipped := 0
+	var candidate *WebSearchResult
+	var texts []string
+	// match adds the candidate to the results if its content, OCR text or a caption matches
+	match := func() error {
+		if candidate == nil {
+			return nil
+		}
+		for i := range texts {
+			if err := encryptor.decryptTexts(&texts[i]); err != nil {
+				return err
+			}
+		}
+		if !matchSearchTerms(filter.Terms, texts...) {
+			return nil
+		}
+		if skipped < filter.Offset {
+			skipped++
+			return nil
+		}
+		candidate.Content = texts[0]
+		candidate.Snippet = searchSnippet(filter.Terms, texts...)
+		results = append(results, *candidate)
+		return nil
+	}
+	// A message has a row for every file
+	for rows.Next() && len(results) < filter.Limit {
+		var id string
+		var sender, chat, content, parsedContent, timestamp, caption, senderName, chatName sql.NullString
+		if err := rows.Scan(&id, &sender, &chat, &content, &parsedContent, &timestamp, &caption, &senderName, &chatName); err != nil {
+			return nil, err
+		}
+		if candidate == nil || candidate.ID != id {
+			if err := match(); err != nil {
+				return nil, err
+			}
+			candidate = &WebSearchResult{ID: id, Sender: sender.String, Chat: chat.String, Timestamp: timestamp.String,
+				SenderName: senderName.String, ChatName: chatName.String}
+			texts = []string{content.String, parsedContent.String}
+		}
+		if caption.String != "" {
+			texts = append(texts, caption.String)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(results) < filter.Limit {
+		if err := match(); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// WebPollOption is an option of a poll with its voters
+type WebPollOption struct {
+	Name   string   `json:"name"`
+	Votes  int      `json:"votes"`
+	Voters []string `json:"voters"`
+}
+
+// WebPoll is a poll with its current results
+type WebPoll struct {
+	ID              string          `json:"id"`
+	Question        string          `json:"question"`
+	SelectableCount int             `json:"selectable_count"`
+	Options         []WebPollOption `json:"options"`
+}
+
+// Returns a poll with votes for every option
+func (s *Server) getDBPollHandler(w http.ResponseWriter, r *http.Request) {
+	pollID := r.URL.Query().Get("id")
+	if pollID == "" {
+		http.Error(w, "Missing id", http.StatusBadRequest)
+		return
+	}
+
+	poll, err := queryWebPoll(s.DB, pollID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get poll: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if poll == nil {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(poll)
+}
+
+// queryWebPoll returns the poll created by the message with votes for every option, or nil if the message isn't a poll
+func queryWebPoll(db *DB, pollID string) (*WebPoll, error) {
+	poll := &WebPoll{ID: pollID, Options: []WebPollOption{}}
+	err := db.QueryRow(`SELECT question, selectable_count FROM polls WHERE message_id = ?`, pollID).Scan(&poll.Question, &poll.SelectableCount)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+        SELECT poll_options.hash, poll_options.name, poll_votes.voter
+        FROM poll_options
+        LEFT JOIN poll_votes ON poll_votes.poll_id = poll_options.poll_id AND poll_votes.option_hash = poll_options.hash
+        WHERE poll_options.poll_id = ?
+        ORDER BY poll_options.position`, pollID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	optionIndexes := map[string]int{}
+	for rows.Next() {
+		var hash, name string
+		var voter sql.NullString
+		if err := rows.Scan(&hash, &name, &voter); err != nil {
+			return nil, err
+		}
+		i, ok := optionIndexes[hash]
+		if !ok {
+			i = len(poll.Options)
+			optionIndexes[hash] = i
+			poll.Options = append(poll.Options, WebPollOption{Name: name, Voters: []string{}})
+		}
+		if voter.Valid {
+			poll.Options[i].Votes++
+			poll.Options[i].Voters = append(poll.Options[i].Voters, voter.String)
+		}
+	}
+	return poll, rows.Err()
+}
+
+// LocationTrackPoint is a single live location update
+type LocationTrackPoint struct {
+	MessageID string   `json:"message_id"`
+	Sender    string   `json:"sender"`
+	Chat      string   `json:"chat"`
+	Location  Location `json:"location"`
+	Timestamp string   `json:"timestamp"`
+}
+
+// Returns live location updates of a sender, optionally limited to a chat
+func (s *Server) getDBLocationsHandler(w http.ResponseWriter, r *http.Request) {
+	sender := r.URL.Query().Get("sender")
+	chat := r.URL.Query().Get("chat")
+
+	if sender == "" {
+		http.Error(w, "Missing sender", http.StatusBadRequest)
+		return
+	}
+
+	sqlQuery := `
+        SELECT message_id, sender, chat, latitude, longitude, accuracy, speed, heading, sequence, timestamp
+        FROM location_tracks
+        WHERE sender = ?`
+	args := []interface{}{sender}
+	if chat != "" {
+		sqlQuery += " AND chat = ?"
+		args = append(args, chat)
+	}
+	sqlQuery += " ORDER BY id"
+
+	rows, err := s.DB.Query(sqlQuery, args...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get locations: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	points := []LocationTrackPoint{}
+	for rows.Next() {
+		point := LocationTrackPoint{Location: Location{Live: true}}
+		if err := rows.Scan(&point.MessageID, &point.Sender, &point.Chat, &point.Location.Latitude, &point.Location.Longitude,
+			&point.Location.Accuracy, &point.Location.Speed, &point.Location.Heading, &point.Location.Sequence, &point.Timestamp); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to scan location: %v", err), http.StatusInternalServerError)
+			return
+		}
+		points = append(points, point)
+	}
+
+	json.NewEncoder(w).Encode(points)
+}
+
+// WebGroupEvent is a change of a group in its audit log
+type WebGroupEvent struct {
+	Chat            string `json:"chat"`
+	ChatName        string `json:"chat_name,omitempty"`
+	Type            string `json:"type"`
+	Actor           string `json:"actor,omitempty"`
+	ActorName       string `json:"actor_name,omitempty"`
+	Participant     string `json:"participant,omitempty"`
+	ParticipantName string `json:"participant_name,omitempty"`
+	Value           string `json:"value,omitempty"`
+	Reason          string `json:"reason,omitempty"`
+	Timestamp       string `json:"timestamp"`
+}
+
+// Returns changes of groups, optionally limited to a chat and to a date range
+func (s *Server) getDBGroupEventsHandler(w http.ResponseWriter, r *http.Request) {
+	chat := r.URL.Query().Get("chat")
+	dateFromStr := r.URL.Query().Get("from")
+	dateToStr := r.URL.Query().Get("to")
+
+	sqlQuery := `
+        SELECT chat, coalesce((SELECT name FROM chats WHERE chats.jid = group_events.chat), ''), type,
+            actor, (SELECT name FROM contacts WHERE contacts.jid = group_events.actor),
+            participant, (SELECT name FROM contacts WHERE contacts.jid = group_events.participant),
+            value, reason, timestamp
+        FROM group_events
+        WHERE 1 = 1`
+	var args []interface{}
+	if chat != "" {
+		sqlQuery += " AND chat = ?"
+		args = append(args, chat)
+	}
+	if dateFromStr != "" {
+		dateFrom, err := time.Parse("02.01.2006", dateFromStr)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid from format: %v", err), http.StatusBadRequest)
+			return
+		}
+		sqlQuery += " AND ts >= ?"
+		args = append(args, startOfDay(dateFrom).Unix())
+	}
+	if dateToStr != "" {
+		dateTo, err := time.Parse("02.01.2006", dateToStr)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid to format: %v", err), http.StatusBadRequest)
+			return
+		}
+		sqlQuery += " AND ts < ?"
+		args = append(args, startOfDay(dateTo).AddDate(0, 0, 1).Unix())
+	}
+	sqlQuery += " ORDER BY ts DESC, id"
+
+	rows, err := s.DB.Query(sqlQuery, args...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get group events: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	groupEvents := []WebGroupEvent{}
+	for rows.Next() {
+		var event WebGroupEvent
+		var actor, actorName, participant, participantName, value, reason sql.NullString
+		if err := rows.Scan(&event.Chat, &event.ChatName, &event.Type, &actor, &actorName, &participant, &participantName,
+			&value, &reason, &event.Timestamp); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to scan group event: %v", err), http.StatusInternalServerError)
+			return
+		}
+		event.Actor, event.ActorName = actor.String, actorName.String
+		event.Participant, event.ParticipantName = participant.String, participantName.String
+		event.Value, event.Reason = value.String, reason.String
+		groupEvents = append(groupEvents, event)
+	}
+
+	json.NewEncoder(w).Encode(groupEvents)
+}
+
+const (
+	defaultDeliveriesLimit = 100
+	maxDeliveriesLimit     = 1000
+)
+
+// getWebhookDeliveriesHandler returns the newest webhook deliveries, optionally of one target, message or outcome
+func (s *Server) getWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	sqlQuery := `
+        SELECT id, target, url, message_id, event, idempotency_key, attempt, status_code, success, error, duration_ms, ts
+        FROM webhook_deliveries
+        WHERE 1 = 1`
+	var args []interface{}
+	if target := r.URL.Query().Get("target"); target != "" {
+		sqlQuery += " AND target = ?"
+		args = append(args, strings.TrimPrefix(target, webhookTrackerPrefix))
+	}
+	if messageID := r.URL.Query().Get("message_id"); messageID != "" {
+		sqlQuery += " AND message_id = ?"
+		args = append(args, messageID)
+	}
+	if success := r.URL.Query().Get("success"); success != "" {
+		value, err := strconv.ParseBool(success)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid success: %v", err), http.StatusBadRequest)
+			return
+		}
+		sqlQuery += " AND success = ?"
+		args = append(args, value)
+	}
+	limit := defaultDeliveriesLimit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		if limit > maxDeliveriesLimit {
+			limit = maxDeliveriesLimit
+		}
+	}
+	sqlQuery += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := s.DB.Query(sqlQuery, args...)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get webhook deliveries: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var delivery WebhookDelivery
+		var url, messageID, event, idempotencyKey, deliveryError sql.NullString
+		var attempt, statusCode, durationMs, ts sql.NullInt64
+		if err := rows.Scan(&delivery.ID, &delivery.Target, &url, &messageID, &event, &idempotencyKey, &attempt, &statusCode,
+			&delivery.Success, &deliveryError, &durationMs, &ts); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to scan webhook delivery: %v", err), http.StatusInternalServerError)
+			return
+		}
+		delivery.URL, delivery.MessageID, delivery.Event = url.String, messageID.String, event.String
+		delivery.IdempotencyKey, delivery.Error = idempotencyKey.String, deliveryError.String
+		delivery.Attempt, delivery.StatusCode, delivery.DurationMs = int(attempt.Int64), int(statusCode.Int64), durationMs.Int64
+		delivery.Timestamp = time.Unix(ts.Int64, 0).Format(time.RFC3339)
+		deliveries = append(deliveries, delivery)
+	}
+
+	json.NewEncoder(w).Encode(deliveries)
+}
+
 // Middleware to handle CORS
 func (s *Server) corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -203,11 +966,11 @@ func (s *Server) corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func CreateServer(config *Config, db *sql.DB) *Server {
+func CreateServer(configs *ConfigHolder, db *DB) *Server {
 	server := &Server{
 		DB:              db,
-		config:          config,
-		fileStoragePath: config.FileStoragePath,
+		config:          configs,
+		fileStoragePath: configs.Get().FileStoragePath,
 	}
 	server.InitWebSocket() // Initialize WebSocket
 	return server
@@ -220,10 +983,19 @@ func RunServer(server *Server) {
 	// Register your handlers
 	mux.HandleFunc("/chats", server.getDBChatsHandler)
 	mux.HandleFunc("/messages", server.getDBMessagesHandler)
+	mux.HandleFunc("/locations", server.getDBLocationsHandler)
+	mux.HandleFunc("/revisions", server.getDBRevisionsHandler)
+	mux.HandleFunc("/thread", server.getDBThreadHandler)
+	mux.HandleFunc("/reactions", server.getDBReactionsHandler)
+	mux.HandleFunc("/polls", server.getDBPollHandler)
+	mux.HandleFunc("/search", server.getDBSearchHandler)
+	mux.HandleFunc("/group-events", server.getDBGroupEventsHandler)
+	mux.HandleFunc("/webhook-deliveries", server.getWebhookDeliveriesHandler)
 	mux.HandleFunc("/ws", server.handleWebSocket) // WebSocket endpoint
+	mux.HandleFunc("/ws/events", server.handleEventsWebSocket)
 
 	// Serve static files from the "data" directory at the "files" path
-	fsData := http.StripPrefix(FileWebPathPrefix+"/", http.FileServer(http.Dir(server.fileStoragePath)))
+	fsData := http.StripPrefix(FileWebPathPrefix+"/", server.fileHandler())
 	mux.Handle(FileWebPathPrefix+"/", fsData)
 
 	// Serve static files from the "./static" directory at the root path "/"
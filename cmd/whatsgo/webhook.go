@@ -2,59 +2,373 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"math/rand"
 	"net/http"
-	"sync"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
 )
 
+const (
+	defaultWebhookTimeout = 10 * time.Second
+	webhookTrackerPrefix  = "webhook:"
+)
+
+// Headers of webhook requests
+const (
+	webhookSignatureHeader      = "X-Whatsgo-Signature"
+	webhookTimestampHeader      = "X-Whatsgo-Timestamp"
+	webhookEventHeader          = "X-Whatsgo-Event"
+	webhookIdempotencyKeyHeader = "Idempotency-Key"
+)
+
+// WebhookTracker posts events to one webhook target. Every target is a separate tracker,
+// so a failing target is retried on its own and doesn't hold back the others.
 type WebhookTracker struct {
-	WebhookURLs []string
+	db              *DB
+	target          WebhookTarget
+	retry           RetryConfig
+	client          *http.Client
+	template        *template.Template
+	fileStoragePath string
+	filesBaseURL    string
+}
+
+func (w *WebhookTracker) Name() string {
+	return webhookTrackerPrefix + w.target.Name
 }
 
 func (w *WebhookTracker) Init(config *Config) error {
-	w.WebhookURLs = config.Webhook.URLs
+	for _, target := range config.Webhook.GetTargets() {
+		if target.Name == w.target.Name {
+			w.target = target
+		}
+	}
+	if w.target.Timeout <= 0 {
+		w.target.Timeout = defaultWebhookTimeout
+	}
+	w.retry = RetryConfig{MaxAttempts: config.Queue.MaxAttempts, BaseDelay: config.Queue.BaseDelay, MaxDelay: config.Queue.MaxDelay}
+	if w.target.Retry.MaxAttempts > 0 {
+		w.retry.MaxAttempts = w.target.Retry.MaxAttempts
+	}
+	if w.target.Retry.BaseDelay > 0 {
+		w.retry.BaseDelay = w.target.Retry.BaseDelay
+	}
+	if w.target.Retry.MaxDelay > 0 {
+		w.retry.MaxDelay = w.target.Retry.MaxDelay
+	}
+	if w.retry.BaseDelay <= 0 {
+		w.retry.BaseDelay = defaultQueueBaseDelay
+	}
+	if w.retry.MaxDelay <= 0 {
+		w.retry.MaxDelay = defaultQueueMaxDelay
+	}
+	w.client = &http.Client{Timeout: w.target.Timeout}
+	w.fileStoragePath = config.FileStoragePath
+	w.filesBaseURL = strings.TrimSuffix(config.Webhook.FilesBaseURL, "/")
+	if w.target.Template != "" {
+		var err error
+		w.template, err = parseWebhookTemplate(w.target.Name, w.target.Template, config)
+		if err != nil {
+			return fmt.Errorf("invalid template of webhook %s: %w", w.target.Name, err)
+		}
+	}
 	return nil
 }
 
+// MaxAttempts returns the number of attempts before the delivery is given up
+func (w *WebhookTracker) MaxAttempts() int {
+	return w.retry.MaxAttempts
+}
+
+// RetryDelay doubles the delay after every attempt and picks a random point in its upper half,
+// so deliveries that failed together aren't retried together
+func (w *WebhookTracker) RetryDelay(attempts int) time.Duration {
+	delay := w.retry.BaseDelay
+	for i := 1; i < attempts && delay < w.retry.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > w.retry.MaxDelay {
+		delay = w.retry.MaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// idempotencyKey is the same for every attempt to deliver an event to a target
+func (w *WebhookTracker) idempotencyKey(message *TrackableMessage) string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{w.Name(), message.Event, message.MessageID, message.EventTimestamp}, "\n")))
+	return hex.EncodeToString(hash[:16])
+}
+
+// sign returns the HMAC-SHA256 of the timestamp and the body, joined by a dot
+func sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *WebhookTracker) accepts(statusCode int) bool {
+	if len(w.target.AcceptedCodes) == 0 {
+		return statusCode >= 200 && statusCode < 300
+	}
+	for _, code := range w.target.AcceptedCodes {
+		if code == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
 func (w *WebhookTracker) TrackMessage(message *TrackableMessage) error {
-	data, err := json.Marshal(message)
+	if len(w.target.Events) > 0 && !containsString(w.target.Events, message.Event) {
+		log.Debugf("Skipping %s of %s, webhook %s doesn't receive it", message.Event, message.MessageID, w.target.Name)
+		return nil
+	}
+	delivery := WebhookDelivery{
+		Target:         w.target.Name,
+		URL:            w.target.URL,
+		MessageID:      message.MessageID,
+		Event:          message.Event,
+		IdempotencyKey: w.idempotencyKey(message),
+	}
+	// The same event fails to render on every attempt, so it isn't retried
+	if w.target.Template != "" && w.template == nil {
+		return &PermanentError{fmt.Errorf("webhook %s isn't sent, its template is invalid", w.target.Name)}
+	}
+	data, contentType, err := w.body(message, delivery.IdempotencyKey)
 	if err != nil {
-		return err
+		return &PermanentError{fmt.Errorf("failed to render webhook for %s: %w", w.target.Name, err)}
+	}
+	// A template that renders nothing doesn't apply to the event
+	if w.template != nil && len(bytes.TrimSpace(data)) == 0 {
+		log.Debugf("Skipping %s of %s, the template of webhook %s is empty for it", message.Event, message.MessageID, w.target.Name)
+		return nil
 	}
 
-	var (
-		allErrors []error
-		mutex     sync.Mutex
-		wg        sync.WaitGroup
-	)
-
-	for _, url := range w.WebhookURLs {
-		wg.Add(1)
-		go func(url string) {
-			defer wg.Done()
-			resp, err := http.Post(url, "application/json", bytes.NewBuffer(data))
-			if err != nil {
-				mutex.Lock()
-				allErrors = append(allErrors, fmt.Errorf("failed to send webhook to %s: %v", url, err))
-				mutex.Unlock()
-				return
-			}
-			defer resp.Body.Close()
+	start := time.Now()
+	delivery.StatusCode, err = w.post(data, contentType, message.Event, delivery.IdempotencyKey)
+	delivery.Duration = time.Since(start)
+	if err == nil && !w.accepts(delivery.StatusCode) {
+		err = fmt.Errorf("unexpected status %d", delivery.StatusCode)
+	}
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	delivery.Success = err == nil
+	if logErr := w.logDelivery(&delivery, start); logErr != nil {
+		log.Warnf("Failed to log delivery of %s to webhook %s: %v", message.MessageID, w.target.Name, logErr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to send webhook to %s: %w", w.target.Name, err)
+	}
+	return nil
+}
 
-			if resp.StatusCode != http.StatusOK {
-				mutex.Lock()
-				allErrors = append(allErrors, fmt.Errorf("failed to send webhook to %s: %s", url, resp.Status))
-				mutex.Unlock()
-			}
-		}(url)
+func (w *WebhookTracker) post(body []byte, contentType string, event string, idempotencyKey string) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, w.target.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for name, value := range w.target.Headers {
+		req.Header.Set(name, value)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookEventHeader, event)
+	req.Header.Set(webhookIdempotencyKeyHeader, idempotencyKey)
+	if w.target.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, sign(w.target.Secret, timestamp, body))
 	}
 
-	wg.Wait()
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection is reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, nil
+}
+
+// WebhookDelivery is an attempt to deliver an event to a webhook target
+type WebhookDelivery struct {
+	ID             int64         `json:"id"`
+	Target         string        `json:"target"`
+	URL            string        `json:"url"`
+	MessageID      string        `json:"message_id"`
+	Event          string        `json:"event"`
+	IdempotencyKey string        `json:"idempotency_key"`
+	Attempt        int           `json:"attempt"`
+	StatusCode     int           `json:"status_code,omitempty"`
+	Success        bool          `json:"success"`
+	Error          string        `json:"error,omitempty"`
+	Duration       time.Duration `json:"-"`
+	DurationMs     int64         `json:"duration_ms"`
+	Timestamp      string        `json:"timestamp"`
+}
 
-	if len(allErrors) > 0 {
-		return fmt.Errorf("encountered errors: %v", allErrors)
+// logDelivery stores the attempt, attempts are counted by the idempotency key
+func (w *WebhookTracker) logDelivery(delivery *WebhookDelivery, start time.Time) error {
+	if w.db == nil {
+		return nil
+	}
+	err := w.db.QueryRow(`SELECT COUNT(*) FROM webhook_deliveries WHERE idempotency_key = ?`, delivery.IdempotencyKey).Scan(&delivery.Attempt)
+	if err != nil {
+		return err
+	}
+	delivery.Attempt++
+	_, err = w.db.Exec(`
+		INSERT INTO webhook_deliveries (target, url, message_id, event, idempotency_key, attempt, status_code, success, error, duration_ms, ts)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		delivery.Target, delivery.URL, delivery.MessageID, delivery.Event, delivery.IdempotencyKey, delivery.Attempt,
+		nullInt(delivery.StatusCode), delivery.Success, nullString(delivery.Error), delivery.Duration.Milliseconds(), start.Unix())
+	return err
+}
+
+// runWebhookCommand handles `whatsgo webhook test <target> [event]`, which sends a sample event to a target,
+// and `whatsgo webhook echo [address] [secret]`, which prints requests it receives, so targets can be tried locally
+func runWebhookCommand(config *Config, args []string) error {
+	command := ""
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch command {
+	case "test":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: whatsgo webhook test <target> [event]")
+		}
+		event := EventMessageCreated
+		if len(args) > 2 {
+			event = args[2]
+		}
+		return testWebhook(config, args[1], event)
+	case "echo":
+		address := "localhost:9090"
+		if len(args) > 1 {
+			address = args[1]
+		}
+		secret := ""
+		if len(args) > 2 {
+			secret = args[2]
+		}
+		return runWebhookEcho(address, secret)
+	}
+	return fmt.Errorf("usage: whatsgo webhook test <target> [event] | echo [address] [secret]")
+}
+
+// testWebhook sends a sample event to the target, the delivery isn't logged
+func testWebhook(config *Config, name string, event string) error {
+	found := false
+	for _, target := range config.Webhook.GetTargets() {
+		found = found || target.Name == name
+	}
+	if !found {
+		return fmt.Errorf("unknown webhook target %q", name)
+	}
+	message, err := sampleWebhookMessage(config, event)
+	if err != nil {
+		return err
 	}
 
+	tracker := &WebhookTracker{target: WebhookTarget{Name: name}}
+	err = tracker.Init(config)
+	if err != nil {
+		return err
+	}
+	key := tracker.idempotencyKey(message)
+	body, contentType, err := tracker.body(message, key)
+	if err != nil {
+		return fmt.Errorf("failed to render webhook: %w", err)
+	}
+	fmt.Printf("%s\n", body)
+	statusCode, err := tracker.post(body, contentType, message.Event, key)
+	if err != nil {
+		return err
+	}
+	if !tracker.accepts(statusCode) {
+		return fmt.Errorf("webhook %s answered with unexpected status %d", name, statusCode)
+	}
+	log.Infof("Webhook %s accepted the %s event with status %d", name, event, statusCode)
 	return nil
 }
+
+// sampleWebhookMessage returns an event of the type in the first tracked chat
+func sampleWebhookMessage(config *Config, event string) (*TrackableMessage, error) {
+	now := time.Now().Round(0)
+	message := &TrackableMessage{
+		Event:      event,
+		MessageID:  "TEST" + strconv.FormatInt(now.Unix(), 10),
+		Sender:     "380501234567@s.whatsapp.net",
+		SenderName: "Test Sender",
+		Chat:       "120363000000000000@g.us",
+		ChatName:   "Test Chat",
+		Content:    "Test message from whatsgo",
+		Timestamp:  now.String(),
+		Metadata:   MessageMetadata{Date: now.Format("02.01.2006"), Timestamp: now},
+	}
+	if len(config.Chats) > 0 {
+		message.Chat = config.Chats[0].ID
+	}
+	message.Metadata.Folder = config.GetChatFolder(message.Chat)
+
+	switch event {
+	case EventMessageCreated:
+		message.Files = []Attachment{{ID: "test", Path: config.FileStoragePath + "/" + message.Metadata.Folder + "/test.jpg",
+			MimeType: "image/jpeg", Size: 1024, Caption: "Test caption"}}
+	case EventMessageEdited, EventMessageRevoked:
+		message.EventTimestamp = now.String()
+	case EventReaction:
+		message.Reaction = &Reaction{MessageID: message.MessageID, Emoji: "👍"}
+	case EventPollVote:
+		message.PollVote = &PollVote{PollID: message.MessageID, Options: []PollOption{{Name: "Yes"}}}
+	case EventGroupChange:
+		message.GroupChange = &GroupChange{Type: GroupChangeJoin, Participants: []string{message.Sender}}
+	case EventConnection:
+		message.Chat, message.ChatName, message.Sender, message.SenderName, message.Content = "", "", "", "", ""
+		message.Connection = &ConnectionState{State: ConnectionConnected}
+	default:
+		return nil, fmt.Errorf("unknown event %q, known events: %s", event, strings.Join(trackableEvents, ", "))
+	}
+	return message, nil
+}
+
+// runWebhookEcho prints the requests it receives and checks their signatures if the secret is given
+func runWebhookEcho(address string, secret string) error {
+	log.Infof("Printing webhooks received at http://%s", address)
+	return http.ListenAndServe(address, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var names []string
+		for name := range r.Header {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Printf("%s %s\n", r.Method, r.URL)
+		for _, name := range names {
+			fmt.Printf("%s: %s\n", name, strings.Join(r.Header[name], ", "))
+		}
+		fmt.Printf("\n%s\n\n", body)
+		if secret != "" {
+			expected := sign(secret, r.Header.Get(webhookTimestampHeader), body)
+			if !hmac.Equal([]byte(expected), []byte(r.Header.Get(webhookSignatureHeader))) {
+				log.Warnf("Invalid signature, expected %s", expected)
+				http.Error(w, "invalid signature", http.StatusUnauthorized)
+				return
+			}
+			log.Infof("Signature is valid")
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+}
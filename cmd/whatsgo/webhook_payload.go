@@ -0,0 +1,168 @@
+package main
+
+import "time"
+
+// webhookPayloadVersion is increased on changes of the payload that break receivers,
+// new fields are added without a new version
+const webhookPayloadVersion = 1
+
+// Payloads of webhook targets
+const (
+	webhookPayloadEnvelope = "envelope"
+	webhookPayloadRaw      = "raw"
+)
+
+// WebhookEvent is the envelope of every webhook request. ID is the idempotency key of the event,
+// Data is one of the Webhook*Data types or a ConnectionState depending on Type.
+type WebhookEvent struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	Version   int         `json:"version"`
+	Timestamp string      `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// WebhookParty is a chat or a user with the name known at the time of the event
+type WebhookParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+// WebhookMessageData is the data of message.created, message.edited and message.revoked events.
+// Edits carry the new text, revocations the text that was revoked if the message was stored.
+type WebhookMessageData struct {
+	ID          string          `json:"id"`
+	Chat        WebhookParty    `json:"chat"`
+	Sender      WebhookParty    `json:"sender"`
+	Timestamp   string          `json:"timestamp"`
+	Type        string          `json:"type"`
+	Text        string          `json:"text,omitempty"`
+	ParsedText  string          `json:"parsed_text,omitempty"`
+	Attachments []WebAttachment `json:"attachments,omitempty"`
+	Location    *Location       `json:"location,omitempty"`
+	Context     *MessageContext `json:"context,omitempty"`
+	Poll        *Poll           `json:"poll,omitempty"`
+	Annotations []Annotation    `json:"annotations,omitempty"`
+	EditedAt    string          `json:"edited_at,omitempty"`
+	RevokedAt   string          `json:"revoked_at,omitempty"`
+}
+
+// WebhookReactionData is the data of reaction events, an empty emoji removes the reaction
+type WebhookReactionData struct {
+	ID        string       `json:"id"`
+	Chat      WebhookParty `json:"chat"`
+	Sender    WebhookParty `json:"sender"`
+	Timestamp string       `json:"timestamp"`
+	MessageID string       `json:"message_id"`
+	Emoji     string       `json:"emoji"`
+	Removed   bool         `json:"removed"`
+}
+
+// WebhookPollVoteData is the data of poll.vote events, the options replace the previous vote of the sender
+type WebhookPollVoteData struct {
+	ID        string       `json:"id"`
+	Chat      WebhookParty `json:"chat"`
+	Sender    WebhookParty `json:"sender"`
+	Timestamp string       `json:"timestamp"`
+	PollID    string       `json:"poll_id"`
+	Options   []PollOption `json:"options"`
+}
+
+// WebhookGroupChangeData is the data of group.change events, the actor is missing when WhatsApp doesn't tell it
+type WebhookGroupChangeData struct {
+	Chat      WebhookParty  `json:"chat"`
+	Actor     *WebhookParty `json:"actor,omitempty"`
+	Timestamp string        `json:"timestamp"`
+	GroupChange
+}
+
+// webhookEvent converts the message to the envelope sent to webhooks
+func (w *WebhookTracker) webhookEvent(message *TrackableMessage, id string) WebhookEvent {
+	sent := webhookTime(message)
+	event := WebhookEvent{
+		ID:        id,
+		Type:      message.Event,
+		Version:   webhookPayloadVersion,
+		Timestamp: sent,
+	}
+	chat := WebhookParty{ID: message.Chat, Name: message.ChatName}
+	sender := WebhookParty{ID: message.Sender, Name: message.SenderName}
+
+	switch message.Event {
+	case EventReaction:
+		data := WebhookReactionData{ID: message.MessageID, Chat: chat, Sender: sender, Timestamp: sent}
+		if message.Reaction != nil {
+			data.MessageID, data.Emoji, data.Removed = message.Reaction.MessageID, message.Reaction.Emoji, message.Reaction.Emoji == ""
+		}
+		event.Data = data
+	case EventPollVote:
+		data := WebhookPollVoteData{ID: message.MessageID, Chat: chat, Sender: sender, Timestamp: sent}
+		if message.PollVote != nil {
+			data.PollID, data.Options = message.PollVote.PollID, message.PollVote.Options
+		}
+		event.Data = data
+	case EventGroupChange:
+		data := WebhookGroupChangeData{Chat: chat, Timestamp: sent}
+		if message.Sender != "" {
+			data.Actor = &sender
+		}
+		if message.GroupChange != nil {
+			data.GroupChange = *message.GroupChange
+		}
+		event.Data = data
+	case EventConnection:
+		event.Data = message.Connection
+	default:
+		data := WebhookMessageData{
+			ID:          message.MessageID,
+			Chat:        chat,
+			Sender:      sender,
+			Timestamp:   sent,
+			Type:        messageType(message),
+			Text:        message.Content,
+			ParsedText:  message.ParsedContent,
+			Location:    message.Location,
+			Context:     message.Context,
+			Poll:        message.Poll,
+			Annotations: message.Annotations,
+		}
+		for _, file := range message.Files {
+			data.Attachments = append(data.Attachments, WebAttachment{
+				ID:       file.ID,
+				URL:      w.filesBaseURL + fileURL(w.fileStoragePath, file.Path),
+				MimeType: file.MimeType,
+				Size:     file.Size,
+				SHA256:   file.SHA256,
+				FileName: file.FileName,
+				Caption:  file.Caption,
+				Width:    file.Width,
+				Height:   file.Height,
+				Duration: file.Duration,
+			})
+		}
+		// Edits and revocations happen later than the message was sent
+		if changed, err := parseMessageTimestamp(message.EventTimestamp); err == nil {
+			event.Timestamp = formatWebhookTime(changed)
+			if message.Event == EventMessageEdited {
+				data.EditedAt = event.Timestamp
+			} else if message.Event == EventMessageRevoked {
+				data.RevokedAt = event.Timestamp
+			}
+		}
+		event.Data = data
+	}
+	return event
+}
+
+// webhookTime returns the time the message was sent in the format of webhook payloads
+func webhookTime(message *TrackableMessage) string {
+	timestamp, err := messageTime(message)
+	if err != nil {
+		return message.Timestamp
+	}
+	return formatWebhookTime(timestamp)
+}
+
+func formatWebhookTime(timestamp time.Time) string {
+	return timestamp.UTC().Format(time.RFC3339)
+}
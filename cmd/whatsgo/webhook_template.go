@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+const defaultWebhookContentType = "application/json"
+
+// parseWebhookTemplate parses the body template of a webhook target
+func parseWebhookTemplate(name string, text string, config *Config) (*template.Template, error) {
+	return template.New(name).Funcs(webhookTemplateFuncs(config)).Parse(text)
+}
+
+// webhookTemplateFuncs are the helpers available in body templates
+func webhookTemplateFuncs(config *Config) template.FuncMap {
+	return template.FuncMap{
+		// chatAlias returns the alias of the chat from the config, its name or its ID
+		"chatAlias": func(chat WebhookParty) string {
+			if alias := config.GetChatFolder(chat.ID); alias != chat.ID {
+				return alias
+			}
+			if chat.Name != "" {
+				return chat.Name
+			}
+			return chat.ID
+		},
+		// senderName returns the name of the sender or the phone number
+		"senderName": func(sender WebhookParty) string {
+			if sender.Name != "" {
+				return sender.Name
+			}
+			if jid, err := types.ParseJID(sender.ID); err == nil && jid.Server == types.DefaultUserServer {
+				return "+" + jid.User
+			}
+			return sender.ID
+		},
+		"truncate":        truncateText,
+		"attachmentLinks": attachmentLinks,
+		"join": func(separator string, values []string) string {
+			return strings.Join(values, separator)
+		},
+		// json quotes the value for JSON bodies, e.g. "text": {{json .Data.Text}}
+		"json": func(value interface{}) (string, error) {
+			data, err := json.Marshal(value)
+			return string(data), err
+		},
+		"default": func(fallback string, value string) string {
+			if value == "" {
+				return fallback
+			}
+			return value
+		},
+	}
+}
+
+// truncateText shortens the text to the number of characters, including the ellipsis that replaces the rest
+func truncateText(length int, text string) string {
+	if length <= 0 || utf8.RuneCountInString(text) <= length {
+		return text
+	}
+	runes := []rune(text)
+	return string(runes[:length-1]) + "…"
+}
+
+// attachmentLinks returns the URLs of the attachments
+func attachmentLinks(attachments []WebAttachment) []string {
+	links := make([]string, 0, len(attachments))
+	for _, attachment := range attachments {
+		links = append(links, attachment.URL)
+	}
+	return links
+}
+
+// body returns the body of the request and its content type
+func (w *WebhookTracker) body(message *TrackableMessage, id string) ([]byte, string, error) {
+	contentType := w.target.ContentType
+	if contentType == "" {
+		contentType = defaultWebhookContentType
+	}
+	if w.target.Payload == webhookPayloadRaw {
+		data, err := json.Marshal(message)
+		return data, contentType, err
+	}
+	event := w.webhookEvent(message, id)
+	if w.template == nil {
+		data, err := json.Marshal(event)
+		return data, contentType, err
+	}
+	var buf bytes.Buffer
+	err := w.template.Execute(&buf, event)
+	return buf.Bytes(), contentType, err
+}
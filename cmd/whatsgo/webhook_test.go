@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookRequest is a request received by the test server
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// newWebhookServer starts a stand-in for a webhook target that records requests and answers with the status
+func newWebhookServer(t *testing.T, status int) (*httptest.Server, func() []webhookRequest) {
+	var mu sync.Mutex
+	var requests []webhookRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, webhookRequest{header: r.Header.Clone(), body: body})
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []webhookRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]webhookRequest{}, requests...)
+	}
+}
+
+func newTestWebhookTracker(t *testing.T, target WebhookTarget) *WebhookTracker {
+	config := &Config{
+		Chats:           []Chat{{ID: "123@g.us", Alias: "Ops"}},
+		FileStoragePath: "data/files",
+		Webhook:         WebhookConfig{Enabled: true, FilesBaseURL: "https://whatsgo.example.com/", Targets: []WebhookTarget{target}},
+	}
+	tracker := &WebhookTracker{target: WebhookTarget{Name: target.Name}}
+	if err := tracker.Init(config); err != nil {
+		t.Fatalf("Init() error = %v", err)
+	}
+	return tracker
+}
+
+func testWebhookMessages() map[string]*TrackableMessage {
+	sent := time.Date(2024, 5, 1, 10, 0, 0, 0, time.FixedZone("EEST", 3*3600))
+	base := TrackableMessage{
+		MessageID:  "M1",
+		Chat:       "123@g.us",
+		ChatName:   "Operations",
+		Sender:     "380501234567@s.whatsapp.net",
+		SenderName: "",
+		Timestamp:  sent.String(),
+		Metadata:   MessageMetadata{Timestamp: sent},
+	}
+	created := base
+	created.Event = EventMessageCreated
+	created.Content = "Server is down again"
+	created.Files = []Attachment{{ID: "F1", Path: "data/files/Ops/01.05.2024/photo.jpg", MimeType: "image/jpeg", Size: 10}}
+	edited := base
+	edited.Event = EventMessageEdited
+	edited.Content = "Server is up"
+	edited.EventTimestamp = sent.Add(time.Minute).String()
+	reaction := base
+	reaction.Event = EventReaction
+	reaction.Reaction = &Reaction{MessageID: "M0"}
+	change := base
+	change.Event = EventGroupChange
+	change.Sender = ""
+	change.GroupChange = &GroupChange{Type: GroupChangeJoin, Participants: []string{"380671234567@s.whatsapp.net"}}
+	connection := TrackableMessage{Event: EventConnection, MessageID: "C1", Timestamp: sent.String(), Metadata: base.Metadata,
+		Connection: &ConnectionState{State: ConnectionDisconnected}}
+	return map[string]*TrackableMessage{
+		EventMessageCreated: &created,
+		EventMessageEdited:  &edited,
+		EventReaction:       &reaction,
+		EventGroupChange:    &change,
+		EventConnection:     &connection,
+	}
+}
+
+func TestWebhookBody(t *testing.T) {
+	messages := testWebhookMessages()
+	slack := `{{if eq .Type "message.created"}}{"text": {{json (printf "%s in %s: %s" (senderName .Data.Sender) (chatAlias .Data.Chat) (truncate 10 .Data.Text))}}, "links": {{json (attachmentLinks .Data.Attachments | join " ")}}}{{end}}`
+
+	tests := []struct {
+		name        string
+		target      WebhookTarget
+		event       string
+		want        string
+		contentType string
+	}{
+		{
+			name:  "envelope of a message",
+			event: EventMessageCreated,
+			want: `{"id":"key","type":"message.created","version":1,"timestamp":"2024-05-01T07:00:00Z","data":{"id":"M1",` +
+				`"chat":{"id":"123@g.us","name":"Operations"},"sender":{"id":"380501234567@s.whatsapp.net"},"timestamp":"2024-05-01T07:00:00Z",` +
+				`"type":"image","text":"Server is down again","attachments":[{"id":"F1","url":"https://whatsgo.example.com/files/Ops/01.05.2024/photo.jpg",` +
+				`"mime_type":"image/jpeg","size":10}]}}`,
+			contentType: "application/json",
+		},
+		{
+			name:  "envelope of an edit",
+			event: EventMessageEdited,
+			want: `{"id":"key","type":"message.edited","version":1,"timestamp":"2024-05-01T07:01:00Z","data":{"id":"M1",` +
+				`"chat":{"id":"123@g.us","name":"Operations"},"sender":{"id":"380501234567@s.whatsapp.net"},"timestamp":"2024-05-01T07:00:00Z",` +
+				`"type":"text","text":"Server is up","edited_at":"2024-05-01T07:01:00Z"}}`,
+			contentType: "application/json",
+		},
+		{
+			name:  "envelope of a removed reaction",
+			event: EventReaction,
+			want: `{"id":"key","type":"reaction","version":1,"timestamp":"2024-05-01T07:00:00Z","data":{"id":"M1",` +
+				`"chat":{"id":"123@g.us","name":"Operations"},"sender":{"id":"380501234567@s.whatsapp.net"},"timestamp":"2024-05-01T07:00:00Z",` +
+				`"message_id":"M0","emoji":"","removed":true}}`,
+			contentType: "application/json",
+		},
+		{
+			name:  "envelope of a group change without actor",
+			event: EventGroupChange,
+			want: `{"id":"key","type":"group.change","version":1,"timestamp":"2024-05-01T07:00:00Z","data":{` +
+				`"chat":{"id":"123@g.us","name":"Operations"},"timestamp":"2024-05-01T07:00:00Z","type":"join","participants":["380671234567@s.whatsapp.net"]}}`,
+			contentType: "application/json",
+		},
+		{
+			name:        "envelope of a connection event",
+			event:       EventConnection,
+			want:        `{"id":"key","type":"connection.state","version":1,"timestamp":"2024-05-01T07:00:00Z","data":{"state":"disconnected"}}`,
+			contentType: "application/json",
+		},
+		{
+			name:        "template with helpers",
+			target:      WebhookTarget{Template: slack, ContentType: "application/json; charset=utf-8"},
+			event:       EventMessageCreated,
+			want:        `{"text": "+380501234567 in Ops: Server is…", "links": "https://whatsgo.example.com/files/Ops/01.05.2024/photo.jpg"}`,
+			contentType: "application/json; charset=utf-8",
+		},
+		{
+			name:        "guarded template on another event",
+			target:      WebhookTarget{Template: slack},
+			event:       EventConnection,
+			want:        ``,
+			contentType: "application/json",
+		},
+		{
+			name:        "plain text template",
+			target:      WebhookTarget{Template: `{{.Type}} {{default "-" .Data.Reason}}`, ContentType: "text/plain"},
+			event:       EventConnection,
+			want:        `connection.state -`,
+			contentType: "text/plain",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.target.Name = "test"
+			test.target.URL = "http://localhost"
+			tracker := newTestWebhookTracker(t, test.target)
+			body, contentType, err := tracker.body(messages[test.event], "key")
+			if err != nil {
+				t.Fatalf("body() error = %v", err)
+			}
+			if string(body) != test.want {
+				t.Errorf("body() =\n%s\nwant\n%s", body, test.want)
+			}
+			if contentType != test.contentType {
+				t.Errorf("body() content type = %q, want %q", contentType, test.contentType)
+			}
+		})
+	}
+}
+
+func TestWebhookRawPayload(t *testing.T) {
+	message := testWebhookMessages()[EventMessageCreated]
+	tracker := newTestWebhookTracker(t, WebhookTarget{Name: "raw", URL: "http://localhost", Payload: webhookPayloadRaw})
+	body, _, err := tracker.body(message, "key")
+	if err != nil {
+		t.Fatalf("body() error = %v", err)
+	}
+	var decoded TrackableMessage
+	if err := json.Unmarshal(body, &decoded); err != nil || decoded.MessageID != "M1" || decoded.Content != message.Content {
+		t.Errorf("body() = %s, want the message as it is", body)
+	}
+}
+
+func TestSign(t *testing.T) {
+	// Computed with: printf '<timestamp>.<body>' | openssl dgst -sha256 -hmac <secret>
+	tests := []struct {
+		secret    string
+		timestamp string
+		body      string
+		want      string
+	}{
+		{"secret", "1714546800", `{"a":1}`, "sha256=4b4ca1633db548e0cd6ba7cf785fc118cdd142b884848fd9376db3689d6c31fb"},
+		{"secret", "1714546801", `{"a":1}`, "sha256=e02bde2fb277ce07a50949f6ef1f798700d91776cfef11aa23a1151599201ace"},
+		{"other", "1714546800", `{"a":1}`, "sha256=2f976d289088c12464fc4fbbab5b4c31965d85ded4176e201b2f4543355f8a3b"},
+		{"secret", "1714546800", ``, "sha256=d95b8d5298462915e6a26607e34c6b3f1c56c31f1e1d9c6910a29a6a72e3300c"},
+	}
+	for _, test := range tests {
+		if got := sign(test.secret, test.timestamp, []byte(test.body)); got != test.want {
+			t.Errorf("sign(%q, %q, %q) = %s, want %s", test.secret, test.timestamp, test.body, got, test.want)
+		}
+	}
+}
+
+func TestWebhookTrackMessage(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		target    WebhookTarget
+		event     string
+		requests  int
+		wantErr   bool
+		permanent bool
+	}{
+		{name: "accepted", status: http.StatusOK, event: EventMessageCreated, requests: 1},
+		{name: "accepted code", status: http.StatusAccepted, target: WebhookTarget{AcceptedCodes: []int{202}}, event: EventMessageCreated, requests: 1},
+		{name: "unexpected code", status: http.StatusOK, target: WebhookTarget{AcceptedCodes: []int{202}}, event: EventMessageCreated, requests: 1, wantErr: true},
+		{name: "server error", status: http.StatusInternalServerError, event: EventMessageCreated, requests: 1, wantErr: true},
+		{name: "skipped event", status: http.StatusOK, target: WebhookTarget{Events: []string{EventMessageCreated}}, event: EventConnection},
+		{name: "empty template", status: http.StatusOK, target: WebhookTarget{Template: `{{if eq .Type "message.created"}}{{.Data.Text}}{{end}}`},
+			event: EventReaction},
+		{name: "render error", status: http.StatusOK, target: WebhookTarget{Template: `{{.Data.Text}}`}, event: EventConnection,
+			wantErr: true, permanent: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, requests := newWebhookServer(t, test.status)
+			test.target.Name = "test"
+			test.target.URL = server.URL
+			test.target.Secret = "secret"
+			test.target.Headers = map[string]string{"Authorization": "Bearer token"}
+			tracker := newTestWebhookTracker(t, test.target)
+			message := testWebhookMessages()[test.event]
+
+			err := tracker.TrackMessage(message)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("TrackMessage() error = %v, want error %v", err, test.wantErr)
+			}
+			var permanent *PermanentError
+			if errors.As(err, &permanent) != test.permanent {
+				t.Errorf("TrackMessage() error = %v, want permanent %v", err, test.permanent)
+			}
+			received := requests()
+			if len(received) != test.requests {
+				t.Fatalf("received %d requests, want %d", len(received), test.requests)
+			}
+			for _, request := range received {
+				header := request.header
+				want := sign("secret", header.Get(webhookTimestampHeader), request.body)
+				if header.Get(webhookSignatureHeader) != want {
+					t.Errorf("signature = %s, want %s", header.Get(webhookSignatureHeader), want)
+				}
+				if header.Get(webhookIdempotencyKeyHeader) != tracker.idempotencyKey(message) {
+					t.Errorf("idempotency key = %s, want %s", header.Get(webhookIdempotencyKeyHeader), tracker.idempotencyKey(message))
+				}
+				if header.Get(webhookEventHeader) != test.event || header.Get("Authorization") != "Bearer token" {
+					t.Errorf("headers = %v", header)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookIdempotencyKeyIsStableAcrossAttempts(t *testing.T) {
+	server, requests := newWebhookServer(t, http.StatusInternalServerError)
+	tracker := newTestWebhookTracker(t, WebhookTarget{Name: "test", URL: server.URL})
+	message := testWebhookMessages()[EventMessageCreated]
+	for i := 0; i < 2; i++ {
+		if err := tracker.TrackMessage(message); err == nil {
+			t.Fatalf("TrackMessage() error = nil, want the status error")
+		}
+	}
+	received := requests()
+	if len(received) != 2 || received[0].header.Get(webhookIdempotencyKeyHeader) != received[1].header.Get(webhookIdempotencyKeyHeader) {
+		t.Errorf("idempotency keys differ between attempts")
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	tracker := newTestWebhookTracker(t, WebhookTarget{Name: "test", URL: "http://localhost",
+		Retry: RetryConfig{MaxAttempts: 3, BaseDelay: time.Second, MaxDelay: 4 * time.Second}})
+	tests := []struct {
+		attempts int
+		min, max time.Duration
+	}{
+		{1, 500 * time.Millisecond, time.Second},
+		{2, time.Second, 2 * time.Second},
+		{3, 2 * time.Second, 4 * time.Second},
+		{10, 2 * time.Second, 4 * time.Second},
+	}
+	for _, test := range tests {
+		for i := 0; i < 20; i++ {
+			if delay := tracker.RetryDelay(test.attempts); delay < test.min || delay > test.max {
+				t.Fatalf("RetryDelay(%d) = %s, want between %s and %s", test.attempts, delay, test.min, test.max)
+			}
+		}
+	}
+	if tracker.MaxAttempts() != 3 {
+		t.Errorf("MaxAttempts() = %d, want 3", tracker.MaxAttempts())
+	}
+}
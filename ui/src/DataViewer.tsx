@@ -5,17 +5,22 @@ import moment from 'moment';
 import {LatLngLiteral} from "leaflet";
 
 import useWS from "./useWS.ts";
-import {Chat, RawMessage, RawMessages} from "./types";
+import {Chat, GroupEvent, PollVoteEvent, RawMessage, RawMessages, ReactionEvent} from "./types";
 import {
+    applyPollVote,
+    applyReaction,
     copyToClipboard,
+    describeGroupEvent,
     downloadJsonFile,
-    getYesterdaysDate, isNewNotificationSupported,
+    getYesterdaysDate, groupEventsFromChange, isNewNotificationSupported,
     parseCoordinatesFromContent,
     parseDateTime,
     uploadJsonFile
 } from "./helpers";
 import {MessageContent} from "./components/MessageContent";
 import {ParsedContent} from "./components/ParsedContent.tsx";
+import {MessageReactions} from "./components/MessageReactions.tsx";
+import {PollResults} from "./components/PollResults.tsx";
 import {PolygonMap, PolygonMapLayer, isPointInPolygon, polygonColors} from "./components/PolygonMap.tsx";
 
 let _host = window.location.host;
@@ -91,7 +96,11 @@ const useStyles = createUseStyles({
     },
     selectedMultiple: {
         background: 'rgba(155, 89, 182, 1)',
-    }
+    },
+    groupEvent: {
+        color: 'grey',
+        fontStyle: 'italic',
+    },
 })
 
 const notificationSound = '/notify.mp3';
@@ -106,6 +115,7 @@ function DataViewer() {
     const [chats, setChats] = useState<{ [key: string]: string }>({});
     const [selectedChat, setSelectedChat] = useState('');
     const [messages, setMessages] = useState<RawMessages>([]);
+    const [groupEvents, setGroupEvents] = useState<GroupEvent[]>([]);
     const [lastMessageTs, setLastMessageTs] = useState('');
     const [loading, setLoading] = useState(false);
     const [justOpened, setJustOpened] = useState(true);
@@ -139,6 +149,27 @@ function DataViewer() {
         }
     });
 
+    const {connectWS: connectEventsWS, disconnectWS: disconnectEventsWS} = useWS({
+        url: `ws://${host}/ws/events`,
+        onMessage: (event) => {
+            const {type, data} = JSON.parse(event.data);
+            if (type === 'group.change') {
+                setGroupEvents((events) => [...groupEventsFromChange(data), ...events]);
+            }
+            // reaction counts and poll results of shown messages are updated live
+            if (type === 'reaction') {
+                const reaction = data as ReactionEvent;
+                setMessages((messages) => messages.map((message) => message.id === reaction.Reaction.message_id ?
+                    {...message, reactions: applyReaction(message.reactions, reaction)} : message));
+            }
+            if (type === 'poll.vote') {
+                const vote = data as PollVoteEvent;
+                setMessages((messages) => messages.map((message) => message.id === vote.PollVote.poll_id && message.poll ?
+                    {...message, poll: applyPollVote(message.poll, vote)} : message));
+            }
+        }
+    });
+
     useEffect(() => {
         localStorage.setItem('selectedContentGroups', JSON.stringify(selectedContentGroups));
     }, [selectedContentGroups]);
@@ -235,9 +266,11 @@ function DataViewer() {
         requestNotificationPermission();
 
         connectWS();
+        connectEventsWS();
 
         return () => {
             disconnectWS();
+            disconnectEventsWS();
         };
     }, []);
 
@@ -260,11 +293,28 @@ function DataViewer() {
         return messages;
     }, [selectedChat, messages]);
 
+    // messages and changes of groups ordered by time, newest first
+    const timeline = useMemo(() => {
+        const items: ({ kind: 'message', message: RawMessage } | { kind: 'group', event: GroupEvent })[] = [
+            ...filteredMessages.map((message) => ({kind: 'message' as const, message})),
+            ...groupEvents
+                .filter((event) => !selectedChat || event.chat === selectedChat)
+                .map((event) => ({kind: 'group' as const, event})),
+        ];
+        const time = (item: typeof items[number]) =>
+            moment(item.kind === 'message' ? item.message.timestamp : item.event.timestamp, 'YYYY-MM-DD HH:mm:ss Z').valueOf();
+        return items.sort((a, b) => time(b) - time(a));
+    }, [selectedChat, filteredMessages, groupEvents]);
+
     const handleSubmit = async () => {
         await handleUserInteraction();
         setLoading(true);
         setJustOpened(false);
         setLastContent(content);
+        fetch(`http://${host}/group-events?from=${moment(dateFrom).format('DD.MM.YYYY')}&to=${moment(dateTo).format('DD.MM.YYYY')}`)
+            .then(response => response.json())
+            .then(data => setGroupEvents(data || []))
+            .catch((error) => console.error("Failed to get group events:", error));
         fetch(`http://${host}/messages?from=${moment(dateFrom).format('DD.MM.YYYY')}&to=${moment(dateTo).format('DD.MM.YYYY')}&content=${content}`)
             .then(response => response.json())
             .then(data => {
@@ -526,7 +576,7 @@ function DataViewer() {
                         <div className={classes.spinnerWrap}>
                             <div className={classes.spinner}></div>
                         </div> : <div className={classes.dataTable}>
-                            {messages.length ? <table className={classes.table}>
+                            {timeline.length ? <table className={classes.table}>
                                 <thead>
                                 <tr>
                                     <th>
@@ -568,7 +618,23 @@ function DataViewer() {
                                 </tr>
                                 </thead>
                                 <tbody>
-                                {filteredMessages.map((message) => {
+                                {timeline.map((item) => {
+                                    if (item.kind === 'group') {
+                                        const event = item.event;
+                                        const ts = moment(event.timestamp, 'YYYY-MM-DD HH:mm:ss Z').format('HH:mm:ss DD.MM.YYYY');
+                                        return (
+                                            <tr key={`${event.chat}-${event.timestamp}-${event.type}-${event.participant}`}
+                                                className={classes.dataRow}>
+                                                <td></td>
+                                                <td className={classes.td}>{ts}</td>
+                                                <td className={classes.td}>{chats[event.chat] || event.chat_name || event.chat}</td>
+                                                <td className={`${classes.td} ${classes.groupEvent}`} colSpan={2}>
+                                                    {describeGroupEvent(event)}
+                                                </td>
+                                            </tr>
+                                        );
+                                    }
+                                    const message = item.message;
                                     //parse string like `2024-08-10 15:06:22 +0300 EEST`
                                     const ts = moment(message.timestamp, 'YYYY-MM-DD HH:mm:ss Z').format('HH:mm:ss DD.MM.YYYY');
                                     let chatName;
@@ -606,6 +672,8 @@ function DataViewer() {
                                                 />
                                                 {message.filename && <a href={message.filename}
                                                                         target="_blank" rel="noreferrer">Download</a>}
+                                                {message.poll && <PollResults poll={message.poll}/>}
+                                                <MessageReactions reactions={message.reactions}/>
                                             </td>
                                             <td className={classes.td}>
                                                 <ParsedContent message={message}/>
@@ -0,0 +1,23 @@
+import {Reactions} from "../types.ts";
+
+export const MessageReactions = ({reactions}: {
+    reactions?: Reactions
+}) => {
+    const counts = Object.entries(reactions?.counts || {});
+    if (!counts.length) {
+        return null;
+    }
+    return (
+        <div style={{display: 'flex', flexWrap: 'wrap', gap: '0.25rem', marginTop: '0.25rem'}}>
+            {counts.map(([emoji, count]) => (
+                <span key={emoji}
+                      title={reactions?.reactions.filter((reaction) => reaction.emoji === emoji).map((reaction) => reaction.sender).join(', ')}
+                      style={{
+                          border: '1px solid #f3f3f3',
+                          borderRadius: '1rem',
+                          padding: '0 0.5rem',
+                      }}>{emoji} {count}</span>
+            ))}
+        </div>
+    );
+};
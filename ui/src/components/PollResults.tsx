@@ -0,0 +1,26 @@
+import {PollResult} from "../types.ts";
+
+export const PollResults = ({poll}: {
+    poll: PollResult
+}) => {
+    const total = poll.options.reduce((sum, option) => sum + option.votes, 0);
+    return (
+        <div style={{marginTop: '0.25rem'}}>
+            <div style={{fontWeight: 'bold'}}>{poll.question}</div>
+            {poll.options.map((option) => {
+                const share = total ? Math.round(option.votes * 100 / total) : 0;
+                return (
+                    <div key={option.name} title={option.voters.join(', ')} style={{margin: '0.25rem 0'}}>
+                        <div style={{display: 'flex', justifyContent: 'space-between', gap: '1rem'}}>
+                            <span>{option.name}</span>
+                            <span>{option.votes}</span>
+                        </div>
+                        <div style={{background: '#f3f3f3', height: '4px', borderRadius: '2px'}}>
+                            <div style={{background: '#3498db', height: '4px', borderRadius: '2px', width: `${share}%`}}/>
+                        </div>
+                    </div>
+                );
+            })}
+        </div>
+    );
+};
@@ -1,6 +1,6 @@
 import moment from "moment";
 
-import {RawMessage} from "./types.ts";
+import {GroupChangeEvent, GroupEvent, PollResult, PollVoteEvent, RawMessage, ReactionEvent, Reactions} from "./types.ts";
 
 export const parseDateTime = (message: RawMessage): Date | null => {
     const input = message.content;
@@ -122,4 +122,73 @@ export const isNewNotificationSupported = () => {
         }
     }
     return true;
-}
\ No newline at end of file
+}
+// splits a change of the events WebSocket into rows of the group audit log, one per participant
+export const groupEventsFromChange = (data: GroupChangeEvent): GroupEvent[] => {
+    const {type, participants, value, reason} = data.GroupChange;
+    const base: GroupEvent = {
+        chat: data.Chat,
+        chat_name: data.ChatName,
+        type,
+        actor: data.Sender,
+        actor_name: data.SenderName,
+        value,
+        reason,
+        timestamp: data.Timestamp,
+    };
+    if (!participants?.length) {
+        return [base];
+    }
+    return participants.map((participant) => ({...base, participant}));
+}
+
+export const describeGroupEvent = (event: GroupEvent): string => {
+    const actor = event.actor_name || event.actor;
+    const participant = event.participant_name || event.participant;
+    const by = actor && actor !== participant ? ` by ${actor}` : '';
+    switch (event.type) {
+        case 'join':
+            return `${participant} joined${by}${event.reason ? ` (${event.reason})` : ''}`;
+        case 'leave':
+            return actor && actor !== participant ? `${participant} was removed${by}` : `${participant} left`;
+        case 'promote':
+            return `${participant} was promoted to admin${by}`;
+        case 'demote':
+            return `${participant} was demoted${by}`;
+        case 'subject':
+            return `Subject changed to "${event.value}"${by}`;
+        case 'description':
+            return event.value ? `Description changed to "${event.value}"${by}` : `Description removed${by}`;
+        case 'picture':
+            return event.value ? `Picture changed${by}` : `Picture removed${by}`;
+    }
+    return event.type;
+}
+
+// replaces the reaction of the sender of a `reaction` event and counts the emojis again
+export const applyReaction = (reactions: Reactions | undefined, data: ReactionEvent): Reactions => {
+    const list = (reactions?.reactions || []).filter((reaction) => reaction.sender !== data.Sender);
+    if (data.Reaction.emoji) {
+        list.push({sender: data.Sender, emoji: data.Reaction.emoji, timestamp: data.Timestamp});
+    }
+    const counts: Reactions['counts'] = {};
+    list.forEach((reaction) => {
+        counts[reaction.emoji] = (counts[reaction.emoji] || 0) + 1;
+    });
+    return {counts, reactions: list};
+}
+
+// replaces the vote of the sender of a `poll.vote` event in the results of the poll
+export const applyPollVote = (poll: PollResult, data: PollVoteEvent): PollResult => {
+    const selected = (data.PollVote.options || []).map((option) => option.name);
+    return {
+        ...poll,
+        options: poll.options.map((option) => {
+            const voters = option.voters.filter((voter) => voter !== data.Sender);
+            if (selected.includes(option.name)) {
+                voters.push(data.Sender);
+            }
+            return {...option, votes: voters.length, voters};
+        }),
+    };
+}
@@ -1,14 +1,129 @@
+export interface Location {
+    latitude: number;
+    longitude: number;
+    accuracy?: number;
+    name?: string;
+    address?: string;
+    live: boolean;
+}
+
+export interface MessageContext {
+    quoted_message_id?: string;
+    quoted_sender?: string;
+    forwarded?: boolean;
+    forwarding_score?: number;
+    mentions?: string[];
+}
+
+export interface Attachment {
+    id: string;
+    url: string;
+    mime_type?: string;
+    size: number;
+    sha256?: string;
+    file_name?: string;
+    caption?: string;
+    width?: number;
+    height?: number;
+    duration?: number;
+}
+
+export interface Reaction {
+    sender: string;
+    emoji: string;
+    timestamp: string;
+}
+
+// Reactions to a message with the number of every emoji, as returned by `/reactions`
+export interface Reactions {
+    counts: { [emoji: string]: number };
+    reactions: Reaction[];
+}
+
+export interface PollResultOption {
+    name: string;
+    votes: number;
+    voters: string[];
+}
+
+// A poll with its current results, as returned by `/polls`
+export interface PollResult {
+    id: string;
+    question: string;
+    selectable_count: number;
+    options: PollResultOption[];
+}
+
 export interface RawMessage {
     id: string;
     sender: string;
+    sender_name?: string;
     chat: string;
+    chat_name?: string;
     content: string;
     timestamp: string;
     filename: string | null;
+    files?: Attachment[];
+    location?: Location;
+    context?: MessageContext;
+    edited_at?: string;
+    deleted_at?: string;
+    reactions?: Reactions;
+    poll?: PollResult;
 }
 
 export type RawMessages = RawMessage[];
 
+export type GroupChangeType = 'join' | 'leave' | 'promote' | 'demote' | 'subject' | 'description' | 'picture';
+
+export interface GroupEvent {
+    chat: string;
+    chat_name?: string;
+    type: GroupChangeType;
+    actor?: string;
+    actor_name?: string;
+    participant?: string;
+    participant_name?: string;
+    value?: string;
+    reason?: string;
+    timestamp: string;
+}
+
+// Data of a `group.change` event of the events WebSocket
+export interface GroupChangeEvent {
+    Chat: string;
+    ChatName?: string;
+    Sender?: string;
+    SenderName?: string;
+    Timestamp: string;
+    GroupChange: {
+        type: GroupChangeType;
+        participants?: string[];
+        value?: string;
+        reason?: string;
+    };
+}
+
+// Data of a `reaction` event of the events WebSocket, an empty emoji removes the reaction of the sender
+export interface ReactionEvent {
+    Sender: string;
+    Timestamp: string;
+    Reaction: {
+        message_id: string;
+        emoji: string;
+    };
+}
+
+// Data of a `poll.vote` event of the events WebSocket, the options replace the previous vote of the sender
+export interface PollVoteEvent {
+    Sender: string;
+    Timestamp: string;
+    PollVote: {
+        poll_id: string;
+        options?: { hash: string; name: string }[];
+    };
+}
+
 export interface Chat {
     Alias: string;
     ID: string;